@@ -0,0 +1,315 @@
+package stick
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// valueKind classifies a Value for the purposes of comparison.
+type valueKind int
+
+const (
+	kindNull valueKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindString
+	kindArray
+	kindOther
+)
+
+// numericStringMatcher matches strings that PHP 8 considers numeric.
+// Leading and trailing whitespace is allowed.
+var numericStringMatcher = regexp.MustCompile(`^[ \t\n\r\v\f]*[+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?[ \t\n\r\v\f]*$`)
+
+// isNumericString returns true if s is a numeric string.
+func isNumericString(s string) bool {
+	return numericStringMatcher.MatchString(s)
+}
+
+// kindOf returns the kind of the given Value. SafeValues should be
+// unwrapped before calling kindOf.
+func kindOf(v Value) valueKind {
+	switch v.(type) {
+	case nil:
+		return kindNull
+	case bool:
+		return kindBool
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return kindInt
+	case float32, float64:
+		return kindFloat
+	case string:
+		return kindString
+	case decimal.Decimal, Number:
+		if toNumeric(v).isInt {
+			return kindInt
+		}
+		return kindFloat
+	case *OrderedMap:
+		return kindArray
+	case Stringer:
+		return kindString
+	case Boolean:
+		return kindBool
+	}
+	r := reflect.Indirect(reflect.ValueOf(v))
+	switch r.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return kindArray
+	}
+	return kindOther
+}
+
+// unwrapSafe returns the value wrapped by a SafeValue, or v itself.
+func unwrapSafe(v Value) Value {
+	if sv, ok := v.(SafeValue); ok {
+		return unwrapSafe(sv.Value())
+	}
+	return v
+}
+
+// truthy returns the boolean value of v as PHP would when comparing.
+func truthy(v Value, k valueKind) bool {
+	switch k {
+	case kindNull:
+		return false
+	case kindInt, kindFloat:
+		return toNumeric(v).float() != 0
+	case kindString:
+		s := CoerceString(v)
+		return s != "" && s != "0"
+	case kindArray:
+		l, _ := Len(v)
+		return l > 0
+	}
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return CoerceBool(v)
+}
+
+// arrayEntries returns the keys and values of an array-like Value. Keys are
+// converted to strings so that slices and maps can be compared.
+func arrayEntries(v Value) ([]string, map[string]Value) {
+	keys := make([]string, 0)
+	vals := make(map[string]Value)
+	Iterate(v, func(k, v Value, l Loop) (bool, error) {
+		ks := CoerceString(k)
+		keys = append(keys, ks)
+		vals[ks] = v
+		return false, nil
+	})
+	return keys, vals
+}
+
+func compareInts(l, r int) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func compareNumbers(left, right Value) int {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		switch {
+		case l.i < r.i:
+			return -1
+		case l.i > r.i:
+			return 1
+		}
+		return 0
+	}
+	lf, rf := l.float(), r.float()
+	switch {
+	case lf < rf:
+		return -1
+	case lf > rf:
+		return 1
+	}
+	return 0
+}
+
+// compare compares two values following PHP 8 loose comparison rules. The
+// second return value is false if the values cannot be compared, such as two
+// arrays with different keys.
+func compare(left, right Value) (int, bool) {
+	left, right = unwrapSafe(left), unwrapSafe(right)
+	lk, rk := kindOf(left), kindOf(right)
+
+	switch {
+	case lk == kindNull && rk == kindNull:
+		return 0, true
+
+	case lk == kindBool || rk == kindBool,
+		lk == kindNull && rk != kindString,
+		rk == kindNull && lk != kindString:
+		// Comparisons with bool, or with null other than against a string,
+		// convert both sides to bool.
+		lb, rb := truthy(left, lk), truthy(right, rk)
+		switch {
+		case lb == rb:
+			return 0, true
+		case rb:
+			return -1, true
+		}
+		return 1, true
+
+	case lk == kindNull || rk == kindNull:
+		// Null compared to a string is treated as the empty string.
+		return strings.Compare(CoerceString(left), CoerceString(right)), true
+
+	case lk == kindArray && rk == kindArray:
+		return compareArrays(left, right)
+
+	case lk == kindArray:
+		// Arrays are always greater.
+		return 1, true
+
+	case rk == kindArray:
+		return -1, true
+
+	case isNumberKind(lk) && isNumberKind(rk):
+		return compareNumbers(left, right), true
+
+	case isNumberKind(lk) && rk == kindString:
+		if s := CoerceString(right); isNumericString(s) {
+			return compareNumbers(left, s), true
+		}
+		return strings.Compare(CoerceString(left), CoerceString(right)), true
+
+	case lk == kindString && isNumberKind(rk):
+		if s := CoerceString(left); isNumericString(s) {
+			return compareNumbers(s, right), true
+		}
+		return strings.Compare(CoerceString(left), CoerceString(right)), true
+
+	case lk == kindString && rk == kindString:
+		ls, rs := CoerceString(left), CoerceString(right)
+		if isNumericString(ls) && isNumericString(rs) {
+			return compareNumbers(ls, rs), true
+		}
+		return strings.Compare(ls, rs), true
+	}
+
+	// Other values are only equal to values of the same type.
+	if reflect.TypeOf(left) == reflect.TypeOf(right) && reflect.DeepEqual(left, right) {
+		return 0, true
+	}
+	return 1, false
+}
+
+func isNumberKind(k valueKind) bool {
+	return k == kindInt || k == kindFloat
+}
+
+// compareArrays compares two array-like values. Smaller arrays are less than
+// larger ones. Arrays of the same size are compared value by value and cannot
+// be compared if a key in left does not exist in right.
+func compareArrays(left, right Value) (int, bool) {
+	lkeys, lvals := arrayEntries(left)
+	rkeys, rvals := arrayEntries(right)
+	if c := compareInts(len(lkeys), len(rkeys)); c != 0 {
+		return c, true
+	}
+	for _, k := range lkeys {
+		rv, ok := rvals[k]
+		if !ok {
+			return 1, false
+		}
+		c, ok := compare(lvals[k], rv)
+		if !ok {
+			return 1, false
+		}
+		if c != 0 {
+			return c, true
+		}
+	}
+	return 0, true
+}
+
+// Compare compares two values, returning -1, 0, or 1 if left is less than,
+// equal to, or greater than right. This is the "<=>" operator.
+//
+// Values are compared following PHP 8 (and Twig) semantics. Numbers and
+// numeric strings are compared numerically, other strings are compared
+// lexically, and comparisons with booleans or null compare truthiness.
+// Arrays and maps are compared by size and then value by value. Values
+// that cannot be compared result in 1.
+func Compare(left, right Value) int {
+	c, _ := compare(left, right)
+	return c
+}
+
+// Equal returns true if the two Values are loosely equal, as with the "=="
+// operator.
+//
+// For example, 1 == "1.0" and null == false are true, but 0 == "a" is false.
+func Equal(left Value, right Value) bool {
+	c, ok := compare(left, right)
+	return ok && c == 0
+}
+
+// Same returns true if the two values are identical, as with the "same as"
+// test. Unlike Equal, no type conversion is done; 1 is not the same as "1"
+// or 1.0, and a Stringer is not the same as a string. Arrays are the same
+// when they have the same keys in the same order and their values are the
+// same.
+func Same(left, right Value) bool {
+	left, right = unwrapSafe(left), unwrapSafe(right)
+	lk, rk := kindOf(left), kindOf(right)
+	if lk != rk {
+		return false
+	}
+	switch lk {
+	case kindNull:
+		return true
+	case kindBool:
+		return truthy(left, lk) == truthy(right, rk)
+	case kindInt, kindFloat:
+		return compareNumbers(left, right) == 0
+	case kindString:
+		// A Stringer is an object; it is never the same as a string.
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok || rok {
+			return lok && rok && ls == rs
+		}
+	case kindArray:
+		lkeys, lvals := arrayEntries(left)
+		rkeys, rvals := arrayEntries(right)
+		if len(lkeys) != len(rkeys) {
+			return false
+		}
+		ordered := isOrdered(left) && isOrdered(right)
+		for i, k := range lkeys {
+			if ordered && rkeys[i] != k {
+				return false
+			}
+			rv, ok := rvals[k]
+			if !ok || !Same(lvals[k], rv) {
+				return false
+			}
+		}
+		return true
+	}
+	lt := reflect.TypeOf(left)
+	if lt != reflect.TypeOf(right) || !lt.Comparable() {
+		return false
+	}
+	return left == right
+}
+
+// isOrdered returns true if the iteration order of the array-like value is
+// meaningful. Go maps have no defined order.
+func isOrdered(v Value) bool {
+	_, ok := v.(*OrderedMap)
+	return ok || IsArray(v)
+}
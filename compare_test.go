@@ -0,0 +1,79 @@
+package stick
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		left, right Value
+		expected    int
+		equal       bool
+	}{
+		{1, "1.0", 0, true},
+		{1, 1.0, 0, true},
+		{"1e3", "1000", 0, true},
+		{"abc", "abd", -1, false},
+		{"apple", "banana", -1, false},
+		{0, "a", -1, false},
+		{"1", "01", 0, true},
+		{"10", "9", 1, false},
+		{"10", "9a", -1, false},
+		{nil, false, 0, true},
+		{nil, 0, 0, true},
+		{nil, "", 0, true},
+		{nil, "a", -1, false},
+		{true, "a", 0, true},
+		{false, 0, 0, true},
+		{[]int{1, 2}, []int{1, 2}, 0, true},
+		{[]int{1, 2}, []int{1, 3}, -1, false},
+		{[]int{1, 2, 3}, []int{1, 3}, 1, false},
+		{[]int{1, 2}, "12", 1, false},
+		{[]int{}, false, 0, true},
+		{map[string]int{"a": 1}, map[string]Value{"a": "1"}, 0, true},
+		{int64(9007199254740993), int64(9007199254740992), 1, false},
+		{NewSafeValue("a", "html"), "a", 0, true},
+	}
+	for _, test := range tests {
+		if c := Compare(test.left, test.right); c != test.expected {
+			t.Errorf("Compare(%#v, %#v): expected %d, got %d", test.left, test.right, test.expected, c)
+		}
+		if eq := Equal(test.left, test.right); eq != test.equal {
+			t.Errorf("Equal(%#v, %#v): expected %v, got %v", test.left, test.right, test.equal, eq)
+		}
+	}
+}
+
+func TestSame(t *testing.T) {
+	om := NewOrderedMap()
+	om.Set("a", 1)
+	om.Set("b", 2)
+	om2 := NewOrderedMap()
+	om2.Set("b", 2)
+	om2.Set("a", 1)
+
+	tests := []struct {
+		left, right Value
+		expected    bool
+	}{
+		{1, 1, true},
+		{1, int64(1), true},
+		{1, 1.0, false},
+		{1, "1", false},
+		{"a", "a", true},
+		{testType{}, "some string", false},
+		{"some string", testType{}, false},
+		{testType{}, testType{}, true},
+		{NewSafeValue("a", "html"), "a", true},
+		{nil, nil, true},
+		{nil, false, false},
+		{true, true, true},
+		{[]int{1, 2}, []int64{1, 2}, true},
+		{[]int{1, 2}, []Value{1, "2"}, false},
+		{om, om, true},
+		{om, om2, false},
+	}
+	for _, test := range tests {
+		if s := Same(test.left, test.right); s != test.expected {
+			t.Errorf("Same(%#v, %#v): expected %v, got %v", test.left, test.right, test.expected, s)
+		}
+	}
+}
@@ -3,7 +3,8 @@ Package stick is a Go language port of the Twig templating engine.
 
 Stick executes Twig templates and allows users to define custom Functions,
 Filters, and Tests. The parser allows parse-time node inspection with
-NodeVisitors, and a template Loader to load named templates from any source.
+NodeVisitors and modification with NodeTransformers, and a template Loader to
+load named templates from any source.
 
 # Twig compatibility
 
@@ -41,8 +42,13 @@ Another example, using a FilesystemLoader and responding to an HTTP request:
 # Types and values
 
 Any user value in Stick is represented by a stick.Value. There are three main types
-in Stick when it comes to built-in operations: strings, numbers, and booleans. Of note,
-numbers are represented by float64 as this matches regular Twig behavior most closely.
+in Stick when it comes to built-in operations: strings, numbers, and booleans.
+
+Numbers follow PHP semantics, as regular Twig does. Integer literals evaluate to int64
+and arithmetic on two integers stays an integer whenever the result fits, so large IDs
+do not lose precision. Otherwise, numbers are represented by float64. Division returns
+an integer only when there is no remainder ({{ 10 / 4 }} is 2.5, {{ 10 / 5 }} is 2),
+and dividing by zero is an error.
 
 Stick makes no restriction on what is stored in a stick.Value, but some built-in
 operators will try to coerce a value into a boolean, string, or number depending
@@ -123,5 +129,32 @@ User-defined types are added to an Env after it is created. For example:
 		// Probably not that useful.
 		return stick.CoerceBool(val) == false
 	}
+
+# User defined tags
+
+Tags are added by registering a parse.TagParser in Env.Tags. The TagParser
+uses the exported methods on parse.Tree, such as ParseExpr, Expect, Peek,
+ParseUntilTag and ParseUntilEndTag, to parse the rest of the tag and return
+a Node.
+
+Custom nodes are executed by implementing ExecutableNode. The Context passed
+to Execute can evaluate expressions and render child nodes. Embedding
+parse.Range in a custom node lets the parser record where the tag starts and
+ends in the source.
+
+	env.Tags["feature"] = func(t *parse.Tree, start parse.Pos) (parse.Node, error) {
+		name, err := t.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		body, err := t.ParseUntilEndTag("feature", start)
+		if err != nil {
+			return nil, err
+		}
+		return &featureNode{parse.Range{Pos: start}, parse.TrimmableNode{}, name, body}, nil
+	}
 */
 package stick
@@ -0,0 +1,238 @@
+package stick
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// An UndefinedError is returned when a template refers to a function, filter
+// or test that is not defined in the Env.
+type UndefinedError struct {
+	Kind     string      // The kind of the undefined name: "function", "filter" or "test".
+	Name     string      // The undefined name.
+	Template string      // The name of the template containing the reference.
+	Range    parse.Range // The location of the reference in the template.
+
+	msg string // Replaces the default message, if set.
+}
+
+func (e *UndefinedError) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+	switch e.Kind {
+	case "test":
+		return fmt.Sprintf(`unknown test "%s"`, e.Name)
+	default:
+		return fmt.Sprintf(`Undeclared %s "%s"`, e.Kind, e.Name)
+	}
+}
+
+// newUndefinedError returns a new UndefinedError for the given expression.
+// The range of a filter covers only its name, not the value it is applied to.
+func (s *state) newUndefinedError(kind, name string, exp parse.Expr) error {
+	r := parse.Range{Pos: exp.Start(), EndPos: exp.End()}
+	if f, ok := exp.(*parse.FilterExpr); ok {
+		end := f.NamePos
+		end.Offset += len(f.Name)
+		end.Byte += len(f.Name)
+		r = parse.Range{Pos: f.NamePos, EndPos: end}
+	}
+	return &UndefinedError{Kind: kind, Name: name, Template: s.name, Range: r}
+}
+
+// FormatError returns a human-friendly description of err, meant to be shown
+// to template authors.
+//
+// Errors that refer to a location in a template are rendered with the
+// offending line of source, marked with a caret. Tokens are described as they
+// appear in the template, using the delimiters configured in the Env. Unknown
+// tags, filters, functions and tests include suggestions based on the names
+// registered in the Env. Any other error is returned as is.
+func (env *Env) FormatError(err error) string {
+	switch err := err.(type) {
+	case parse.ParsingErrors:
+		res := make([]string, len(err))
+		for i, e := range err {
+			res[i] = env.FormatError(e)
+		}
+		return strings.Join(res, "\n")
+
+	case parse.ParsingError:
+		var names []string
+		if e, ok := err.(*parse.UnknownTagError); ok {
+			names = suggest(e.TagName(), e.KnownTags())
+		}
+		return env.formatError(parse.Describe(err, env.Delimiters), err.Name(), err.Start(), err.End(), names)
+
+	case *UndefinedError:
+		var known []string
+		switch err.Kind {
+		case "function":
+			for name := range env.Functions {
+				known = append(known, name)
+			}
+		case "filter":
+			for name := range env.Filters {
+				known = append(known, name)
+			}
+		case "test":
+			for name := range env.Tests {
+				known = append(known, name)
+			}
+		}
+		msg := fmt.Sprintf(`undefined %s "%s"`, err.Kind, err.Name)
+		return env.formatError(msg, err.Template, err.Range.Pos, err.Range.End(), suggest(err.Name, known))
+	}
+	return err.Error()
+}
+
+// formatError renders a message, followed by the source line at start with
+// the range up to end underlined, and any suggestions.
+func (env *Env) formatError(msg, name string, start, end parse.Pos, suggestions []string) string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "error: %s\n", msg)
+	src, ok := env.source(name)
+	if ok && name != src {
+		fmt.Fprintf(buf, "  --> %s, line %d, column %d\n", name, start.Line, start.Offset)
+	} else {
+		fmt.Fprintf(buf, "  --> line %d, column %d\n", start.Line, start.Offset)
+	}
+	if ok && start.Byte <= len(src) {
+		lineStart := strings.LastIndex(src[:start.Byte], "\n") + 1
+		lineEnd := strings.IndexByte(src[start.Byte:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(src)
+		} else {
+			lineEnd += start.Byte
+		}
+		width := 1
+		if end.Byte > start.Byte {
+			if end.Byte > lineEnd {
+				end.Byte = lineEnd
+			}
+			width = end.Byte - start.Byte
+		}
+		if width < 1 {
+			width = 1
+		}
+		gutter := fmt.Sprint(start.Line)
+		pad := strings.Repeat(" ", len(gutter))
+		// Keep tabs before the caret so it lines up with the source.
+		indent := strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return r
+			}
+			return ' '
+		}, src[lineStart:start.Byte])
+		fmt.Fprintf(buf, "%s |\n", pad)
+		fmt.Fprintf(buf, "%s | %s\n", gutter, src[lineStart:lineEnd])
+		fmt.Fprintf(buf, "%s | %s^%s\n", pad, indent, strings.Repeat("~", width-1))
+	}
+	if len(suggestions) > 0 {
+		fmt.Fprintf(buf, "  = did you mean %s?\n", quoteList(suggestions))
+	}
+	return buf.String()
+}
+
+// source returns the contents of the named template, if it can be loaded.
+func (env *Env) source(name string) (string, bool) {
+	if env.Loader == nil {
+		return "", false
+	}
+	tpl, err := env.Loader.Load(name)
+	if err != nil {
+		return "", false
+	}
+	b, err := ioutil.ReadAll(tpl.Contents())
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// quoteList returns the quoted names, separated by commas and a final "or".
+func quoteList(names []string) string {
+	res := ""
+	for i, name := range names {
+		switch {
+		case i == 0:
+		case i == len(names)-1:
+			res += " or "
+		default:
+			res += ", "
+		}
+		res += fmt.Sprintf(`"%s"`, name)
+	}
+	return res
+}
+
+// maxSuggestions is the maximum number of names suggested for a misspelling.
+const maxSuggestions = 3
+
+// suggest returns the known names that are most similar to name, closest first.
+// Names that differ too much from name are not suggested.
+func suggest(name string, known []string) []string {
+	type match struct {
+		name string
+		dist int
+	}
+	var matches []match
+	limit := len([]rune(name))/3 + 1
+	for _, k := range known {
+		if k == name {
+			continue
+		}
+		if d := levenshtein(name, k); d <= limit {
+			matches = append(matches, match{k, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].dist != matches[j].dist {
+			return matches[i].dist < matches[j].dist
+		}
+		return matches[i].name < matches[j].name
+	})
+	var res []string
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		res = append(res, matches[i].name)
+	}
+	return res
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(vals ...int) int {
+	res := vals[0]
+	for _, v := range vals[1:] {
+		if v < res {
+			res = v
+		}
+	}
+	return res
+}
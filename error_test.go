@@ -0,0 +1,141 @@
+package stick
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/tyler-sommer/stick/parse"
+)
+
+func TestFormatError(t *testing.T) {
+	env := New(&MemoryLoader{map[string]string{
+		"tag.twig":    "Hello\n{% fo x in y %}{% endfor %}",
+		"filter.twig": "Hi\n\t<< name|uppr >>",
+		"chain.twig":  "<< name|upper|uppr(1) >>",
+		"apply.twig":  "{% apply upper|uppr %}x{% endapply %}",
+		"test.twig":   "{% if 2 is evn %}{% endif %}",
+		"func.twig":   "<< lenght(name) >>",
+		"token.twig":  "<< a b >>",
+	}})
+	env.Filters["upper"] = func(ctx Context, val Value, args ...Value) Value { return val }
+	env.Tests["even"] = func(ctx Context, val Value, args ...Value) bool { return true }
+	env.Functions["length"] = func(ctx Context, args ...Value) Value { return nil }
+	env.Delimiters = parse.Delimiters{PrintOpen: "<<", PrintClose: ">>"}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"tag.twig", `error: unknown tag "fo"
+  --> tag.twig, line 2, column 3
+  |
+2 | {% fo x in y %}{% endfor %}
+  |    ^~
+  = did you mean "do" or "for"?
+`},
+		{"filter.twig", `error: undefined filter "uppr"
+  --> filter.twig, line 2, column 9
+  |
+2 | 	<< name|uppr >>
+  | 	        ^~~~
+  = did you mean "upper"?
+`},
+		{"chain.twig", `error: undefined filter "uppr"
+  --> chain.twig, line 1, column 14
+  |
+1 | << name|upper|uppr(1) >>
+  |               ^~~~
+  = did you mean "upper"?
+`},
+		{"apply.twig", `error: undefined filter "uppr"
+  --> apply.twig, line 1, column 15
+  |
+1 | {% apply upper|uppr %}x{% endapply %}
+  |                ^~~~
+  = did you mean "upper"?
+`},
+		{"test.twig", `error: undefined test "evn"
+  --> test.twig, line 1, column 11
+  |
+1 | {% if 2 is evn %}{% endif %}
+  |            ^~~
+  = did you mean "even"?
+`},
+		{"func.twig", `error: undefined function "lenght"
+  --> func.twig, line 1, column 3
+  |
+1 | << lenght(name) >>
+  |    ^~~~~~~~~~~~
+  = did you mean "length"?
+`},
+		{"token.twig", `error: expected end of print ">>", got name "b"
+  --> token.twig, line 1, column 5
+  |
+1 | << a b >>
+  |      ^
+`},
+	}
+	for _, test := range tests {
+		err := env.Execute(test.name, &bytes.Buffer{}, map[string]Value{"name": "x"})
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if res := env.FormatError(err); res != test.expected {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, res, test.expected)
+		}
+	}
+}
+
+func TestFormatErrorStringLoader(t *testing.T) {
+	env := New(nil)
+	err := env.Execute("{{ 'a' }}{{ 'b' )}}", &bytes.Buffer{}, nil)
+	expected := `error: expected end of print "}}", got ")"
+  --> line 1, column 16
+  |
+1 | {{ 'a' }}{{ 'b' )}}
+  |                 ^
+`
+	if res := env.FormatError(err); res != expected {
+		t.Errorf("got\n%s\nexpected\n%s", res, expected)
+	}
+}
+
+func TestUndefinedErrorMessage(t *testing.T) {
+	env := New(nil)
+	tests := []struct {
+		tpl      string
+		expected string
+	}{
+		{"{{ name|uppr }}", `Undeclared filter "uppr"`},
+		{"{% apply uppr %}x{% endapply %}", `undefined filter "uppr".`},
+		{"{{ lenght(name) }}", `Undeclared function "lenght"`},
+		{"{% if 2 is evn %}{% endif %}", `unknown test "evn"`},
+	}
+	for _, test := range tests {
+		err := env.Execute(test.tpl, &bytes.Buffer{}, nil)
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%s: expected error %q, got %v", test.tpl, test.expected, err)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	known := []string{"upper", "lower", "length", "last", "date"}
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"uppr", []string{"upper"}},
+		{"lenght", []string{"length"}},
+		{"lst", []string{"last"}},
+		{"title", nil},
+		{"upper", nil},
+	}
+	for _, test := range tests {
+		if res := suggest(test.name, known); !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, res, test.expected)
+		}
+	}
+}
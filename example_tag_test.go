@@ -0,0 +1,70 @@
+package stick_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/parse"
+)
+
+// featureNode renders its body only when the named feature is enabled.
+type featureNode struct {
+	parse.Range
+	parse.TrimmableNode
+	Feature parse.Expr
+	Body    parse.Node
+}
+
+func (n *featureNode) String() string {
+	return fmt.Sprintf("Feature(%s: %s)", n.Feature, n.Body)
+}
+
+func (n *featureNode) All() []parse.Node {
+	return []parse.Node{n.Feature, n.Body}
+}
+
+func (n *featureNode) Execute(ctx stick.Context, out io.Writer) error {
+	v, err := ctx.Eval(n.Feature)
+	if err != nil {
+		return err
+	}
+	enabled, _ := ctx.Scope().Get("features")
+	if ok, _ := stick.Contains(enabled, v); !ok {
+		return nil
+	}
+	return ctx.Render(n.Body, out)
+}
+
+// An example of a user-defined tag.
+//
+// The feature tag parses an expression and a body, returning a node that
+// executes itself.
+func ExampleExecutableNode() {
+	env := stick.New(nil)
+	env.Tags["feature"] = func(t *parse.Tree, start parse.Pos) (parse.Node, error) {
+		name, err := t.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		body, err := t.ParseUntilEndTag("feature", start)
+		if err != nil {
+			return nil, err
+		}
+		return &featureNode{parse.Range{Pos: start}, parse.TrimmableNode{}, name, body}, nil
+	}
+
+	err := env.Execute(
+		`{% feature 'search' %}Search! {% endfeature %}{% feature 'chat' %}Chat!{% endfeature %}`,
+		os.Stdout,
+		map[string]stick.Value{"features": []string{"search"}},
+	)
+	if err != nil {
+		fmt.Println(err)
+	}
+	// Output: Search!
+}
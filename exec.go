@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -29,6 +29,9 @@ type state struct {
 
 	localMacros map[string]*parse.MacroNode // Macros defined in the current template.
 
+	caller  *callerValue // The body of the call tag for the executing macro, may be nil.
+	callTag *callerValue // The call tag being executed, may be nil.
+
 	env   *Env        // The configured Stick environment.
 	scope *scopeStack // Handles execution scope.
 }
@@ -52,6 +55,13 @@ func newState(name string, out io.Writer, ctx map[string]Value, env *Env) *state
 	}
 }
 
+// Errors returned by walk when a break or continue tag is executed. They are
+// handled by the enclosing for loop and never returned to the caller.
+var (
+	errBreak    = errors.New("stick: break outside of for loop")
+	errContinue = errors.New("stick: continue outside of for loop")
+)
+
 // A selfValue represents the special `_self` variable.
 type selfValue map[string]Value
 
@@ -78,6 +88,18 @@ func (s *state) Meta() ContextMetadata {
 	return s.meta
 }
 
+func (s *state) Eval(expr parse.Expr) (Value, error) {
+	return s.evalExpr(expr)
+}
+
+func (s *state) Render(node parse.Node, out io.Writer) error {
+	defer func(out io.Writer) {
+		s.out = out
+	}(s.out)
+	s.out = out
+	return s.walk(node)
+}
+
 // noexport satisfies the Context interface.
 func (s *state) noexport() {}
 
@@ -198,6 +220,98 @@ func (s *state) getBlock(name string) *parse.BlockNode {
 	return nil
 }
 
+// isBlockDefinedExpr returns the block function call if exp checks whether a
+// block is defined, as in "block('name') is defined".
+func isBlockDefinedExpr(exp *parse.BinaryExpr) (*parse.FuncExpr, bool) {
+	if exp.Op != parse.OpBinaryIs && exp.Op != parse.OpBinaryIsNot {
+		return nil, false
+	}
+	if t, ok := exp.Right.(*parse.TestExpr); !ok || t.Name != "defined" {
+		return nil, false
+	}
+	fn, ok := exp.Left.(*parse.FuncExpr)
+	if !ok || fn.Name != "block" {
+		return nil, false
+	}
+	return fn, true
+}
+
+// Method blockArgs evaluates the arguments of the block function, returning
+// the name of the block and the template to find it in, if any.
+func (s *state) blockArgs(eargs []parse.Expr) (name string, tpl Value, err error) {
+	if len(eargs) < 1 || len(eargs) > 2 {
+		return "", nil, errors.New("block expects one or two parameters")
+	}
+	val, err := s.evalExpr(eargs[0])
+	if err != nil {
+		return "", nil, err
+	}
+	if len(eargs) == 2 {
+		tpl, err = s.evalExpr(eargs[1])
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return CoerceString(val), tpl, nil
+}
+
+// Method findBlock returns the block with the given name, or nil if it does
+// not exist.
+//
+// If tpl is not nil, the block is located in that template or its parents.
+// The blocks to render it with are returned along with the name of the
+// template. Otherwise, the block is located in the current template and
+// blocks is nil.
+func (s *state) findBlock(name string, tpl Value) (*parse.BlockNode, []map[string]*parse.BlockNode, string, error) {
+	if tpl == nil {
+		return s.getBlock(name), nil, "", nil
+	}
+	tplName, tree, err := s.env.loadFirst(tpl)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	blocks := []map[string]*parse.BlockNode{tree.Blocks()}
+	for p := tree.Root().Parent; p != nil; p = tree.Root().Parent {
+		v, err := s.evalExpr(p.Tpl)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		_, tree, err = s.env.loadFirst(v)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		blocks = append(blocks, tree.Blocks())
+	}
+	for _, b := range blocks {
+		if blk, ok := b[name]; ok {
+			return blk, blocks, tplName, nil
+		}
+	}
+	return nil, nil, "", nil
+}
+
+// Method renderBlock renders the given block and returns the output. If blocks
+// is not nil, the block is rendered as part of the template named tpl.
+func (s *state) renderBlock(blk *parse.BlockNode, blocks []map[string]*parse.BlockNode, tpl string) (Value, error) {
+	defer func(out io.Writer, blocks []map[string]*parse.BlockNode, name string, current *parse.BlockNode) {
+		s.out, s.blocks, s.name, s.current = out, blocks, name, current
+	}(s.out, s.blocks, s.name, s.current)
+	if blocks != nil {
+		s.blocks = blocks
+		s.name = tpl
+	}
+	if blk.Origin != "" {
+		s.name = blk.Origin
+	}
+	s.current = blk
+	buf := &bytes.Buffer{}
+	s.out = buf
+	if err := s.walk(blk.Body); err != nil {
+		return nil, err
+	}
+	return newMarkup(buf.String()), nil
+}
+
 func (s *state) getParentBlock(name string) *parse.BlockNode {
 	rootFound := false
 	for _, blocks := range s.blocks {
@@ -220,8 +334,7 @@ func (s *state) walk(node parse.Node) error {
 			if err != nil {
 				return err
 			}
-			name := CoerceString(tplName)
-			tree, err := s.env.load(name)
+			name, tree, err := s.env.loadFirst(tplName)
 			if err != nil {
 				return err
 			}
@@ -250,6 +363,9 @@ func (s *state) walk(node parse.Node) error {
 	case *parse.TextNode:
 		_, err := io.WriteString(s.out, node.Data)
 		return err
+	case *parse.VerbatimNode:
+		_, err := io.WriteString(s.out, node.Data)
+		return err
 	case *parse.PrintNode:
 		v, err := s.evalExpr(node.X)
 		if err != nil {
@@ -286,24 +402,22 @@ func (s *state) walk(node parse.Node) error {
 			return s.walk(node.Else)
 		}
 	case *parse.IncludeNode:
-		tpl, ctx, err := s.walkIncludeNode(node)
-		if err != nil {
+		tpl, tree, ctx, err := s.walkIncludeNode(node)
+		if err != nil || tree == nil {
 			return err
 		}
-		err = execute(tpl, s.out, ctx, s.env)
+		si := newState(tpl, s.out, ctx, s.env)
+		si.blocks = append(si.blocks, tree.Blocks())
+		err = si.walk(tree.Root())
 		if err != nil {
 			return err
 		}
 	case *parse.EmbedNode:
-		tpl, ctx, err := s.walkIncludeNode(node.IncludeNode)
-		if err != nil {
+		tpl, tree, ctx, err := s.walkIncludeNode(node.IncludeNode)
+		if err != nil || tree == nil {
 			return err
 		}
 		si := newState(tpl, s.out, ctx, s.env)
-		tree, err := s.env.load(tpl)
-		if err != nil {
-			return err
-		}
 		si.blocks = append(s.blocks, node.Blocks, tree.Blocks())
 		err = si.walk(tree.Root())
 		if err != nil {
@@ -313,6 +427,10 @@ func (s *state) walk(node parse.Node) error {
 		return s.walkUseNode(node)
 	case *parse.ForNode:
 		return s.walkForNode(node)
+	case *parse.BreakNode:
+		return s.walkLoopControl(node.Cond, errBreak)
+	case *parse.ContinueNode:
+		return s.walkLoopControl(node.Cond, errContinue)
 	case *parse.SetNode:
 		return s.walkSetNode(node)
 	case *parse.DoNode:
@@ -321,10 +439,18 @@ func (s *state) walk(node parse.Node) error {
 		return s.walkFilterNode(node)
 	case *parse.ImportNode:
 		return s.walkImportNode(node)
+	case *parse.CallNode:
+		return s.walkCallNode(node)
+	case *parse.WithNode:
+		return s.walkWithNode(node)
+	case *parse.AutoEscapeNode:
+		return s.walk(node.Body)
 	case *parse.FromNode:
 		return s.walkFromNode(node)
 	case *parse.CommentNode:
 		// Nothing.
+	case ExecutableNode:
+		return node.Execute(s, s.out)
 	default:
 		return errors.New("Unknown node " + node.String())
 	}
@@ -355,78 +481,180 @@ func (s *state) walkForNode(node *parse.ForNode) error {
 	if err != nil {
 		return err
 	}
-	kn := node.Key
-	vn := node.Val
-	ct, err := Iterate(res, func(k Value, v Value, l Loop) (bool, error) {
-		s.scope.push()
-		defer s.scope.pop()
+	if node.Cond != nil {
+		res, err = s.filterLoop(node, res)
+		if err != nil {
+			return err
+		}
+	}
+	parent, _ := s.scope.Get("loop")
+	lv := newLoopValue(parent)
+
+	// When the length is known upfront, the loop runs one item behind the
+	// iteration so that loop.nextitem is available.
+	_, err = Len(res)
+	lookahead := err == nil
 
-		if kn != "" {
-			s.scope.setLocal(kn, k)
+	var pending *loopItem
+	stopped := false
+	ct, err := Iterate(res, func(k Value, v Value, l Loop) (bool, error) {
+		if !lookahead {
+			return s.walkLoopBody(node, lv, loopItem{k, v, l}, nil)
 		}
-		s.scope.setLocal(vn, v)
-		loopValue := map[string]Value{
-			"Last":      l.Last,
-			"Index":     l.Index,
-			"Index0":    l.Index0,
-			"last":      l.Last,
-			"index":     l.Index,
-			"index0":    l.Index0,
-			"revindex":  l.Revindex,
-			"revindex0": l.Revindex0,
-			"first":     l.First,
-			"length":    l.Length,
+		if pending != nil {
+			brk, err := s.walkLoopBody(node, lv, *pending, &loopItem{k, v, l})
+			if brk || err != nil {
+				stopped = true
+				return true, err
+			}
 		}
-
-		parent, hasParent := s.scope.Get("loop")
-		if hasParent {
-			loopValue["parent"] = parent
+		pending = &loopItem{k, v, l}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if pending != nil && !stopped {
+		if _, err = s.walkLoopBody(node, lv, *pending, nil); err != nil {
+			return err
 		}
+	}
+	if ct == 0 {
+		return s.walk(node.Else)
+	}
+	return nil
+}
+
+// A loopItem is a single step in a for loop.
+type loopItem struct {
+	k, v Value
+	l    Loop
+}
+
+// walkLoopBody executes the body of a for loop for the given item. next is
+// the following item, if known. The first return value is true if the loop
+// should stop.
+func (s *state) walkLoopBody(node *parse.ForNode, lv *loopValue, item loopItem, next *loopItem) (bool, error) {
+	s.scope.push()
+	defer s.scope.pop()
+
+	if err := s.setLoopVars(node, item.k, item.v); err != nil {
+		return true, err
+	}
+	lv.Loop = item.l
+	lv.hasNext = next != nil
+	lv.next = nil
+	if next != nil {
+		lv.next = next.v
+	}
+	s.scope.setLocal("loop", lv)
+
+	err := s.walk(node.Body)
+	lv.prev, lv.hasPrev = item.v, true
+	switch err {
+	case nil, errContinue:
+		return false, nil
+	case errBreak:
+		return true, nil
+	}
+	return true, err
+}
 
-		s.scope.setLocal("loop", loopValue)
+// setLoopVars sets the key and value variables of a for loop in the current
+// scope.
+func (s *state) setLoopVars(node *parse.ForNode, k, v Value) error {
+	if node.Key != "" {
+		s.scope.setLocal(node.Key, k)
+	}
+	if node.Target != nil {
+		return s.assign(node.Target, v, s.scope.setLocal)
+	}
+	s.scope.setLocal(node.Val, v)
+	return nil
+}
 
-		err := s.walk(node.Body)
+// filterLoop returns the items in val that meet the condition of the given
+// for loop. The whole of val is consumed so that loop metadata, such as
+// loop.length, describes only the matching items.
+func (s *state) filterLoop(node *parse.ForNode, val Value) (Value, error) {
+	res := make([]loopItem, 0)
+	_, err := Iterate(val, func(k Value, v Value, l Loop) (bool, error) {
+		s.scope.push()
+		defer s.scope.pop()
+
+		if err := s.setLoopVars(node, k, v); err != nil {
+			return true, err
+		}
+		ok, err := s.evalExpr(node.Cond)
 		if err != nil {
 			return true, err
 		}
+		if CoerceBool(ok) {
+			res = append(res, loopItem{k: k, v: v})
+		}
 		return false, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return &loopItems{items: res}, nil
+}
+
+// walkLoopControl returns the given loop control error if cond is nil or
+// evaluates to true.
+func (s *state) walkLoopControl(cond parse.Expr, ctrl error) error {
+	if cond == nil {
+		return ctrl
+	}
+	v, err := s.evalExpr(cond)
 	if err != nil {
 		return err
 	}
-	if ct == 0 {
-		return s.walk(node.Else)
+	if CoerceBool(v) {
+		return ctrl
 	}
 	return nil
 }
 
 // Method walkInclude determines the necessary parameters for including or embedding a template.
-func (s *state) walkIncludeNode(node *parse.IncludeNode) (tpl string, ctx map[string]Value, err error) {
+//
+// The returned tree is nil if the template does not exist and the node is marked "ignore missing".
+func (s *state) walkIncludeNode(node *parse.IncludeNode) (tpl string, tree *parse.Tree, ctx map[string]Value, err error) {
 	ctx = make(map[string]Value)
 	v, err := s.evalExpr(node.Tpl)
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
+	}
+	tpl, tree, err = s.env.loadFirst(v)
+	if err != nil {
+		if node.IgnoreMissing && isNotExist(err) {
+			return "", nil, nil, nil
+		}
+		return "", nil, nil, err
 	}
-	tpl = CoerceString(v)
 	var with Value
 	if n := node.With; n != nil {
 		with, err = s.evalExpr(n)
-		// TODO: Assert "with" is a hash?
 		if err != nil {
-			return "", nil, err
+			return "", nil, nil, err
+		}
+		if !IsMap(with) {
+			return "", nil, nil, fmt.Errorf("variables passed to include must be a hash, got %T", with)
 		}
 	}
 	if !node.Only {
 		ctx = s.scope.All()
 	}
 	if with != nil {
-		if with, ok := with.(map[string]Value); ok {
-			for k, v := range with {
-				ctx[k] = v
-			}
+		_, err = Iterate(with, func(k, v Value, l Loop) (bool, error) {
+			ctx[CoerceString(k)] = v
+			return false, nil
+		})
+		if err != nil {
+			return "", nil, nil, err
 		}
 	}
-	return tpl, ctx, err
+	return tpl, tree, ctx, err
 }
 
 func (s *state) walkUseNode(node *parse.UseNode) error {
@@ -460,6 +688,7 @@ func (s *state) walkSetNode(node *parse.SetNode) error {
 		// when setting a variable with a body, it may contain any number
 		// of any type of node or expression. because of this, the value is
 		// always converted to a string which is stored in the variable name.
+		// the output is already escaped, so it is marked safe.
 		prevBuf := s.out
 		defer func() {
 			s.out = prevBuf
@@ -470,7 +699,7 @@ func (s *state) walkSetNode(node *parse.SetNode) error {
 		if err != nil {
 			return err
 		}
-		v = string(buf.Bytes())
+		v = newMarkup(buf.String())
 	case parse.Expr:
 		// evaluates the right side of a basic set statement
 		var err error
@@ -482,8 +711,51 @@ func (s *state) walkSetNode(node *parse.SetNode) error {
 		return fmt.Errorf("unsupported expression type in set statement: %T (bug?)", node.X)
 	}
 
-	s.scope.Set(node.Name, v)
-	return nil
+	if node.Target == nil {
+		s.scope.Set(node.Name, v)
+		return nil
+	}
+	return s.assign(node.Target, v, s.scope.Set)
+}
+
+// assign assigns val to the given target. Names are set with setVar,
+// attributes are set on their container, and a TupleExpr has val unpacked
+// into each of its elements.
+func (s *state) assign(target parse.Expr, val Value, setVar func(string, Value)) error {
+	switch t := target.(type) {
+	case *parse.NameExpr:
+		setVar(t.Name, val)
+		return nil
+	case *parse.GetAttrExpr:
+		c, err := s.evalExpr(t.Cont)
+		if err != nil {
+			return err
+		}
+		k, err := s.evalExpr(t.Attr)
+		if err != nil {
+			return err
+		}
+		return SetAttr(c, k, val)
+	case *parse.TupleExpr:
+		vals := make([]Value, 0, len(t.Elements))
+		_, err := Iterate(val, func(k, v Value, l Loop) (bool, error) {
+			vals = append(vals, v)
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(vals) != len(t.Elements) {
+			return fmt.Errorf("unable to unpack %d values into %d targets", len(vals), len(t.Elements))
+		}
+		for i, e := range t.Elements {
+			if err := s.assign(e, vals[i], setVar); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported assignment target: %s", target)
 }
 
 func (s *state) walkDoNode(node *parse.DoNode) error {
@@ -505,24 +777,33 @@ func (s *state) walkFilterNode(node *parse.FilterNode) error {
 	if err != nil {
 		return err
 	}
-	val := string(buf.Bytes())
-	for _, v := range node.Filters {
-		f, ok := s.env.Filters[v]
+	var val Value = buf.String()
+	for _, fe := range node.Filters {
+		f, ok := s.env.Filters[fe.Name]
 		if !ok {
-			return errors.New("undefined filter \"" + v + "\".")
+			// The apply tag has always reported unknown filters this way.
+			err := s.newUndefinedError("filter", fe.Name, fe).(*UndefinedError)
+			err.msg = `undefined filter "` + fe.Name + `".`
+			return err
+		}
+		args := make([]Value, len(fe.Args))
+		for i, e := range fe.Args {
+			v, err := s.evalExpr(e)
+			if err != nil {
+				return err
+			}
+			args[i] = v
 		}
-		val = CoerceString(f(s, val))
+		// The result of each filter is passed to the next as-is so that
+		// a SafeValue is not escaped again by a later filter.
+		val = f(s, val, args...)
 	}
-	io.WriteString(prevBuf, val)
-	return nil
+	_, err = io.WriteString(prevBuf, CoerceString(val))
+	return err
 }
 
 func (s *state) walkImportNode(node *parse.ImportNode) error {
-	tpl, err := s.evalExpr(node.Tpl)
-	if err != nil {
-		return err
-	}
-	tree, err := s.env.load(CoerceString(tpl))
+	tree, err := s.loadMacroSource(node.Tpl)
 	if err != nil {
 		return err
 	}
@@ -535,11 +816,7 @@ func (s *state) walkImportNode(node *parse.ImportNode) error {
 }
 
 func (s *state) walkFromNode(node *parse.FromNode) error {
-	tpl, err := s.evalExpr(node.Tpl)
-	if err != nil {
-		return err
-	}
-	tree, err := s.env.load(CoerceString(tpl))
+	tree, err := s.loadMacroSource(node.Tpl)
 	if err != nil {
 		return err
 	}
@@ -554,6 +831,19 @@ func (s *state) walkFromNode(node *parse.FromNode) error {
 	return nil
 }
 
+// loadMacroSource loads the template referred to in an import or from
+// statement. The special `_self` variable refers to the current template.
+func (s *state) loadMacroSource(tplExpr parse.Expr) (*parse.Tree, error) {
+	tpl, err := s.evalExpr(tplExpr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tpl.(selfValue); ok {
+		return s.env.load(s.name)
+	}
+	return s.env.load(CoerceString(tpl))
+}
+
 // Method evalExpr evaluates the given expression, returning a Value or error.
 func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 	switch exp := exp.(type) {
@@ -571,6 +861,12 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 			e = errors.New("undefined variable \"" + exp.Name + "\"")
 		}
 	case *parse.NumberExpr:
+		if !strings.Contains(exp.Value, ".") {
+			if num, err := strconv.ParseInt(exp.Value, 10, 64); err == nil {
+				return num, nil
+			}
+			// Integer literals that do not fit in an int64 become floats.
+		}
 		num, err := strconv.ParseFloat(exp.Value, 64)
 		if err != nil {
 			return nil, err
@@ -590,11 +886,27 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 			return !CoerceBool(in), nil
 		case parse.OpUnaryPositive:
 			// no-op, +1 = 1, +(-1) = -1, +(false) = 0
-			return CoerceNumber(in), nil
+			return numPositive(in), nil
 		case parse.OpUnaryNegative:
-			return -CoerceNumber(in), nil
+			return numNegate(in), nil
+		default:
+			if op, ok := s.env.UnaryOperators[exp.Op]; ok {
+				return op.Eval(s, in)
+			}
+			return nil, fmt.Errorf("unsupported unary operator: %s (bug?)", exp.Op)
 		}
 	case *parse.BinaryExpr:
+		if fn, ok := isBlockDefinedExpr(exp); ok {
+			name, tpl, err := s.blockArgs(fn.Args)
+			if err != nil {
+				return nil, err
+			}
+			blk, _, _, err := s.findBlock(name, tpl)
+			if err != nil {
+				return nil, err
+			}
+			return (blk != nil) == (exp.Op == parse.OpBinaryIs), nil
+		}
 		left, err := s.evalExpr(exp.Left)
 		if err != nil {
 			return nil, err
@@ -605,19 +917,19 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		}
 		switch exp.Op {
 		case parse.OpBinaryAdd:
-			return CoerceNumber(left) + CoerceNumber(right), nil
+			return numAdd(left, right), nil
 		case parse.OpBinarySubtract:
-			return CoerceNumber(left) - CoerceNumber(right), nil
+			return numSubtract(left, right), nil
 		case parse.OpBinaryMultiply:
-			return CoerceNumber(left) * CoerceNumber(right), nil
+			return numMultiply(left, right), nil
 		case parse.OpBinaryDivide:
-			return CoerceNumber(left) / CoerceNumber(right), nil
+			return numDivide(left, right)
 		case parse.OpBinaryFloorDiv:
-			return math.Floor(CoerceNumber(left) / CoerceNumber(right)), nil
+			return numFloorDivide(left, right)
 		case parse.OpBinaryModulo:
-			return float64(int(CoerceNumber(left)) % int(CoerceNumber(right))), nil
+			return numModulo(left, right)
 		case parse.OpBinaryPower:
-			return math.Pow(CoerceNumber(left), CoerceNumber(right)), nil
+			return numPower(left, right), nil
 		case parse.OpBinaryConcat:
 			return CoerceString(left) + CoerceString(right), nil
 		case parse.OpBinaryEndsWith:
@@ -653,31 +965,35 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		case parse.OpBinaryNotEqual:
 			return !Equal(left, right), nil
 		case parse.OpBinaryGreaterEqual:
-			return CoerceNumber(left) >= CoerceNumber(right), nil
+			c, ok := compare(left, right)
+			return ok && c >= 0, nil
 		case parse.OpBinaryGreaterThan:
-			return CoerceNumber(left) > CoerceNumber(right), nil
+			c, ok := compare(left, right)
+			return ok && c > 0, nil
 		case parse.OpBinaryLessEqual:
-			return CoerceNumber(left) <= CoerceNumber(right), nil
+			c, ok := compare(left, right)
+			return ok && c <= 0, nil
 		case parse.OpBinaryLessThan:
-			return CoerceNumber(left) < CoerceNumber(right), nil
+			c, ok := compare(left, right)
+			return ok && c < 0, nil
+		case parse.OpBinarySpaceship:
+			return int64(Compare(left, right)), nil
 		case parse.OpBinaryRange:
-			l, r := CoerceNumber(left), CoerceNumber(right)
-			res := make([]float64, uint(math.Ceil(r-l))+1)
-			for i, k := 0, l; k <= r; i, k = i+1, k+1 {
-				res[i] = k
-			}
-			return res, nil
+			return numRange(left, right)
 		case parse.OpBinaryBitwiseAnd:
-			return int(CoerceNumber(left)) & int(CoerceNumber(right)), nil
+			return toNumeric(left).int() & toNumeric(right).int(), nil
 		case parse.OpBinaryBitwiseOr:
-			return int(CoerceNumber(left)) | int(CoerceNumber(right)), nil
+			return toNumeric(left).int() | toNumeric(right).int(), nil
 		case parse.OpBinaryBitwiseXor:
-			return int(CoerceNumber(left)) ^ int(CoerceNumber(right)), nil
+			return toNumeric(left).int() ^ toNumeric(right).int(), nil
 		case parse.OpBinaryAnd:
 			return CoerceBool(left) && CoerceBool(right), nil
 		case parse.OpBinaryOr:
 			return CoerceBool(left) || CoerceBool(right), nil
 		default:
+			if op, ok := s.env.BinaryOperators[exp.Op]; ok {
+				return op.Eval(s, left, right)
+			}
 			return nil, fmt.Errorf("unsupported binary operator: %s (bug?)", exp.Op)
 		}
 	case *parse.FuncExpr:
@@ -704,7 +1020,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		}
 		if _, ok := c.(selfValue); ok {
 			if macro, ok := s.localMacros[CoerceString(k)]; ok {
-				return s.callMacro(macroDef{macro}, args...)
+				return s.callMacro(macroDef{macro}, s.callerFor(exp), args...)
 			}
 			// no locally-defined macro defined with the given name, but the
 			// `_self` variable contains other special values such as `templateName`.
@@ -712,7 +1028,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		}
 		if set, ok := c.(macroSet); ok {
 			if macro, ok := set.defs[CoerceString(k)]; ok {
-				return s.callMacro(macro, args...)
+				return s.callMacro(macro, s.callerFor(exp), args...)
 			}
 			return nil, errors.New("undefined macro: " + CoerceString(k))
 		}
@@ -735,7 +1051,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 				return tfn(s, v, args...)
 			}, nil
 		}
-		return nil, fmt.Errorf(`unknown test "%v"`, exp.Name)
+		return nil, s.newUndefinedError("test", exp.Name, exp)
 	case *parse.TernaryIfExpr:
 		cond, err := s.evalExpr(exp.Cond)
 		if err != nil {
@@ -747,7 +1063,7 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 		return s.evalExpr(exp.FalseX)
 
 	case *parse.HashExpr:
-		vals := make(map[string]Value)
+		vals := NewOrderedMap()
 		for _, v := range exp.Elements {
 			var key Value
 			var err error
@@ -763,7 +1079,18 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 			if err != nil {
 				return nil, err
 			}
-			vals[CoerceString(key)] = val
+			vals.Set(CoerceString(key), val)
+		}
+		return vals, nil
+
+	case *parse.TupleExpr:
+		vals := make([]Value, len(exp.Elements))
+		for i, v := range exp.Elements {
+			val, err := s.evalExpr(v)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
 		}
 		return vals, nil
 
@@ -788,6 +1115,19 @@ func (s *state) evalExpr(exp parse.Expr) (v Value, e error) {
 func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 	fnName := exp.Name
 	switch fnName {
+	case "caller":
+		if caller := s.caller; caller != nil {
+			eargs := exp.Args
+			args := make([]Value, len(eargs))
+			for i, e := range eargs {
+				v, err := s.evalExpr(e)
+				if err != nil {
+					return nil, err
+				}
+				args[i] = v
+			}
+			return s.callCaller(caller, args...)
+		}
 	case "parent":
 		if s.current == nil {
 			return nil, errors.New("not inside a block!")
@@ -801,31 +1141,22 @@ func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 				return nil, err
 			}
 			s.out = pout
-			return buf.String(), nil
+			return newMarkup(buf.String()), nil
 		}
 		return nil, errors.New("Unable to locate block \"" + name + "\"")
 	case "block":
-		eargs := exp.Args
-		if len(eargs) != 1 {
-			return nil, errors.New("block expects one parameter")
+		name, tpl, err := s.blockArgs(exp.Args)
+		if err != nil {
+			return nil, err
 		}
-		val, err := s.evalExpr(eargs[0])
+		blk, blocks, tplName, err := s.findBlock(name, tpl)
 		if err != nil {
 			return nil, err
 		}
-		name := CoerceString(val)
-		if blk := s.getBlock(name); blk != nil {
-			pout := s.out
-			buf := &bytes.Buffer{}
-			s.out = buf
-			err = s.walk(blk.Body)
-			if err != nil {
-				return nil, err
-			}
-			s.out = pout
-			return buf.String(), nil
+		if blk == nil {
+			return nil, errors.New("Unable to locate block \"" + name + "\"")
 		}
-		return nil, errors.New("Unable to locate block \"" + name + "\"")
+		return s.renderBlock(blk, blocks, tplName)
 	}
 	if macro, ok := s.macros[fnName]; ok {
 		eargs := exp.Args
@@ -837,7 +1168,7 @@ func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 			}
 			args[i] = v
 		}
-		return s.callMacro(macroDef{macro}, args...)
+		return s.callMacro(macroDef{macro}, s.callerFor(exp), args...)
 	}
 	if fn, ok := s.env.Functions[fnName]; ok {
 		eargs := exp.Args
@@ -851,7 +1182,7 @@ func (s *state) evalFunction(exp *parse.FuncExpr) (Value, error) {
 		}
 		return fn(s, args...), nil
 	}
-	return nil, errors.New("Undeclared function \"" + fnName + "\"")
+	return nil, s.newUndefinedError("function", fnName, exp)
 }
 
 func (s *state) evalFilter(exp *parse.FilterExpr) (Value, error) {
@@ -871,7 +1202,7 @@ func (s *state) evalFilter(exp *parse.FilterExpr) (Value, error) {
 		}
 		return fn(s, args[0], args[1:]...), nil
 	}
-	return nil, errors.New("Undeclared filter \"" + ftName + "\"")
+	return nil, s.newUndefinedError("filter", ftName, exp)
 }
 
 type macroDef struct {
@@ -882,16 +1213,34 @@ type macroSet struct {
 	defs map[string]macroDef
 }
 
-func (s *state) callMacro(macro macroDef, args ...Value) (Value, error) {
+// callMacro executes the macro with the given arguments. The caller is the
+// body of the call tag the macro was called from, or nil.
+func (s *state) callMacro(macro macroDef, caller *callerValue, args ...Value) (Value, error) {
 	s.scope.push()
 	defer s.scope.pop()
+	defer func(caller, callTag *callerValue) {
+		s.caller, s.callTag = caller, callTag
+	}(s.caller, s.callTag)
+	s.caller, s.callTag = caller, nil
 	for i, name := range macro.Args {
-		if i >= len(args) {
-			s.scope.setLocal(name, nil)
-		} else {
+		if i < len(args) {
 			s.scope.setLocal(name, args[i])
+		} else if def, ok := macro.Defaults[name]; ok {
+			v, err := s.evalExpr(def)
+			if err != nil {
+				return nil, err
+			}
+			s.scope.setLocal(name, v)
+		} else {
+			s.scope.setLocal(name, nil)
 		}
 	}
+	// Any extra arguments are available in the special varargs variable.
+	varargs := make([]Value, 0)
+	if len(args) > len(macro.Args) {
+		varargs = append(varargs, args[len(macro.Args):]...)
+	}
+	s.scope.setLocal("varargs", varargs)
 	defer func(buf io.Writer) {
 		s.out = buf
 	}(s.out)
@@ -907,7 +1256,80 @@ func (s *state) callMacro(macro macroDef, args ...Value) (Value, error) {
 	if err != nil {
 		return nil, err
 	}
-	return buf.String(), nil
+	return newMarkup(buf.String()), nil
+}
+
+// walkWithNode executes the body of a with tag in a new scope. Variables set
+// inside the body are not visible outside of it.
+func (s *state) walkWithNode(node *parse.WithNode) error {
+	vars := make(map[string]Value)
+	if !node.Only {
+		vars = s.scope.All()
+	}
+	if node.With != nil {
+		with, err := s.evalExpr(node.With)
+		if err != nil {
+			return err
+		}
+		if !IsMap(with) {
+			return fmt.Errorf("variables passed to with must be a hash, got %T", with)
+		}
+		_, err = Iterate(with, func(k, v Value, l Loop) (bool, error) {
+			vars[CoerceString(k)] = v
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	defer func(scopes []map[string]Value) {
+		s.scope.scopes = scopes
+	}(s.scope.scopes)
+	s.scope.scopes = []map[string]Value{vars}
+	return s.walk(node.Body)
+}
+
+// A callerValue is the body of a call tag, passed to the called macro as the
+// special caller function.
+type callerValue struct {
+	x      parse.Expr         // The macro call in the call tag.
+	macro  *parse.MacroNode   // The body of the call tag.
+	scopes []map[string]Value // The scope where the call tag was executed.
+	outer  *callerValue       // The caller of the macro containing the call tag, may be nil.
+}
+
+func (s *state) walkCallNode(node *parse.CallNode) error {
+	defer func(callTag *callerValue) {
+		s.callTag = callTag
+	}(s.callTag)
+	s.callTag = &callerValue{node.X, node.Caller, s.scope.scopes, s.caller}
+	v, err := s.evalExpr(node.X)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(s.out, CoerceString(v))
+	return err
+}
+
+// callerFor returns the caller to pass to a macro called by exp. Only the
+// macro called directly by a call tag receives its body; macros called from
+// its arguments or from within the macro do not.
+func (s *state) callerFor(exp parse.Expr) *callerValue {
+	if s.callTag != nil && s.callTag.x == exp {
+		return s.callTag
+	}
+	return nil
+}
+
+// callCaller renders the body of a call tag. The body is executed in the
+// scope where the call tag appeared rather than the scope of the macro.
+func (s *state) callCaller(caller *callerValue, args ...Value) (Value, error) {
+	defer func(scopes []map[string]Value) {
+		s.scope.scopes = scopes
+	}(s.scope.scopes)
+	n := len(caller.scopes)
+	s.scope.scopes = caller.scopes[:n:n]
+	return s.callMacro(macroDef{caller.macro}, caller.outer, args...)
 }
 
 // execute kicks off execution of the given template.
@@ -928,17 +1350,101 @@ func execute(name string, out io.Writer, ctx map[string]Value, env *Env) error {
 	return nil
 }
 
+// Method loadFirst loads and parses the first template that exists. The
+// given value may be the name of a single template or a list of names.
+//
+// If none of the templates exist, the returned error satisfies isNotExist.
+func (env *Env) loadFirst(names Value) (string, *parse.Tree, error) {
+	if !IsArray(names) {
+		name := CoerceString(names)
+		tree, err := env.load(name)
+		return name, tree, err
+	}
+	var list []string
+	_, err := Iterate(names, func(k, v Value, l Loop) (bool, error) {
+		list = append(list, CoerceString(v))
+		return false, nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, name := range list {
+		tree, err := env.load(name)
+		if isNotExist(err) {
+			continue
+		}
+		return name, tree, err
+	}
+	return "", nil, notFoundError(list)
+}
+
+// A notFoundError is returned when none of the templates in a list exist.
+type notFoundError []string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("unable to find one of the following templates: %q", []string(e))
+}
+
+// isNotExist returns true if err, or any error it wraps, reports that a
+// template does not exist. Wrapped errors are unwrapped by hand, as
+// errors.Is(err, os.ErrNotExist) would, to keep supporting Go 1.12.
+func isNotExist(err error) bool {
+	for err != nil {
+		if _, ok := err.(notFoundError); ok {
+			return true
+		}
+		if os.IsNotExist(err) {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				if isNotExist(err) {
+					return true
+				}
+			}
+			return false
+		default:
+			return false
+		}
+	}
+	return false
+}
+
 // Method load attempts to load and parse the given template.
 func (env *Env) load(name string) (*parse.Tree, error) {
-	tpl, err := env.Loader.Load(name)
+	tree, err := env.newTree(name)
 	if err != nil {
 		return nil, err
 	}
-	tree := parse.NewNamedTree(name, tpl.Contents())
-	tree.Visitors = append(tree.Visitors, env.Visitors...)
 	err = tree.Parse()
 	if err != nil {
 		return nil, err
 	}
 	return tree, nil
 }
+
+// newTree loads the given template and returns a Tree, configured with the
+// tags, operators, delimiters and visitors of the Env, ready to be parsed.
+func (env *Env) newTree(name string) (*parse.Tree, error) {
+	tpl, err := env.Loader.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	tree := parse.NewNamedTree(name, tpl.Contents())
+	tree.Visitors = append(tree.Visitors, env.Visitors...)
+	tree.Transformers = append(tree.Transformers, env.Transformers...)
+	tree.Delimiters = env.Delimiters
+	for name, p := range env.Tags {
+		tree.Tags[name] = p
+	}
+	for name, op := range env.BinaryOperators {
+		tree.BinaryOperators[name] = parse.Operator{Precedence: op.Precedence, Assoc: op.Assoc}
+	}
+	for name, op := range env.UnaryOperators {
+		tree.UnaryOperators[name] = parse.Operator{Precedence: op.Precedence}
+	}
+	return tree, nil
+}
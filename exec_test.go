@@ -2,8 +2,11 @@ package stick
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -54,6 +57,7 @@ func withNodeVisitor(visitFunc func(parse.Node)) testOption {
 
 var tests = []execTest{
 	newExecTest("Hello, World", "Hello, World!", expect("Hello, World!")),
+	newExecTest("Verbatim", "{% verbatim %}{{ a }}{% if b %}{% endverbatim %}", expect("{{ a }}{% if b %}")),
 	newExecTest("Hello, Tyler!", "Hello, {{ name }}!", expect("Hello, Tyler!"), withContext(map[string]Value{"name": "Tyler"})),
 	newExecTest("Simple if", `<li class="{% if active %}active{% endif %}">`, expect(`<li class="active">`), withContext(map[string]Value{"active": true})),
 	newExecTest("Simple inheritance", `{% extends 'Hello, {% block test %}universe{% endblock %}!' %}{% block test %}world{% endblock %}`, expect(`Hello, world!`)),
@@ -82,6 +86,34 @@ var tests = []execTest{
 		`{% for i in 1..3 %}{{ i }}{{ loop.index }}{{ loop.index0 }}{{ loop.revindex }}{{ loop.revindex0 }}{{ loop.length }}{% if loop.first %}f{% endif %}{% if loop.last %}l{% endif %}{% endfor %}`,
 		expect(`110323f221213332103l`),
 	),
+	newExecTest(
+		"For loop over channel",
+		`{% for i in ch %}{{ i }}{{ loop.index }}[{{ loop.length }}{{ loop.last }}]{% endfor %}`,
+		expect(`a1[]b2[]`),
+		withContext(map[string]Value{"ch": func() chan string {
+			ch := make(chan string, 2)
+			ch <- "a"
+			ch <- "b"
+			close(ch)
+			return ch
+		}()}),
+	),
+	newExecTest(
+		"For loop over send-only channel",
+		`{% for i in ch %}{{ i }}{% endfor %}`,
+		expectErrorContains(`unable to iterate over send-only channel`),
+		withContext(map[string]Value{"ch": make(chan<- string)}),
+	),
+	newExecTest(
+		"For loop over sequence function",
+		`{% for k, v in seq %}{{ k }}={{ v }};{% endfor %}`,
+		expect(`a=1;b=2;`),
+		withContext(map[string]Value{"seq": func(yield func(string, int) bool) {
+			if yield("a", 1) {
+				yield("b", 2)
+			}
+		}}),
+	),
 	newExecTest("For else", `{% for i in emptySet %}{{ i }}{% else %}No results.{% endfor %}`, expect(`No results.`), withContext(map[string]Value{"emptySet": []int{}})),
 	newExecTest(
 		"For map",
@@ -94,7 +126,38 @@ var tests = []execTest{
 		`{{ 4.5 * 10 }} - {{ 3 + true }} - {{ 3 + 4 == 7.0 }} - {{ 10 % 2 == 0 }} - {{ 10 ** 2 > 99.9 and 10 ** 2 <= 100 }}`,
 		expect(`45 - 4 - 1 - 1 - 1`),
 	),
+	newExecTest(
+		"Integer arithmetic",
+		`{{ 10 / 4 }} - {{ 10 / 5 }} - {{ 10 // 4 }} - {{ (-7) // 2 }} - {{ 7 % 3 }} - {{ 5.5 % 2 }} - {{ 2 ** 62 }} - {{ id + 1 }}`,
+		expect(`2.5 - 2 - 2 - -4 - 1 - 1.5 - 4611686018427387904 - 9007199254740993`),
+		withContext(map[string]Value{"id": int64(9007199254740992)}),
+	),
+	newExecTest("Division by zero", `{{ 1 / 0 }}`, expectErrorContains("division by zero")),
+	newExecTest("Modulo by zero", `{{ 1 % 0 }}`, expectErrorContains("modulo by zero")),
+	newExecTest("Descending range", `{% for i in 3..1 %}{{ i }}{% endfor %}`, expect(`321`)),
+	newExecTest("Huge range", `{% for i in 10000000000000000.0..100000000000000000.0 %}{{ i }}{% endfor %}`, expectErrorContains(`range bounds must be integers`)),
+	newExecTest("String comparison", `{{ 'apple' < 'banana' }}-{{ 'b' >= 'a' }}-{{ '10' > '9' }}`, expect(`1-1-1`)),
+	newExecTest("Loose equality", `{{ 1 == '1.0' }}-{{ 0 == 'a' }}-{{ null == false }}-{{ [1, 2] == [1, 2] }}`, expect(`1--1-1`)),
+	newExecTest("Spaceship operator", `{{ 2 <=> 1 }} {{ 1 <=> 1 }} {{ 'a' <=> 'b' }}`, expect(`1 0 -1`)),
 	newExecTest("In and not in", `{{ 5 in set and 4 not in set }}`, expect(`1`), withContext(map[string]Value{"set": []int{5, 10}})),
+	newExecTest("In string", `{{ 'ell' in 'hello' }}-{{ 'z' in 'hello' }}-{{ 1 in '2019' }}-{{ 'ell' in safe }}`, expect(`1--1-1`), withContext(map[string]Value{"safe": NewSafeValue("hello")})),
+	newExecTest("In hash", `{{ 1 in {a: 1} }}-{{ 'a' in {a: 1} }}-{{ '1' in [1, 2] }}-{{ 0 in ['a'] }}`, expect(`1--1-`)),
+	newExecTest("For loop break", `{% for i in 1..5 %}{% if i == 4 %}{% break %}{% endif %}{{ i }}{% endfor %}`, expect(`123`)),
+	newExecTest("For loop continue", `{% for i in 1..5 %}{% continue if i % 2 == 1 %}{{ i }}{% endfor %}`, expect(`24`)),
+	newExecTest("Nested loop break", `{% for i in 1..2 %}{% for j in 1..3 %}{% break if j > i %}{{ i }}{{ j }} {% endfor %}{% endfor %}`, expect(`11 21 22 `)),
+	newExecTest("Loop control in set", `{% for i in 1..3 %}{% set s %}{% if i == 2 %}{% continue %}{% endif %}{{ i }}{% endset %}{{ s }}{% else %}empty{% endfor %}`, expect(`13`)),
+	newExecTest("Filtered for loop", `{% for i in 1..6 if i % 2 == 0 %}{{ loop.index }}/{{ loop.length }}{% if loop.last %}!{% endif %} {% endfor %}`, expect(`1/3 2/3 3/3! `)),
+	newExecTest("Filtered for loop keys", `{% for k, v in {a: 1, b: 2, c: 3} if v > 1 %}{{ k }}{% endfor %}{% for i in [1] if i > 1 %}x{% else %}none{% endfor %}`, expect(`bcnone`)),
+	newExecTest("Loop cycle", `{% for i in 1..4 %}{{ loop.cycle('odd', 'even') }} {% endfor %}`, expect(`odd even odd even `)),
+	newExecTest("Loop changed", `{% for c in ['a', 'a', 'b', 'a'] %}{% if loop.changed(c) %}{{ c }}{% endif %}{% endfor %}`, expect(`aba`)),
+	newExecTest("Loop previtem and nextitem", `{% for i in [1, 2, 3] %}{{ loop.previtem }}<{{ i }}>{{ loop.nextitem }} {% endfor %}`, expect(`<1>2 1<2>3 2<3> `)),
+	newExecTest("Set multiple", `{% set a, b = 1, 2 %}{{ a }}{{ b }}{% set a, b = b, a %}{{ a }}{{ b }}{% set (c, d), e = [3, 4], 5 %}{{ c }}{{ d }}{{ e }}`, expect(`1221345`)),
+	newExecTest("Set count mismatch", `{% set a, b = [1, 2] %}`, expectErrorContains("set requires the same number of variables and values")),
+	newExecTest("Set unpack mismatch", `{% set (a, b), c = [1], 2 %}`, expectErrorContains("unable to unpack 1 values into 2 targets")),
+	newExecTest("Set attribute", `{% set user = {name: 'a'} %}{% set user.name = 'x' %}{% set user['age'] = 3 %}{{ user.name }}{{ user.age }}{% set data.title = 'y' %}{{ data.title }}`, expect(`x3y`), withContext(map[string]Value{"data": map[string]Value{}})),
+	newExecTest("Set attribute number conversion", `{% set m.a = 5 %}{% set m.b = m.a * 2 %}{{ m.a + m.b }}`, expect(`15`), withContext(map[string]Value{"m": map[string]int{}})),
+	newExecTest("Set attribute on nil map", `{% set m.k = 1 %}`, expectErrorContains(`setattr: unable to set attribute "k"`), withContext(map[string]Value{"m": map[string]interface{}(nil)})),
+	newExecTest("For loop with unpacking", `{% for id, (name, email) in users %}{{ id }}:{{ name }}<{{ email }}> {% endfor %}`, expect(`0:a<a@x> 1:b<b@x> `), withContext(map[string]Value{"users": [][]string{{"a", "a@x"}, {"b", "b@x"}}})),
 	newExecTest("Function call", `{{ multiply(num, 5) }}`, expect(`50`), withContext(map[string]Value{"num": 10})),
 	newExecTest("Filter call", `Welcome, {{ name }}`, expect(`Welcome, `)),
 	newExecTest("Filter call", `Welcome, {{ name|default('User') }}`, expect(`Welcome, User`), withContext(map[string]Value{"name": nil})),
@@ -109,6 +172,33 @@ var tests = []execTest{
 		`{% extends '{% block message %}{% endblock %}' %}{% use '{% block message %}Hello{% endblock %}' with message as base_message %}{% block message %}{{ block('base_message') }}, World!{% endblock %}`,
 		expect("Hello, World!"),
 	),
+	newExecTest(
+		"Block shortcut",
+		`{% extends '<title>{% block title %}{% endblock %}</title>' %}{% block title name|upper %}`,
+		expect("<title>JOHN</title>"),
+		withContext(map[string]Value{"name": "john"}),
+	),
+	newExecTest(
+		"Block from another template",
+		`{{ block('sidebar', '{% block sidebar %}Sidebar {{ name }}{% endblock %}') }}`,
+		expect("Sidebar john"),
+		withContext(map[string]Value{"name": "john"}),
+	),
+	newExecTest(
+		"Block from another template with parent",
+		`{{ block('sidebar', "{% extends '{% block sidebar %}Sidebar{% endblock %}' %}") }}`,
+		expect("Sidebar"),
+	),
+	newExecTest(
+		"Block defined",
+		`{% block a %}{% endblock a %}{{ block('a') is defined ? 'yes' : 'no' }}{{ block('b') is defined ? 'yes' : 'no' }}{{ block('b') is not defined ? 'yes' : 'no' }}{{ block('c', '{% block c %}{% endblock %}') is defined ? 'yes' : 'no' }}`,
+		expect("yesnoyesyes"),
+	),
+	newExecTest(
+		"Block missing",
+		`{{ block('b') }}`,
+		expectErrorContains(`Unable to locate block "b"`),
+	),
 	newExecTest(
 		"Set statement",
 		`{% set val = 'a value' %}{{ val }}`,
@@ -153,6 +243,11 @@ var tests = []execTest{
 		`{% filter upper %}hello, world!{% endfilter %}`,
 		expect("HELLO, WORLD!"),
 	),
+	newExecTest(
+		"Apply statement",
+		`{% apply default('empty')|upper %}{% endapply %} {% apply upper|default('x') %}hello{% endapply %}`,
+		expect("EMPTY HELLO"),
+	),
 	newExecTest(
 		"Import statement",
 		`{% import 'macros.twig' as mac %}{{ mac.test("hi") }}`,
@@ -163,6 +258,52 @@ var tests = []execTest{
 		`{% from 'macros.twig' import test, def as other %}{{ other("", "HI!") }}`,
 		expect("HI!"),
 	),
+	newExecTest(
+		"Macro default arguments",
+		`{% macro input(name, type='text', size=20) %}{{ name }}:{{ type }}:{{ size }}{% endmacro %}{{ _self.input('a') }} {{ _self.input('b', 'password') }}`,
+		expect("a:text:20 b:password:20"),
+	),
+	newExecTest(
+		"Macro varargs",
+		`{% macro list(sep) %}{% for v in varargs %}{{ v }}{{ sep }}{% endfor %}{% endmacro %}{{ _self.list(',', 1, 2, 3) }}`,
+		expect("1,2,3,"),
+	),
+	newExecTest(
+		"Import self",
+		`{% import _self as forms %}{% macro tree(items) %}{% import _self as forms %}[{% for i in items %}{{ i.name }}{% if i.children != null %}{{ forms.tree(i.children) }}{% endif %}{% endfor %}]{% endmacro %}{{ forms.tree([{name: 'a', children: [{name: 'b'}]}, {name: 'c'}]) }}`,
+		expect("[a[b]c]"),
+	),
+	newExecTest(
+		"Call tag",
+		`{% macro panel(title) %}<div><h1>{{ title }}</h1>{{ caller() }}</div>{% endmacro %}{% set title = 'outer' %}{% call _self.panel('Title') %}{{ title }}{% endcall %}`,
+		expect("<div><h1>Title</h1>outer</div>"),
+	),
+	newExecTest(
+		"Call tag with arguments",
+		`{% import 'macros.twig' as mac %}{% call(item, sep = ';') mac.list([1, 2]) %}<{{ item }}>{{ sep }}{% endcall %}`,
+		expect("<1>;<2>;"),
+	),
+	newExecTest(
+		"Call tag caller not visible to nested macros",
+		`{% macro inner() %}[{{ caller() }}]{% endmacro %}{% macro outer() %}{{ _self.inner() }}{% endmacro %}{% call _self.outer() %}x{% endcall %}`,
+		expectErrorContains(`"caller"`),
+	),
+	newExecTest(
+		"Call tag nested in macro",
+		`{% macro wrap() %}({{ caller() }}){% endmacro %}{% macro outer() %}{% call _self.wrap() %}{{ caller() }}{% endcall %}{% endmacro %}{% call _self.outer() %}x{% endcall %}`,
+		expect("(x)"),
+	),
+	newExecTest(
+		"With tag",
+		`{% set a = 1 %}{% with {b: 2} %}{{ a }}{{ b }}{% set a = 5 %}{% set c = 3 %}{{ a }}{% endwith %}{{ a }}[{{ c }}]`,
+		expect("1251[]"),
+	),
+	newExecTest(
+		"With tag only",
+		`{% set a = 1 %}{% with {b: 2} only %}[{{ a }}{{ b }}]{% endwith %}{% with %}{{ a }}{% endwith %}`,
+		expect("[2]1"),
+	),
+	newExecTest("With tag invalid vars", `{% with 'x' %}{% endwith %}`, expectErrorContains("must be a hash")),
 	newExecTest(
 		"Ternary if",
 		`{{ false ? (true ? "Hello" : "World") : "Words" }}`,
@@ -178,6 +319,17 @@ var tests = []execTest{
 		`{% set v = {quadruple: "to the power of four!", 0: "ew", "0": "it's not that bad"} %}ew? {{ v.0 }} {{ v.quadruple }}`,
 		expect("ew? it's not that bad to the power of four!"),
 	),
+	newExecTest(
+		"Hash literal preserves order",
+		`{% for k, v in {"b": 1, "a": 2, "c": 3} %}{{ k }}{{ v }}{% endfor %}`,
+		expect("b1a2c3"),
+	),
+	newExecTest(
+		"Include with hash literal",
+		`{% include 'Hello, {{ name }}{{ value }}' with {"name": "world"} %}`,
+		expect(`Hello, world!`),
+		withContext(map[string]Value{"value": "!"}),
+	),
 	newExecTest(
 		"Array literal",
 		`{{ ["test", 1, "bar"][2] }}`,
@@ -417,6 +569,8 @@ func TestExec(t *testing.T) {
 {% macro test(arg) %}test: {{ arg }}{% endmacro %}
 
 {% macro def(val, default) %}{% if not val %}{{ default }}{% else %}{{ val }}{% endif %}{% endmacro %}
+
+{% macro list(items) %}{% for i in items %}{{ caller(i) }}{% endfor %}{% endmacro %}
 `),
 		},
 	))
@@ -449,6 +603,210 @@ func TestExec(t *testing.T) {
 	}
 }
 
+func TestIncludeFallback(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"default.twig": `default {{ name }}`,
+		"custom.twig":  `custom {{ name }}`,
+		"layout.twig":  `layout {% block content %}{% endblock %}`,
+		"broken.twig":  `{% if %}`,
+	}})
+	tests := []execTest{
+		newExecTest("Include list", `{% include ['missing.twig', 'custom.twig', 'default.twig'] %}`, expect(`custom a`), withContext(map[string]Value{"name": "a"})),
+		newExecTest("Include list fallback", `{% include ['custom/' ~ name ~ '.twig', 'default.twig'] %}`, expect(`default a`), withContext(map[string]Value{"name": "a"})),
+		newExecTest("Include list missing", `{% include ['x.twig', 'y.twig'] %}`, expectErrorContains(`unable to find one of the following templates: ["x.twig" "y.twig"]`)),
+		newExecTest("Include missing", `{% include 'x.twig' %}`, expectErrorContains(`file does not exist`)),
+		newExecTest("Include ignore missing", `a{% include 'x.twig' ignore missing %}b`, expect(`ab`)),
+		newExecTest("Include list ignore missing", `a{% include ['x.twig', 'y.twig'] ignore missing only %}b`, expect(`ab`)),
+		newExecTest("Include ignore missing with error", `{% include 'broken.twig' ignore missing %}`, expectErrorContains(`unexpected`)),
+		newExecTest("Embed ignore missing", `a{% embed 'x.twig' ignore missing %}{% block content %}c{% endblock %}{% endembed %}b`, expect(`ab`)),
+		newExecTest("Embed list", `{% embed ['x.twig', 'layout.twig'] %}{% block content %}c{% endblock %}{% endembed %}`, expect(`layout c`)),
+		newExecTest("Extends list", `{% extends ['x.twig', 'layout.twig'] %}{% block content %}c{% endblock %}`, expect(`layout c`)),
+		newExecTest("Include with non-hash", `{% include 'default.twig' with 5 %}`, expectErrorContains(`variables passed to include must be a hash, got int`)),
+		newExecTest("Include with list", `{% include 'default.twig' with [1, 2] %}`, expectErrorContains(`variables passed to include must be a hash`)),
+	}
+	for _, test := range tests {
+		env.Loader.(*MemoryLoader).Templates["test.twig"] = test.tpl
+		test.tpl = "test.twig"
+		evaluateTest(t, env, test)
+	}
+
+	// Loaders may wrap os.ErrNotExist.
+	loader := env.Loader.(*MemoryLoader)
+	env.Loader = &wrappingLoader{loader}
+	tests = []execTest{
+		newExecTest("Wrapped include ignore missing", `a{% include 'x.twig' ignore missing %}b`, expect(`ab`)),
+		newExecTest("Wrapped include list", `{% include ['x.twig', 'custom.twig'] %}`, expect(`custom a`), withContext(map[string]Value{"name": "a"})),
+	}
+	for _, test := range tests {
+		loader.Templates["test.twig"] = test.tpl
+		test.tpl = "test.twig"
+		evaluateTest(t, env, test)
+	}
+}
+
+// A wrappingLoader wraps the errors returned by another Loader.
+type wrappingLoader struct {
+	Loader
+}
+
+func (l *wrappingLoader) Load(name string) (Template, error) {
+	tpl, err := l.Loader.Load(name)
+	if err != nil {
+		return nil, &wrapError{"unable to load " + name, err}
+	}
+	return tpl, nil
+}
+
+// A wrapError is an error that wraps another.
+type wrapError struct {
+	msg string
+	err error
+}
+
+func (e *wrapError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *wrapError) Unwrap() error {
+	return e.err
+}
+
+func TestCustomOperators(t *testing.T) {
+	env := New(nil)
+	env.BinaryOperators["overlaps"] = BinaryOperator{
+		Precedence: 20,
+		Assoc:      parse.LeftAssoc,
+		Eval: func(ctx Context, left, right Value) (Value, error) {
+			found := false
+			_, err := Iterate(left, func(k, v Value, l Loop) (bool, error) {
+				found, _ = Contains(right, v)
+				return found, nil
+			})
+			return found, err
+		},
+	}
+	env.BinaryOperators["per"] = BinaryOperator{
+		Precedence: 60,
+		Assoc:      parse.LeftAssoc,
+		Eval: func(ctx Context, left, right Value) (Value, error) {
+			if CoerceNumber(right) == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return CoerceNumber(left) / CoerceNumber(right), nil
+		},
+	}
+	env.UnaryOperators["double"] = UnaryOperator{
+		Precedence: 500,
+		Eval: func(ctx Context, val Value) (Value, error) {
+			return numMultiply(val, 2), nil
+		},
+	}
+	tests := []execTest{
+		newExecTest("Binary operator", `{{ ([1, 2] overlaps [2, 3]) ? 'y' : 'n' }}{{ ([1] overlaps [2]) ? 'y' : 'n' }}`, expect("yn")),
+		newExecTest("Binary operator precedence", `{{ ([1] overlaps [0] ~ '' or true) ? 'y' : 'n' }}`, expect("y")),
+		newExecTest("Unary operator", `{{ double 2 + 1 }}`, expect("5")),
+		newExecTest("Binary operator error", `{{ 6 per 3 }}{{ 1 per 0 }}`, expectErrorContains("division by zero")),
+	}
+	for _, test := range tests {
+		evaluateTest(t, env, test)
+	}
+
+	// Operators are scoped to the Env they are registered on.
+	err := New(nil).Execute(`{{ [1] overlaps [1] }}`, ioutil.Discard, nil)
+	if err == nil {
+		t.Errorf("expected an error using an operator registered on another Env")
+	}
+}
+
+func TestDelimiters(t *testing.T) {
+	env := New(nil)
+	env.Delimiters = parse.Delimiters{PrintOpen: "[[", PrintClose: "]]", TagOpen: "<%", TagClose: "%>"}
+	tests := []execTest{
+		newExecTest("Custom delimiters", `<div>{{ vue }}</div><% for i in 1..2 %>[[ i ]]<% endfor %>{# comment #}`, expect("<div>{{ vue }}</div>12")),
+		newExecTest("Custom delimiters with include", `<% include '[[ name ]]!' %>`, expect("John!"), withContext(map[string]Value{"name": "John"})),
+		newExecTest("Custom delimiters error", `<% if a %>`, expectErrorContains(`unclosed tag "if"`)),
+	}
+	for _, test := range tests {
+		evaluateTest(t, env, test)
+	}
+}
+
+func TestParseRecover(t *testing.T) {
+	env := New(nil)
+	env.Delimiters = parse.Delimiters{PrintOpen: "[[", PrintClose: "]]", TagOpen: "<%", TagClose: "%>"}
+	env.Tags["ping"] = func(t *parse.Tree, start parse.Pos) (parse.Node, error) {
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		return parse.NewTextNode("pong", start), nil
+	}
+	tree, err := env.ParseRecover(`<% ping %>[[ 1 + ]]<% fo %>{{ x }}[[ y ]]<% ping %>`)
+	errs, ok := err.(parse.ParsingErrors)
+	if !ok {
+		t.Fatalf("expected ParsingErrors, got %T: %v", err, err)
+	}
+	var res []string
+	for _, e := range errs {
+		res = append(res, parse.Describe(e, env.Delimiters))
+	}
+	expected := []string{
+		`unexpected end of print "]]"`,
+		`unknown tag "fo"`,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got %q, expected %q", res, expected)
+	}
+	if tree == nil {
+		t.Fatal("expected a partial tree")
+	}
+	var nodes []string
+	for _, n := range tree.Root().All() {
+		nodes = append(nodes, n.String())
+	}
+	expected = []string{"Text(pong)", "Text({{ x }})", "Print(NameExpr(y))", "Text(pong)"}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("got %q, expected %q", nodes, expected)
+	}
+}
+
+// An extendsTransformer replaces every ExtendsNode with parent.
+type extendsTransformer struct {
+	parent *parse.ExtendsNode
+}
+
+func (v *extendsTransformer) Enter(n parse.Node) {}
+
+func (v *extendsTransformer) Leave(n parse.Node) parse.Node {
+	if _, ok := n.(*parse.ExtendsNode); ok {
+		if v.parent == nil {
+			return nil
+		}
+		return v.parent
+	}
+	return n
+}
+
+func TestTransformExtends(t *testing.T) {
+	env := New(&MemoryLoader{Templates: map[string]string{
+		"a.twig":     `A:{% block c %}{% endblock %}`,
+		"b.twig":     `B:{% block c %}{% endblock %}`,
+		"child.twig": `{% extends 'a.twig' %}{% block c %}child{% endblock %}`,
+	}})
+	tr := &extendsTransformer{}
+	env.Transformers = append(env.Transformers, tr)
+	tests := []struct {
+		parent   *parse.ExtendsNode
+		expected string
+	}{
+		{parse.NewExtendsNode(parse.NewStringExpr("b.twig", parse.Pos{}), parse.Pos{}), "B:child"},
+		{nil, "child"},
+	}
+	for _, test := range tests {
+		tr.parent = test.parent
+		evaluateTest(t, env, newExecTest("Transform extends", "child.twig", expect(test.expected)))
+	}
+}
+
 type fakePerson struct {
 	name string
 }
@@ -0,0 +1,117 @@
+package stick
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A loopValue is the special "loop" variable available inside a for loop.
+//
+// A single loopValue is reused for every iteration of a loop.
+type loopValue struct {
+	Loop
+	parent Value // The loop variable of the enclosing loop, if any.
+
+	prev    Value // The value of the previous item, if any.
+	next    Value // The value of the next item, if known.
+	hasPrev bool
+	hasNext bool
+
+	lastChanged Value // The last value passed to changed.
+	hasChanged  bool
+}
+
+// newLoopValue returns a loopValue with the given parent loop variable.
+func newLoopValue(parent Value) *loopValue {
+	return &loopValue{parent: parent}
+}
+
+// attr returns the value of the named loop attribute.
+func (l *loopValue) attr(name string, args ...Value) (Value, error) {
+	switch name {
+	case "index", "Index":
+		return l.Index, nil
+	case "index0", "Index0":
+		return l.Index0, nil
+	case "first", "First":
+		return l.First, nil
+	case "last", "Last", "revindex", "revindex0", "length":
+		if l.Length < 0 {
+			// Only available when the length of the iterated value is known.
+			break
+		}
+		switch name {
+		case "last", "Last":
+			return l.Last, nil
+		case "revindex":
+			return l.Revindex, nil
+		case "revindex0":
+			return l.Revindex0, nil
+		}
+		return l.Length, nil
+	case "parent":
+		if l.parent != nil {
+			return l.parent, nil
+		}
+	case "previtem":
+		if l.hasPrev {
+			return l.prev, nil
+		}
+		return nil, nil
+	case "nextitem":
+		if l.hasNext {
+			return l.next, nil
+		}
+		return nil, nil
+	case "cycle":
+		return l.cycle(args...)
+	case "changed":
+		return l.changed(args...), nil
+	}
+	return nil, fmt.Errorf("getattr: unable to locate attribute \"%s\" on loop", name)
+}
+
+// cycle returns the argument at the current position, cycling through the
+// arguments as the loop progresses.
+func (l *loopValue) cycle(args ...Value) (Value, error) {
+	if len(args) == 0 {
+		return nil, errors.New("loop.cycle: at least one argument is required")
+	}
+	return args[l.Index0%len(args)], nil
+}
+
+// changed returns true if it is the first call, or if the given values are
+// different from those passed in the previous call.
+func (l *loopValue) changed(args ...Value) bool {
+	var v Value = args
+	if len(args) == 1 {
+		v = args[0]
+	}
+	if l.hasChanged && Equal(l.lastChanged, v) {
+		return false
+	}
+	l.lastChanged = v
+	l.hasChanged = true
+	return true
+}
+
+// loopItems is a Countable Iterator over the items of a filtered loop.
+type loopItems struct {
+	items []loopItem
+	pos   int
+}
+
+// Next returns the next key and value.
+func (it *loopItems) Next() (Value, Value, bool) {
+	if it.pos >= len(it.items) {
+		return nil, nil, false
+	}
+	item := it.items[it.pos]
+	it.pos++
+	return item.k, item.v, true
+}
+
+// Len returns the number of items.
+func (it *loopItems) Len() int {
+	return len(it.items)
+}
@@ -0,0 +1,323 @@
+package stick
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Errors returned by arithmetic operations.
+var (
+	ErrDivisionByZero = errors.New("stick: division by zero")
+	ErrModuloByZero   = errors.New("stick: modulo by zero")
+	ErrRangeTooLarge  = errors.New("stick: range has too many elements")
+	ErrRangeBounds    = errors.New("stick: range bounds must be integers between -2^53 and 2^53")
+)
+
+// MaxRangeLength is the maximum number of elements in a range created with
+// the ".." operator.
+const MaxRangeLength = 1 << 20
+
+// maxExactFloat is the largest float64 up to which every integer is exact.
+const maxExactFloat = 1 << 53
+
+// A numeric is the result of coercing a Value for use in arithmetic.
+//
+// Integers are kept as int64 for as long as possible so that large values,
+// such as IDs greater than 2^53, do not lose precision. Operations follow
+// PHP semantics: the result is an integer when both operands are integers
+// and the result fits in an int64, otherwise it is a float64.
+type numeric struct {
+	i     int64
+	f     float64
+	isInt bool
+}
+
+func intNumeric(i int64) numeric {
+	return numeric{i: i, isInt: true}
+}
+
+func floatNumeric(f float64) numeric {
+	return numeric{f: f}
+}
+
+// float returns the numeric as a float64.
+func (n numeric) float() float64 {
+	if n.isInt {
+		return float64(n.i)
+	}
+	return n.f
+}
+
+// int returns the numeric as an int64, truncating any fractional part.
+func (n numeric) int() int64 {
+	if n.isInt {
+		return n.i
+	}
+	return int64(n.f)
+}
+
+// value returns the numeric as either an int64 or a float64 Value.
+func (n numeric) value() Value {
+	if n.isInt {
+		return n.i
+	}
+	return n.f
+}
+
+// stringToNumeric parses a numeric string, preferring an integer result.
+// Zero is returned if the string is not numeric.
+func stringToNumeric(s string) numeric {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return intNumeric(i)
+	}
+	return floatNumeric(stringToFloat(s))
+}
+
+// toNumeric coerces the given value into a numeric. Integer types are kept
+// as integers; everything else is coerced as CoerceNumber would.
+func toNumeric(v Value) numeric {
+	switch vc := v.(type) {
+	case nil:
+		return intNumeric(0)
+	case SafeValue:
+		return toNumeric(vc.Value())
+	case int:
+		return intNumeric(int64(vc))
+	case int8:
+		return intNumeric(int64(vc))
+	case int16:
+		return intNumeric(int64(vc))
+	case int32:
+		return intNumeric(int64(vc))
+	case int64:
+		return intNumeric(vc)
+	case uint:
+		return uintToNumeric(uint64(vc))
+	case uint8:
+		return intNumeric(int64(vc))
+	case uint16:
+		return intNumeric(int64(vc))
+	case uint32:
+		return intNumeric(int64(vc))
+	case uint64:
+		return uintToNumeric(vc)
+	case float32:
+		return floatNumeric(float64(vc))
+	case float64:
+		return floatNumeric(vc)
+	case bool:
+		if vc {
+			return intNumeric(1)
+		}
+		return intNumeric(0)
+	case decimal.Decimal:
+		if vc.IsInteger() && vc.Abs().LessThanOrEqual(decimal.NewFromInt(math.MaxInt64)) {
+			return intNumeric(vc.IntPart())
+		}
+		f, _ := vc.Float64()
+		return floatNumeric(f)
+	case Number:
+		return floatNumeric(vc.Number())
+	case string:
+		return stringToNumeric(vc)
+	case Stringer:
+		return stringToNumeric(vc.String())
+	}
+	return floatNumeric(CoerceNumber(v))
+}
+
+func uintToNumeric(u uint64) numeric {
+	if u > math.MaxInt64 {
+		return floatNumeric(float64(u))
+	}
+	return intNumeric(int64(u))
+}
+
+// numAdd returns left + right.
+func numAdd(left, right Value) Value {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		s := l.i + r.i
+		if (s > l.i) == (r.i > 0) {
+			return s
+		}
+	}
+	return l.float() + r.float()
+}
+
+// numSubtract returns left - right.
+func numSubtract(left, right Value) Value {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		s := l.i - r.i
+		if (s < l.i) == (r.i > 0) {
+			return s
+		}
+	}
+	return l.float() - r.float()
+}
+
+// numMultiply returns left * right.
+func numMultiply(left, right Value) Value {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		if p, ok := mulInt64(l.i, r.i); ok {
+			return p
+		}
+	}
+	return l.float() * r.float()
+}
+
+// mulInt64 multiplies two integers. The second return value is false if the
+// result overflows.
+func mulInt64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	p := a * b
+	if p/b != a || (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return 0, false
+	}
+	return p, true
+}
+
+// numDivide returns left / right. Like PHP, the result is an integer only
+// when both operands are integers and the division has no remainder.
+func numDivide(left, right Value) (Value, error) {
+	l, r := toNumeric(left), toNumeric(right)
+	if r.float() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	if l.isInt && r.isInt && l.i%r.i == 0 && !(l.i == math.MinInt64 && r.i == -1) {
+		return l.i / r.i, nil
+	}
+	return l.float() / r.float(), nil
+}
+
+// numFloorDivide returns left // right, the division rounded down to the
+// nearest integer.
+func numFloorDivide(left, right Value) (Value, error) {
+	l, r := toNumeric(left), toNumeric(right)
+	if r.float() == 0 {
+		return nil, ErrDivisionByZero
+	}
+	if l.isInt && r.isInt && !(l.i == math.MinInt64 && r.i == -1) {
+		q := l.i / r.i
+		if l.i%r.i != 0 && (l.i < 0) != (r.i < 0) {
+			q--
+		}
+		return q, nil
+	}
+	f := math.Floor(l.float() / r.float())
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return int64(f), nil
+	}
+	return f, nil
+}
+
+// numModulo returns left % right. The result takes the sign of the dividend.
+// Floats are not truncated; the floating-point remainder is returned instead.
+func numModulo(left, right Value) (Value, error) {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		if r.i == 0 {
+			return nil, ErrModuloByZero
+		}
+		return l.i % r.i, nil
+	}
+	if r.float() == 0 {
+		return nil, ErrModuloByZero
+	}
+	return math.Mod(l.float(), r.float()), nil
+}
+
+// numPower returns left ** right.
+func numPower(left, right Value) Value {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt && r.i >= 0 {
+		res, base, exp := int64(1), l.i, r.i
+		ok := true
+		for exp > 0 && ok {
+			if exp&1 == 1 {
+				res, ok = mulInt64(res, base)
+			}
+			exp >>= 1
+			if exp > 0 && ok {
+				base, ok = mulInt64(base, base)
+			}
+		}
+		if ok {
+			return res
+		}
+	}
+	return math.Pow(l.float(), r.float())
+}
+
+// numNegate returns -val.
+func numNegate(val Value) Value {
+	n := toNumeric(val)
+	if n.isInt && n.i != math.MinInt64 {
+		return -n.i
+	}
+	return -n.float()
+}
+
+// numPositive returns val as a number.
+func numPositive(val Value) Value {
+	return toNumeric(val).value()
+}
+
+// numRange returns a slice containing every number between left and right,
+// inclusive. The range counts down if left is greater than right.
+//
+// An error is returned if the range would have more than MaxRangeLength
+// elements, or if a float bound is not an integer that a float64 can
+// represent exactly.
+func numRange(left, right Value) (Value, error) {
+	l, r := toNumeric(left), toNumeric(right)
+	if l.isInt && r.isInt {
+		// The difference is computed as uint64 so that it cannot overflow.
+		n, step := uint64(r.i)-uint64(l.i), int64(1)
+		if l.i > r.i {
+			n, step = uint64(l.i)-uint64(r.i), -1
+		}
+		if n >= MaxRangeLength {
+			return nil, ErrRangeTooLarge
+		}
+		res := make([]int64, 0, n+1)
+		for k := l.i; ; k += step {
+			res = append(res, k)
+			if k == r.i {
+				break
+			}
+		}
+		return res, nil
+	}
+	lf, rf := l.float(), r.float()
+	for _, f := range []float64{lf, rf} {
+		// NaN is not equal to itself, so it is rejected here too.
+		if f != math.Trunc(f) || math.Abs(f) > maxExactFloat {
+			return nil, ErrRangeBounds
+		}
+	}
+	n, step := rf-lf, 1.0
+	if lf > rf {
+		n, step = lf-rf, -1
+	}
+	if n >= MaxRangeLength {
+		return nil, ErrRangeTooLarge
+	}
+	res := make([]float64, 0, int(n)+1)
+	for k := lf; ; k += step {
+		res = append(res, k)
+		if k == rf {
+			break
+		}
+	}
+	return res, nil
+}
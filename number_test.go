@@ -0,0 +1,105 @@
+package stick
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestArithmetic(t *testing.T) {
+	div := func(l, r Value) Value {
+		v, err := numDivide(l, r)
+		if err != nil {
+			return err
+		}
+		return v
+	}
+	floorDiv := func(l, r Value) Value {
+		v, err := numFloorDivide(l, r)
+		if err != nil {
+			return err
+		}
+		return v
+	}
+	mod := func(l, r Value) Value {
+		v, err := numModulo(l, r)
+		if err != nil {
+			return err
+		}
+		return v
+	}
+	ts := []struct {
+		name     string
+		actual   Value
+		expected Value
+	}{
+		{"add ints", numAdd(1, int64(2)), int64(3)},
+		{"add large ints", numAdd(int64(9007199254740993), 1), int64(9007199254740994)},
+		{"add overflow", numAdd(int64(math.MaxInt64), 1), float64(math.MaxInt64) + 1},
+		{"add int and float", numAdd(1, 0.5), 1.5},
+		{"add numeric strings", numAdd("2", "3"), int64(5)},
+		{"add bools", numAdd(true, true), int64(2)},
+		{"subtract ints", numSubtract(1, 3), int64(-2)},
+		{"subtract overflow", numSubtract(int64(math.MinInt64), 1), float64(math.MinInt64) - 1},
+		{"multiply ints", numMultiply(6, 7), int64(42)},
+		{"multiply overflow", numMultiply(int64(math.MaxInt64), 2), float64(math.MaxInt64) * 2},
+		{"divide evenly", div(10, 5), int64(2)},
+		{"divide unevenly", div(10, 4), 2.5},
+		{"divide floats", div(1.5, 0.5), 3.0},
+		{"divide by zero", div(1, 0), ErrDivisionByZero},
+		{"divide by zero float", div(1, 0.0), ErrDivisionByZero},
+		{"floor divide", floorDiv(10, 4), int64(2)},
+		{"floor divide negative", floorDiv(-10, 4), int64(-3)},
+		{"floor divide floats", floorDiv(7.5, 2), int64(3)},
+		{"floor divide by zero", floorDiv(1, 0), ErrDivisionByZero},
+		{"modulo ints", mod(10, 3), int64(1)},
+		{"modulo negative", mod(-10, 3), int64(-1)},
+		{"modulo floats", mod(5.5, 2), 1.5},
+		{"modulo by zero", mod(1, 0), ErrModuloByZero},
+		{"power ints", numPower(2, 10), int64(1024)},
+		{"power negative exponent", numPower(2, -1), 0.5},
+		{"power overflow", numPower(10, 20), 1e20},
+		{"negate int", numNegate(5), int64(-5)},
+		{"negate string", numNegate("1.5"), -1.5},
+		{"uint64 above int64", numAdd(uint64(math.MaxUint64), 0), float64(math.MaxUint64)},
+	}
+	for _, test := range ts {
+		if test.actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v (%T)\n\tgot: %v (%T)", test.name, test.expected, test.expected, test.actual, test.actual)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	ts := []struct {
+		name     string
+		left     Value
+		right    Value
+		expected string
+		err      error
+	}{
+		{"ascending", 1, 3, "[1 2 3]", nil},
+		{"descending", 3, 1, "[3 2 1]", nil},
+		{"single", 2, 2, "[2]", nil},
+		{"floats", 1.0, 3, "[1 2 3]", nil},
+		{"max int", int64(math.MaxInt64 - 1), int64(math.MaxInt64), "[9223372036854775806 9223372036854775807]", nil},
+		{"min int", int64(math.MinInt64 + 1), int64(math.MinInt64), "[-9223372036854775807 -9223372036854775808]", nil},
+		{"too large", 1, MaxRangeLength + 1, "<nil>", ErrRangeTooLarge},
+		{"too large descending", 0, -MaxRangeLength, "<nil>", ErrRangeTooLarge},
+		{"full int64", int64(math.MinInt64), int64(math.MaxInt64), "<nil>", ErrRangeTooLarge},
+		{"huge floats", 1e16, 1e17, "<nil>", ErrRangeBounds},
+		{"huge float span", -1e15, 1e15, "<nil>", ErrRangeTooLarge},
+		{"fractional float", 0.5, 2, "<nil>", ErrRangeBounds},
+		{"infinity", 1, math.Inf(1), "<nil>", ErrRangeBounds},
+		{"nan", math.NaN(), 1, "<nil>", ErrRangeBounds},
+	}
+	for _, test := range ts {
+		res, err := numRange(test.left, test.right)
+		if err != test.err {
+			t.Errorf("%s:\n\texpected error: %v\n\tgot: %v", test.name, test.err, err)
+		}
+		if actual := fmt.Sprintf("%v", res); actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+	}
+}
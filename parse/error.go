@@ -1,13 +1,20 @@
 package parse
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
 // A ParsingError represents an error originating from parsing.
 type ParsingError interface {
 	error
-	Pos() Pos     // Pos returns the position where the error originated.
+	Start() Pos   // Start returns the position where the error originated.
+	End() Pos     // End returns the position following the offending source, if known.
 	Name() string // Name returns the name of the template this error occurred in.
 
+	// describe returns the message of the error, without position, for display to users.
+	describe(d Delimiters) string
+
 	// setTree is used internally to enrich the error with extra information.
 	setTree(t *Tree)
 }
@@ -20,11 +27,16 @@ type DebugError interface {
 
 type parseError struct {
 	Pos
+	end  Pos
 	name string // The template this error occurred in.
 }
 
 func newParseError(p Pos) parseError {
-	return parseError{p, ""}
+	return parseError{p, Pos{}, ""}
+}
+
+func (e *parseError) End() Pos {
+	return e.end
 }
 
 func (e *parseError) Name() string {
@@ -70,9 +82,34 @@ func (e *UnexpectedTokenError) Error() string {
 	return e.sprintf(`expected one of %s, got "%s"`, s, e.actual.tokenType)
 }
 
+func (e *UnexpectedTokenError) describe(d Delimiters) string {
+	if e.actual.tokenType == tokenError {
+		// The lexer describes the problem in the token value.
+		return e.actual.value
+	}
+	if len(e.expected) == 0 {
+		return "unexpected " + e.actual.describe(d)
+	}
+
+	s := ""
+	for i, typ := range e.expected {
+		switch {
+		case i == 0:
+		case i == len(e.expected)-1:
+			s = s + " or "
+		default:
+			s = s + ", "
+		}
+		s = s + typ.describe(d)
+	}
+	return fmt.Sprintf(`expected %s, got %s`, s, e.actual.describe(d))
+}
+
 // newUnexpectedTokenError returns a new UnexpectedTokenError
 func newUnexpectedTokenError(actual token, expected ...tokenType) error {
-	return &UnexpectedTokenError{newBaseError(actual.Pos), actual, expected}
+	err := &UnexpectedTokenError{newBaseError(actual.Pos), actual, expected}
+	err.end = actual.end()
+	return err
 }
 
 // UnclosedTagError is generated when a tag is not properly closed.
@@ -85,6 +122,10 @@ func (e *UnclosedTagError) Error() string {
 	return e.sprintf(`unclosed tag "%s" starting`, e.tagName)
 }
 
+func (e *UnclosedTagError) describe(d Delimiters) string {
+	return fmt.Sprintf(`unclosed tag "%s"`, e.tagName)
+}
+
 // newUnclosedTagError returns a new UnclosedTagError.
 func newUnclosedTagError(tagName string, start Pos) error {
 	return &UnclosedTagError{newBaseError(start), tagName}
@@ -96,7 +137,11 @@ type UnexpectedEOFError struct {
 }
 
 func (e *UnexpectedEOFError) Error() string {
-	return e.sprintf(`unexpected end of input`)
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *UnexpectedEOFError) describe(d Delimiters) string {
+	return `unexpected end of input`
 }
 
 // newUnexpectedEOFError returns a new UnexpectedEOFError
@@ -112,12 +157,74 @@ type UnexpectedValueError struct {
 }
 
 func (e *UnexpectedValueError) Error() string {
-	return e.sprintf(`unexpected "%s", expected "%s"`, e.tok.value, e.val)
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *UnexpectedValueError) describe(d Delimiters) string {
+	return fmt.Sprintf(`unexpected "%s", expected "%s"`, e.tok.value, e.val)
 }
 
 // newUnexpectedValueError returns a new UnexpectedPunctuationError
 func newUnexpectedValueError(tok token, expected string) error {
-	return &UnexpectedValueError{newBaseError(tok.Pos), tok, expected}
+	err := &UnexpectedValueError{newBaseError(tok.Pos), tok, expected}
+	err.end = tok.end()
+	return err
+}
+
+// UnexpectedExprError describes an expression that is not valid in its position.
+type UnexpectedExprError struct {
+	baseError
+	expr Expr   // The actual expression.
+	src  string // The source of the expression.
+	val  string // A description of what was expected.
+}
+
+func (e *UnexpectedExprError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *UnexpectedExprError) describe(d Delimiters) string {
+	return fmt.Sprintf(`unexpected "%s", expected %s`, e.src, e.val)
+}
+
+// newUnexpectedExprError returns a new UnexpectedExprError.
+func newUnexpectedExprError(t *Tree, expr Expr, expected string) error {
+	err := &UnexpectedExprError{newBaseError(expr.Start()), expr, t.source(expr), expected}
+	err.end = expr.End()
+	return err
+}
+
+// UnknownTagError describes a tag that is neither built-in nor user-defined.
+type UnknownTagError struct {
+	baseError
+	tagName string
+	known   []string // The names of all tags known to the parser.
+}
+
+func (e *UnknownTagError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *UnknownTagError) describe(d Delimiters) string {
+	return fmt.Sprintf(`unknown tag "%s"`, e.tagName)
+}
+
+// TagName returns the name of the unknown tag.
+func (e *UnknownTagError) TagName() string {
+	return e.tagName
+}
+
+// KnownTags returns the names of all tags known to the parser, built-in
+// and user-defined, in alphabetical order.
+func (e *UnknownTagError) KnownTags() []string {
+	return e.known
+}
+
+// newUnknownTagError returns a new UnknownTagError.
+func newUnknownTagError(name token, known []string) error {
+	err := &UnknownTagError{newBaseError(name.Pos), name.value, known}
+	err.end = name.end()
+	return err
 }
 
 // MultipleExtendsError describes an attempt to extend from multiple parent templates.
@@ -126,10 +233,133 @@ type MultipleExtendsError struct {
 }
 
 func (e *MultipleExtendsError) Error() string {
-	return e.sprintf(`a template may have only one "extends" statement`)
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *MultipleExtendsError) describe(d Delimiters) string {
+	return `a template may have only one "extends" statement`
 }
 
 // newMultipleExtendsError returns a new MultipleExtendsError
 func newMultipleExtendsError(start Pos) error {
 	return &MultipleExtendsError{newBaseError(start)}
 }
+
+// LoopControlError describes a break or continue tag used outside of a for loop.
+type LoopControlError struct {
+	baseError
+	tagName string
+}
+
+func (e *LoopControlError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *LoopControlError) describe(d Delimiters) string {
+	return fmt.Sprintf(`"%s" tag is only allowed inside a "for" loop`, e.tagName)
+}
+
+// newLoopControlError returns a new LoopControlError.
+func newLoopControlError(tagName string, start Pos) error {
+	return &LoopControlError{newBaseError(start), tagName}
+}
+
+// AssignCountError describes a set tag with a different number of variables
+// and values.
+type AssignCountError struct {
+	baseError
+	targets int
+	values  int
+}
+
+func (e *AssignCountError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *AssignCountError) describe(d Delimiters) string {
+	return fmt.Sprintf(`set requires the same number of variables and values, got %d variables and %d values`, e.targets, e.values)
+}
+
+// newAssignCountError returns a new AssignCountError for the given values.
+func newAssignCountError(targets, n int, values Expr) error {
+	err := &AssignCountError{newBaseError(values.Start()), targets, n}
+	err.end = values.End()
+	return err
+}
+
+// AutoEscapeStrategyError describes an invalid strategy passed to an autoescape tag.
+type AutoEscapeStrategyError struct {
+	baseError
+}
+
+func (e *AutoEscapeStrategyError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *AutoEscapeStrategyError) describe(d Delimiters) string {
+	return `an escaping strategy must be a string or false`
+}
+
+// newAutoEscapeStrategyError returns a new AutoEscapeStrategyError.
+func newAutoEscapeStrategyError(start Pos) error {
+	return &AutoEscapeStrategyError{newBaseError(start)}
+}
+
+// ReplaceNodeError describes a NodeTransformer returning a replacement that
+// cannot take the place of the original Node.
+type ReplaceNodeError struct {
+	baseError
+	parent Node
+	old    Node
+	new    Node
+}
+
+func (e *ReplaceNodeError) Error() string {
+	return e.sprintf("%s", e.describe(Delimiters{}))
+}
+
+func (e *ReplaceNodeError) describe(d Delimiters) string {
+	if e.parent == nil {
+		return fmt.Sprintf(`unable to replace the root %T with %T`, e.old, e.new)
+	}
+	if e.new == nil {
+		return fmt.Sprintf(`unable to remove %T from %T`, e.old, e.parent)
+	}
+	return fmt.Sprintf(`unable to replace %T in %T with %T`, e.old, e.parent, e.new)
+}
+
+// newReplaceNodeError returns a new ReplaceNodeError.
+func newReplaceNodeError(parent, old, new Node) error {
+	err := &ReplaceNodeError{newBaseError(old.Start()), parent, old, new}
+	err.end = old.End()
+	return err
+}
+
+// ParsingErrors is a list of ParsingErrors, returned by a Tree in recovery mode.
+type ParsingErrors []ParsingError
+
+// Error returns the first error message, followed by the number of remaining errors.
+func (e ParsingErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "parse: no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// Describe returns the message of err for display to users. Unlike the
+// message returned by Error, it does not include the position of the error,
+// and tokens are described as they appear in the source, using the given
+// delimiters.
+func Describe(err ParsingError, d Delimiters) string {
+	return err.describe(d.withDefaults())
+}
+
+// sort sorts the list by the position of each error.
+func (e ParsingErrors) sort() {
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Start().Byte < e[j].Start().Byte
+	})
+}
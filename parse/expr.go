@@ -9,13 +9,13 @@ type Expr interface {
 
 // NameExpr represents an identifier, such as a variable.
 type NameExpr struct {
-	Pos
+	Range
 	Name string // Name of the identifier.
 }
 
 // NewNameExpr returns a NameExpr.
 func NewNameExpr(name string, pos Pos) *NameExpr {
-	return &NameExpr{pos, name}
+	return &NameExpr{Range{pos, pos.advance(name)}, name}
 }
 
 // All returns all the child Nodes in a NameExpr.
@@ -30,7 +30,7 @@ func (exp *NameExpr) String() string {
 
 // NullExpr represents a null literal.
 type NullExpr struct {
-	Pos
+	Range
 }
 
 // All returns all the child Nodes in a NullExpr.
@@ -40,7 +40,7 @@ func (exp *NullExpr) All() []Node {
 
 // NewNullExpr returns a NullExpr.
 func NewNullExpr(pos Pos) *NullExpr {
-	return &NullExpr{pos}
+	return &NullExpr{Range{Pos: pos}}
 }
 
 // String returnsa string representation of the NullExpr.
@@ -50,13 +50,13 @@ func (exp *NullExpr) String() string {
 
 // BoolExpr represents a boolean literal.
 type BoolExpr struct {
-	Pos
+	Range
 	Value bool // The raw boolean value.
 }
 
 // NewBoolExpr returns a BoolExpr.
 func NewBoolExpr(value bool, pos Pos) *BoolExpr {
-	return &BoolExpr{pos, value}
+	return &BoolExpr{Range{Pos: pos}, value}
 }
 
 // All returns all the child Nodes in a UseNode.
@@ -74,13 +74,13 @@ func (exp *BoolExpr) String() string {
 
 // NumberExpr represents a number literal.
 type NumberExpr struct {
-	Pos
+	Range
 	Value string // The string representation of the number.
 }
 
 // NewNumberExpr returns a NumberExpr.
 func NewNumberExpr(val string, pos Pos) *NumberExpr {
-	return &NumberExpr{pos, val}
+	return &NumberExpr{Range{pos, pos.advance(val)}, val}
 }
 
 // All returns all the child Nodes in a NumberExpr.
@@ -95,13 +95,13 @@ func (exp *NumberExpr) String() string {
 
 // StringExpr represents a string literal.
 type StringExpr struct {
-	Pos
+	Range
 	Text string // The text contained within the literal.
 }
 
 // NewStringExpr returns a StringExpr.
 func NewStringExpr(text string, pos Pos) *StringExpr {
-	return &StringExpr{pos, text}
+	return &StringExpr{Range{pos, pos.advance(text)}, text}
 }
 
 // All returns all the child Nodes in a StringExpr.
@@ -116,7 +116,7 @@ func (exp *StringExpr) String() string {
 
 // FuncExpr represents a function call.
 type FuncExpr struct {
-	Pos
+	Range
 	Name string // The name of the function.
 	Args []Expr // Arguments to be passed to the function.
 }
@@ -132,7 +132,7 @@ func (exp *FuncExpr) All() []Node {
 
 // NewFuncExpr returns a FuncExpr.
 func NewFuncExpr(name string, args []Expr, pos Pos) *FuncExpr {
-	return &FuncExpr{pos, name, args}
+	return &FuncExpr{Range{Pos: pos}, name, args}
 }
 
 // String returns a string representation of a FuncExpr.
@@ -143,6 +143,7 @@ func (exp *FuncExpr) String() string {
 // FilterExpr represents a filter application.
 type FilterExpr struct {
 	*FuncExpr
+	NamePos Pos // The position of the name of the filter.
 }
 
 // String returns a string representation of the FilterExpr.
@@ -151,8 +152,10 @@ func (exp *FilterExpr) String() string {
 }
 
 // NewFilterExpr returns a FilterExpr.
+//
+// The position of the name is initially pos, the start of the expression.
 func NewFilterExpr(name string, args []Expr, pos Pos) *FilterExpr {
-	return &FilterExpr{NewFuncExpr(name, args, pos)}
+	return &FilterExpr{NewFuncExpr(name, args, pos), pos}
 }
 
 // TestExpr represents a boolean test expression.
@@ -172,7 +175,7 @@ func NewTestExpr(name string, args []Expr, pos Pos) *TestExpr {
 
 // BinaryExpr represents a binary operation, such as "x + y"
 type BinaryExpr struct {
-	Pos
+	Range
 	Left  Expr   // Left side expression.
 	Op    string // Binary operation in string form.
 	Right Expr   // Right side expression.
@@ -180,7 +183,7 @@ type BinaryExpr struct {
 
 // NewBinaryExpr returns a BinaryExpr.
 func NewBinaryExpr(left Expr, op string, right Expr, pos Pos) *BinaryExpr {
-	return &BinaryExpr{pos, left, op, right}
+	return &BinaryExpr{Range{pos, endOf(right)}, left, op, right}
 }
 
 // All returns all the child Nodes in a BinaryExpr.
@@ -195,14 +198,14 @@ func (exp *BinaryExpr) String() string {
 
 // UnaryExpr represents a unary operation, such as "not x"
 type UnaryExpr struct {
-	Pos
+	Range
 	Op string // The operation, in string form.
 	X  Expr   // Expression to be evaluated.
 }
 
 // NewUnaryExpr returns a new UnaryExpr.
 func NewUnaryExpr(op string, expr Expr, pos Pos) *UnaryExpr {
-	return &UnaryExpr{pos, op, expr}
+	return &UnaryExpr{Range{pos, endOf(expr)}, op, expr}
 }
 
 // All returns all the child Nodes in a UnaryExpr.
@@ -217,13 +220,13 @@ func (exp *UnaryExpr) String() string {
 
 // GroupExpr represents an arbitrary wrapper around an inner expression.
 type GroupExpr struct {
-	Pos
+	Range
 	X Expr // Expression to be evaluated.
 }
 
 // NewGroupExpr returns a GroupExpr.
 func NewGroupExpr(inner Expr, pos Pos) *GroupExpr {
-	return &GroupExpr{pos, inner}
+	return &GroupExpr{Range{Pos: pos}, inner}
 }
 
 // All returns all the child Nodes in a GroupExpr.
@@ -238,7 +241,7 @@ func (exp *GroupExpr) String() string {
 
 // GetAttrExpr represents an attempt to retrieve an attribute from a value.
 type GetAttrExpr struct {
-	Pos
+	Range
 	Cont Expr   // Container to get attribute from.
 	Attr Expr   // Attribute to get.
 	Args []Expr // Args to pass to attribute, if its a method.
@@ -246,7 +249,7 @@ type GetAttrExpr struct {
 
 // NewGetAttrExpr returns a GetAttrExpr.
 func NewGetAttrExpr(cont Expr, attr Expr, args []Expr, pos Pos) *GetAttrExpr {
-	return &GetAttrExpr{pos, cont, attr, args}
+	return &GetAttrExpr{Range{Pos: pos}, cont, attr, args}
 }
 
 // All returns all the child Nodes in a GetAttrExpr.
@@ -268,7 +271,7 @@ func (exp *GetAttrExpr) String() string {
 
 // TernaryIfExpr represents an attempt to retrieve an attribute from a value.
 type TernaryIfExpr struct {
-	Pos
+	Range
 	Cond   Expr // Condition to test.
 	TrueX  Expr // Expression if Cond is true.
 	FalseX Expr // Expression if Cond is false.
@@ -276,7 +279,7 @@ type TernaryIfExpr struct {
 
 // NewTernaryIfExpr returns a TernaryIfExpr.
 func NewTernaryIfExpr(cond, tx, fx Expr, pos Pos) *TernaryIfExpr {
-	return &TernaryIfExpr{pos, cond, tx, fx}
+	return &TernaryIfExpr{Range{pos, endOf(fx)}, cond, tx, fx}
 }
 
 // All returns all the child Nodes in a TernaryIfExpr.
@@ -290,14 +293,14 @@ func (exp *TernaryIfExpr) String() string {
 }
 
 type KeyValueExpr struct {
-	Pos
+	Range
 	Key   Expr
 	Value Expr
 }
 
 // NewKeyValueExpr returns a KeyValueExpr.
 func NewKeyValueExpr(k, v Expr, pos Pos) *KeyValueExpr {
-	return &KeyValueExpr{pos, k, v}
+	return &KeyValueExpr{Range{pos, endOf(v)}, k, v}
 }
 
 // All returns all the child Nodes in a KeyValueExpr.
@@ -311,13 +314,13 @@ func (exp *KeyValueExpr) String() string {
 }
 
 type HashExpr struct {
-	Pos
+	Range
 	Elements []*KeyValueExpr
 }
 
 // NewHashExpr returns a HashExpr.
 func NewHashExpr(pos Pos, elements ...*KeyValueExpr) *HashExpr {
-	return &HashExpr{pos, elements}
+	return &HashExpr{Range{Pos: pos}, elements}
 }
 
 // All returns all the child Nodes in a HashExpr.
@@ -335,13 +338,13 @@ func (exp *HashExpr) String() string {
 }
 
 type ArrayExpr struct {
-	Pos
+	Range
 	Elements []Expr
 }
 
 // NewArrayExpr returns a ArrayExpr.
 func NewArrayExpr(pos Pos, els ...Expr) *ArrayExpr {
-	return &ArrayExpr{pos, els}
+	return &ArrayExpr{Range{Pos: pos}, els}
 }
 
 // All returns all the child Nodes in a ArrayExpr.
@@ -357,3 +360,31 @@ func (exp *ArrayExpr) All() []Node {
 func (exp *ArrayExpr) String() string {
 	return fmt.Sprintf("ArrayExpr%v", exp.Elements)
 }
+
+// TupleExpr represents a comma separated list of expressions, such as the
+// targets and values in a multiple assignment.
+//
+//	{% set a, b = 1, 2 %}
+type TupleExpr struct {
+	Range
+	Elements []Expr
+}
+
+// NewTupleExpr returns a TupleExpr.
+func NewTupleExpr(pos Pos, els ...Expr) *TupleExpr {
+	return &TupleExpr{Range{Pos: pos}, els}
+}
+
+// All returns all the child Nodes in a TupleExpr.
+func (exp *TupleExpr) All() []Node {
+	all := make([]Node, len(exp.Elements))
+	for i, v := range exp.Elements {
+		all[i] = v
+	}
+	return all
+}
+
+// String returns a string representation of a TupleExpr.
+func (exp *TupleExpr) String() string {
+	return fmt.Sprintf("TupleExpr%v", exp.Elements)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"strings"
 	"unicode"
 )
@@ -69,6 +70,50 @@ func (typ tokenType) String() string {
 	return names[typ]
 }
 
+// describe returns a user-facing description of the token type, using the
+// given delimiters.
+func (typ tokenType) describe(d Delimiters) string {
+	switch typ {
+	case tokenEOF:
+		return "end of input"
+	case tokenCommentOpen:
+		return fmt.Sprintf(`start of comment "%s"`, d.CommentOpen)
+	case tokenCommentClose:
+		return fmt.Sprintf(`end of comment "%s"`, d.CommentClose)
+	case tokenTagOpen:
+		return fmt.Sprintf(`start of tag "%s"`, d.TagOpen)
+	case tokenTagClose:
+		return fmt.Sprintf(`end of tag "%s"`, d.TagClose)
+	case tokenPrintOpen:
+		return fmt.Sprintf(`start of print "%s"`, d.PrintOpen)
+	case tokenPrintClose:
+		return fmt.Sprintf(`end of print "%s"`, d.PrintClose)
+	case tokenInterpolateOpen:
+		return fmt.Sprintf(`start of interpolation "%s"`, d.InterpolateOpen)
+	case tokenInterpolateClose:
+		return fmt.Sprintf(`end of interpolation "%s"`, d.InterpolateClose)
+	case tokenParensOpen:
+		return `"("`
+	case tokenParensClose:
+		return `")"`
+	case tokenArrayOpen:
+		return `"["`
+	case tokenArrayClose:
+		return `"]"`
+	case tokenHashOpen:
+		return `"{"`
+	case tokenHashClose:
+		return `"}"`
+	case tokenStringOpen:
+		return "string"
+	case tokenStringClose:
+		return "end of string"
+	case tokenError:
+		return "invalid syntax"
+	}
+	return strings.ToLower(typ.String())
+}
+
 const (
 	delimEOF              = ""
 	delimOpenTag          = "{%"
@@ -83,6 +128,53 @@ const (
 	delimHashKeyValue     = ":"
 )
 
+// Delimiters defines the character sequences that begin and end template
+// syntax. Empty fields use the default delimiter.
+type Delimiters struct {
+	PrintOpen        string // Begins a print statement, "{{" by default.
+	PrintClose       string // Ends a print statement, "}}" by default.
+	TagOpen          string // Begins a tag, "{%" by default.
+	TagClose         string // Ends a tag, "%}" by default.
+	CommentOpen      string // Begins a comment, "{#" by default.
+	CommentClose     string // Ends a comment, "#}" by default.
+	InterpolateOpen  string // Begins interpolation inside a string, "#{" by default.
+	InterpolateClose string // Ends interpolation inside a string, "}" by default.
+}
+
+// DefaultDelimiters returns the default, Twig compatible, delimiters.
+func DefaultDelimiters() Delimiters {
+	return Delimiters{
+		PrintOpen:        delimOpenPrint,
+		PrintClose:       delimClosePrint,
+		TagOpen:          delimOpenTag,
+		TagClose:         delimCloseTag,
+		CommentOpen:      delimOpenComment,
+		CommentClose:     delimCloseComment,
+		InterpolateOpen:  delimOpenInterpolate,
+		InterpolateClose: delimCloseInterpolate,
+	}
+}
+
+// withDefaults returns a copy of d with any empty fields set to the default.
+func (d Delimiters) withDefaults() Delimiters {
+	def := DefaultDelimiters()
+	for _, f := range []struct{ v, def *string }{
+		{&d.PrintOpen, &def.PrintOpen},
+		{&d.PrintClose, &def.PrintClose},
+		{&d.TagOpen, &def.TagOpen},
+		{&d.TagClose, &def.TagClose},
+		{&d.CommentOpen, &def.CommentOpen},
+		{&d.CommentClose, &def.CommentClose},
+		{&d.InterpolateOpen, &def.InterpolateOpen},
+		{&d.InterpolateClose, &def.InterpolateClose},
+	} {
+		if *f.v == "" {
+			*f.v = *f.def
+		}
+	}
+	return d
+}
+
 type token struct {
 	value     string
 	tokenType tokenType
@@ -93,6 +185,21 @@ func (tok token) String() string {
 	return fmt.Sprintf("{%s '%s' %s}", tok.tokenType, tok.value, tok.Pos)
 }
 
+// describe returns a user-facing description of the token, including its
+// value where it is not implied by the type.
+func (tok token) describe(d Delimiters) string {
+	switch tok.tokenType {
+	case tokenName, tokenNumber, tokenPunctuation, tokenOperator:
+		return fmt.Sprintf(`%s "%s"`, tok.tokenType.describe(d), tok.value)
+	}
+	return tok.tokenType.describe(d)
+}
+
+// end returns the position following the token.
+func (tok token) end() Pos {
+	return tok.Pos.advance(tok.value)
+}
+
 // stateFn may emit zero or more tokens.
 type stateFn func(*lexer) stateFn
 
@@ -117,6 +224,12 @@ type lexer struct {
 	mode   mode
 	last   token // The last emitted token
 	parens int   // Number of open parenthesis
+
+	done    chan struct{} // Closed when the consumer stops reading tokens.
+	recover bool          // If true, lexing resumes at the next opening delimiter after an error.
+
+	operators *regexp.Regexp // Matches operators.
+	delims    Delimiters     // Delimiters for template syntax.
 }
 
 // nextToken returns the next token emitted by the lexer.
@@ -126,7 +239,8 @@ func (l *lexer) nextToken() token {
 		return v
 	}
 
-	return l.last
+	// The lexer may have stopped after an error; report EOF from then on.
+	return token{"", tokenEOF, l.last.Pos}
 }
 
 // tokenize kicks things off.
@@ -134,13 +248,33 @@ func (l *lexer) tokenize() {
 	for l.state = lexData; l.state != nil; {
 		l.state = l.state(l)
 	}
+	l.mode = modeClosed
+	close(l.tokens)
+}
+
+// stop signals the lexer that no more tokens will be read, allowing
+// the tokenizing goroutine to finish.
+func (l *lexer) stop() {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+}
+
+// send passes the token to the consumer, unless it has stopped reading.
+func (l *lexer) send(tok token) {
+	select {
+	case l.tokens <- tok:
+	case <-l.done:
+	}
 }
 
 // newLexer creates a lexer, ready to begin tokenizing.
 func newLexer(input io.Reader) *lexer {
 	// TODO: lexer should use the reader.
 	i, _ := ioutil.ReadAll(input)
-	return &lexer{0, 0, 1, 0, string(i), make(chan token), nil, modeNormal, token{}, 0}
+	return &lexer{0, 0, 1, 0, string(i), make(chan token), nil, modeNormal, token{}, 0, make(chan struct{}), false, operatorMatcher, DefaultDelimiters()}
 }
 
 func (l *lexer) next() (val string) {
@@ -174,7 +308,7 @@ func (l *lexer) emit(t tokenType) {
 		val = l.input[l.start:l.pos]
 	}
 
-	tok := token{val, t, Pos{l.line, l.offset}}
+	tok := token{val, t, Pos{l.line, l.offset, l.start}}
 
 	if c := strings.Count(val, "\n"); c > 0 {
 		l.line += c
@@ -184,41 +318,60 @@ func (l *lexer) emit(t tokenType) {
 		l.offset += len(val)
 	}
 
-	l.tokens <- tok
+	l.send(tok)
 	l.start = l.pos
-	if tok.tokenType == tokenEOF {
-		close(l.tokens)
-		l.mode = modeClosed
-	}
 }
 
+// errorf emits an error token. Lexing stops, unless the lexer is recovering,
+// in which case it resumes at the next opening delimiter.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	tok := token{fmt.Sprintf(format, args...), tokenError, Pos{l.line, l.offset}}
-	l.tokens <- tok
+	tok := token{fmt.Sprintf(format, args...), tokenError, Pos{l.line, l.offset, l.start}}
+	l.send(tok)
 
-	return nil
+	if !l.recover || l.mode == modeInterpolate {
+		l.mode = modeClosed
+		return nil
+	}
+	l.pos = l.start
+	for l.pos < len(l.input) && l.lexOpen() == nil {
+		l.pos++
+	}
+	p := Pos{l.line, l.offset, l.start}.advance(l.input[l.start:l.pos])
+	l.line, l.offset = p.Line, p.Offset
+	l.start = l.pos
+	l.parens = 0
+	return lexData
+}
+
+// lexOpen returns the stateFn for the opening delimiter at the current
+// position, or nil if there is none. Longer delimiters are tried first, in
+// case one delimiter is a prefix of another.
+func (l *lexer) lexOpen() stateFn {
+	var next stateFn
+	longest := 0
+	for _, d := range []struct {
+		delim string
+		fn    stateFn
+	}{
+		{l.delims.CommentOpen, lexCommentOpen},
+		{l.delims.TagOpen, lexTagOpen},
+		{l.delims.PrintOpen, lexPrintOpen},
+	} {
+		if len(d.delim) > longest && strings.HasPrefix(l.input[l.pos:], d.delim) {
+			next = d.fn
+			longest = len(d.delim)
+		}
+	}
+	return next
 }
 
 func lexData(l *lexer) stateFn {
 	for {
-		switch {
-		case strings.HasPrefix(l.input[l.pos:], delimOpenComment):
-			if l.pos > l.start {
-				l.emit(tokenText)
-			}
-			return lexCommentOpen
-
-		case strings.HasPrefix(l.input[l.pos:], delimOpenTag):
+		if next := l.lexOpen(); next != nil {
 			if l.pos > l.start {
 				l.emit(tokenText)
 			}
-			return lexTagOpen
-
-		case strings.HasPrefix(l.input[l.pos:], delimOpenPrint):
-			if l.pos > l.start {
-				l.emit(tokenText)
-			}
-			return lexPrintOpen
+			return next
 		}
 
 		if l.next() == delimEOF {
@@ -236,6 +389,10 @@ func lexData(l *lexer) stateFn {
 }
 
 func lexExpression(l *lexer) stateFn {
+	if l.mode == modeInterpolate && l.parens == 0 && strings.HasPrefix(l.input[l.pos:], l.delims.InterpolateClose) {
+		l.pos += len(l.delims.InterpolateClose)
+		return nil
+	}
 	if l.tryLexOperator() {
 		// Special handling for operators is necessary because of the alphabetical
 		// operators like "not" and "is".
@@ -245,15 +402,15 @@ func lexExpression(l *lexer) stateFn {
 	case str == delimEOF:
 		return lexData
 
-	case strings.HasPrefix(l.input[l.pos:], delimCloseTag),
-		strings.HasPrefix(l.input[l.pos:], delimTrimWhitespace+delimCloseTag):
+	case strings.HasPrefix(l.input[l.pos:], l.delims.TagClose),
+		strings.HasPrefix(l.input[l.pos:], delimTrimWhitespace+l.delims.TagClose):
 		if l.pos > l.start {
 			return l.errorf("pos > start, previous token not emitted?")
 		}
 		return lexTagClose
 
-	case strings.HasPrefix(l.input[l.pos:], delimClosePrint),
-		strings.HasPrefix(l.input[l.pos:], delimTrimWhitespace+delimClosePrint):
+	case strings.HasPrefix(l.input[l.pos:], l.delims.PrintClose),
+		strings.HasPrefix(l.input[l.pos:], delimTrimWhitespace+l.delims.PrintClose):
 		if l.pos > l.start {
 			return l.errorf("pos > start, previous token not emitted?")
 		}
@@ -289,15 +446,13 @@ func lexExpression(l *lexer) stateFn {
 // This is implemented this way because Twig supports many alphabetical operators like "in",
 // which require more than just a check of the next character.
 func (l *lexer) tryLexOperator() bool {
-	op := operatorMatcher.FindString(l.input[l.pos:])
+	op := l.operators.FindString(l.input[l.pos:])
 	if op == "" {
 		return false
-	} else if op == "%" {
-		// Ensure this is not a tag close token "%}".
+	} else if l.isCloseDelim(l.input[l.pos:]) {
+		// Ensure this is not a close token such as "%}".
 		// Go's regexp engine does not support negative lookahead.
-		if l.input[l.pos+1:l.pos+2] == "}" {
-			return false
-		}
+		return false
 	} else if isAlpha(op) {
 		// If operator is alphabetic (such as "in" or "is"),
 		// we avoid matching "include" or functions like "is_currently_on"
@@ -306,11 +461,9 @@ func (l *lexer) tryLexOperator() bool {
 		if (l.pos+lenOp+1) <= len(l.input) && l.input[l.pos+lenOp:l.pos+lenOp+1] != " " {
 			return false
 		}
-	} else if op == delimTrimWhitespace {
-		switch l.input[l.pos+1 : l.pos+3] {
-		case delimClosePrint, delimCloseTag:
-			return false
-		}
+	} else if op == delimTrimWhitespace && l.isCloseDelim(l.input[l.pos+1:]) {
+		// The trim whitespace modifier of a close token such as "-%}".
+		return false
 	}
 	l.pos += len(op)
 	l.emit(tokenOperator)
@@ -318,6 +471,11 @@ func (l *lexer) tryLexOperator() bool {
 	return true
 }
 
+// isCloseDelim returns true if s begins with a tag or print close delimiter.
+func (l *lexer) isCloseDelim(s string) bool {
+	return strings.HasPrefix(s, l.delims.TagClose) || strings.HasPrefix(s, l.delims.PrintClose)
+}
+
 // Check if a string only contains alphabetic characters
 func isAlpha(s string) bool {
 	for _, r := range s {
@@ -345,6 +503,9 @@ func lexSpace(l *lexer) stateFn {
 func lexNumber(l *lexer) stateFn {
 	for {
 		str := l.next()
+		if str == delimEOF {
+			break
+		}
 		if !isNumeric(str) {
 			l.backup()
 			break
@@ -359,6 +520,9 @@ func lexNumber(l *lexer) stateFn {
 func lexPunctuation(l *lexer) stateFn {
 	for {
 		str := l.next()
+		if str == delimEOF {
+			break
+		}
 		if !isPunctuation(str) {
 			l.backup()
 			break
@@ -378,17 +542,17 @@ func lexString(l *lexer) stateFn {
 		return l.errorf("unclosed string")
 	}
 
-	if open == `"` && strings.Contains(l.input[l.pos:l.pos+closePos], delimOpenInterpolate) {
+	if open == `"` && strings.Contains(l.input[l.pos:l.pos+closePos], l.delims.InterpolateOpen) {
 		input := l.input
 		l.input = input[0 : l.pos+closePos]
 		for {
-			p := strings.Index(l.input[l.pos:], delimOpenInterpolate)
+			p := strings.Index(l.input[l.pos:], l.delims.InterpolateOpen)
 			if p < 0 {
 				break
 			}
 			l.pos += p
 			l.emit(tokenText)
-			l.pos += len(delimOpenInterpolate)
+			l.pos += len(l.delims.InterpolateOpen)
 			l.emit(tokenInterpolateOpen)
 			l.mode = modeInterpolate
 			for ins := lexExpression; ins != nil; {
@@ -443,9 +607,6 @@ func lexCloseParens(l *lexer) stateFn {
 		l.emit(tokenArrayClose)
 
 	case str == "}":
-		if l.parens == 0 && l.mode == modeInterpolate {
-			return nil
-		}
 		l.emit(tokenHashClose)
 
 	default:
@@ -473,12 +634,12 @@ func lexName(l *lexer) stateFn {
 }
 
 func lexCommentOpen(l *lexer) stateFn {
-	l.pos += len(delimOpenComment)
+	l.pos += len(l.delims.CommentOpen)
 	if l.peek() == delimTrimWhitespace {
 		l.pos++
 	}
 	l.emit(tokenCommentOpen)
-	til := strings.Index(l.input[l.pos:], delimCloseComment)
+	til := strings.Index(l.input[l.pos:], l.delims.CommentClose)
 	if til < 0 {
 		til = len(l.input[l.start:])
 	}
@@ -490,17 +651,17 @@ func lexCommentOpen(l *lexer) stateFn {
 	} else {
 		l.emit(tokenText)
 	}
-	if !strings.HasPrefix(l.input[l.pos:], delimCloseComment) {
-		return l.errorf("expected comment close")
+	if !strings.HasPrefix(l.input[l.pos:], l.delims.CommentClose) {
+		return l.errorf(`expected comment close "%s"`, l.delims.CommentClose)
 	}
-	l.pos += len(delimCloseComment)
+	l.pos += len(l.delims.CommentClose)
 	l.emit(tokenCommentClose)
 
 	return lexData
 }
 
 func lexTagOpen(l *lexer) stateFn {
-	l.pos += len(delimOpenTag)
+	l.pos += len(l.delims.TagOpen)
 	if l.peek() == delimTrimWhitespace {
 		l.pos++
 	}
@@ -516,14 +677,14 @@ func lexTagClose(l *lexer) stateFn {
 	if l.peek() == delimTrimWhitespace {
 		l.pos++
 	}
-	l.pos += len(delimCloseTag)
+	l.pos += len(l.delims.TagClose)
 	l.emit(tokenTagClose)
 
 	return lexData
 }
 
 func lexPrintOpen(l *lexer) stateFn {
-	l.pos += len(delimOpenPrint)
+	l.pos += len(l.delims.PrintOpen)
 	if l.peek() == delimTrimWhitespace {
 		l.pos++
 	}
@@ -539,7 +700,7 @@ func lexPrintClose(l *lexer) stateFn {
 	if l.peek() == delimTrimWhitespace {
 		l.pos++
 	}
-	l.pos += len(delimClosePrint)
+	l.pos += len(l.delims.PrintClose)
 	l.emit(tokenPrintClose)
 
 	return lexData
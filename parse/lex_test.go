@@ -3,6 +3,7 @@ package parse
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 type lexTest struct {
@@ -12,7 +13,7 @@ type lexTest struct {
 }
 
 func mkTok(t tokenType, val string) token {
-	return token{val, t, Pos{0, 0}}
+	return token{val, t, Pos{}}
 }
 
 var (
@@ -55,7 +56,7 @@ var lexTests = []lexTest{
 	{"unclosed comment", "{# Hello there", []token{
 		tCommentOpen,
 		mkTok(tokenText, " Hello there"),
-		mkTok(tokenError, "expected comment close"),
+		mkTok(tokenError, `expected comment close "#}"`),
 	}},
 
 	{"number", "{{ 5 }}", []token{
@@ -359,3 +360,145 @@ func TestLex(t *testing.T) {
 		}
 	}
 }
+
+func TestLexDelimiters(t *testing.T) {
+	delims := Delimiters{
+		PrintOpen:       "[[",
+		PrintClose:      "]]",
+		TagOpen:         "<%",
+		TagClose:        "%>",
+		CommentOpen:     "<#",
+		CommentClose:    "#>",
+		InterpolateOpen: "${",
+	}.withDefaults()
+	tests := []lexTest{
+		{"print", `{{ vue }}[[- a ]]`, []token{
+			mkTok(tokenText, "{{ vue }}"),
+			mkTok(tokenPrintOpen, "[["+delimTrimWhitespace),
+			tSpace,
+			mkTok(tokenName, "a"),
+			tSpace,
+			mkTok(tokenPrintClose, "]]"),
+			tEOF,
+		}},
+		{"tag", `<% if a %>{% raw %}<% endif -%>`, []token{
+			mkTok(tokenTagOpen, "<%"),
+			tSpace,
+			mkTok(tokenName, "if"),
+			tSpace,
+			mkTok(tokenName, "a"),
+			tSpace,
+			mkTok(tokenTagClose, "%>"),
+			mkTok(tokenText, "{% raw %}"),
+			mkTok(tokenTagOpen, "<%"),
+			tSpace,
+			mkTok(tokenName, "endif"),
+			tSpace,
+			mkTok(tokenTagClose, delimTrimWhitespace+"%>"),
+			tEOF,
+		}},
+		{"modulo before tag close", `<% 5 % 2 %>`, []token{
+			mkTok(tokenTagOpen, "<%"),
+			tSpace,
+			mkTok(tokenNumber, "5"),
+			tSpace,
+			mkTok(tokenOperator, "%"),
+			tSpace,
+			mkTok(tokenNumber, "2"),
+			tSpace,
+			mkTok(tokenTagClose, "%>"),
+			tEOF,
+		}},
+		{"comment", `<# {{ a }} #>`, []token{
+			mkTok(tokenCommentOpen, "<#"),
+			mkTok(tokenText, " {{ a }} "),
+			mkTok(tokenCommentClose, "#>"),
+			tEOF,
+		}},
+		{"unclosed comment", `<# a #}`, []token{
+			mkTok(tokenCommentOpen, "<#"),
+			mkTok(tokenText, " a #}"),
+			mkTok(tokenError, `expected comment close "#>"`),
+		}},
+		{"interpolation", `[[ "a${ b }#{c}" ]]`, []token{
+			mkTok(tokenPrintOpen, "[["),
+			tSpace,
+			mkTok(tokenStringOpen, `"`),
+			mkTok(tokenText, "a"),
+			mkTok(tokenInterpolateOpen, "${"),
+			tSpace,
+			mkTok(tokenName, "b"),
+			tSpace,
+			mkTok(tokenInterpolateClose, "}"),
+			mkTok(tokenText, "#{c}"),
+			mkTok(tokenStringClose, `"`),
+			tSpace,
+			mkTok(tokenPrintClose, "]]"),
+			tEOF,
+		}},
+	}
+	for _, test := range tests {
+		lex := newLexer(bytes.NewReader([]byte(test.input)))
+		lex.delims = delims
+		var tokens []token
+		go lex.tokenize()
+		for {
+			tok := lex.nextToken()
+			tokens = append(tokens, tok)
+			if tok.tokenType == tokenEOF || tok.tokenType == tokenError {
+				break
+			}
+		}
+		if !equal(tokens, test.tokens) {
+			t.Errorf("%s: got\n\t%+v\nexpected\n\t%v", test.name, tokens, test.tokens)
+		}
+	}
+}
+
+func TestLexStop(t *testing.T) {
+	lex := newLexer(bytes.NewReader([]byte("{{ a }}{{ b }}{{ c }}")))
+	done := make(chan struct{})
+	go func() {
+		lex.tokenize()
+		close(done)
+	}()
+	lex.nextToken()
+	lex.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lexer did not stop")
+	}
+}
+
+func TestLexRecover(t *testing.T) {
+	lex := newLexer(bytes.NewReader([]byte("{{ 'a }}b\n{{ c }}")))
+	lex.recover = true
+	go lex.tokenize()
+	var tokens []token
+	for {
+		tok := lex.nextToken()
+		tokens = append(tokens, tok)
+		if tok.tokenType == tokenEOF {
+			break
+		}
+	}
+	expected := []token{
+		tPrintOpen,
+		tSpace,
+		mkTok(tokenStringOpen, "'"),
+		mkTok(tokenError, "unclosed string"),
+		tPrintOpen,
+		tSpace,
+		mkTok(tokenName, "c"),
+		tSpace,
+		tPrintClose,
+		tEOF,
+	}
+	if !equal(tokens, expected) {
+		t.Errorf("got\n\t%+v\nexpected\n\t%v", tokens, expected)
+	}
+	if p := tokens[4].Pos; p.Line != 2 || p.Offset != 0 || p.Byte != 10 {
+		t.Errorf("expected resumed token at 2:0, got %s (byte %d)", p, p.Byte)
+	}
+}
@@ -10,6 +10,7 @@ import (
 type Node interface {
 	String() string // String representation of the Node, for debugging.
 	Start() Pos     // The position of the Node in the source code.
+	End() Pos       // The position immediately following the Node in the source code.
 	All() []Node    // All children of the Node.
 }
 
@@ -20,10 +21,17 @@ type TrimmableNode struct {
 	TrimAfter  bool // True if whitespace after the node should be removed.
 }
 
+// setTrim sets whether whitespace before and after the node should be removed.
+func (t *TrimmableNode) setTrim(before, after bool) {
+	t.TrimBefore = before
+	t.TrimAfter = after
+}
+
 // Pos is used to track line and offset in a given string.
 type Pos struct {
 	Line   int
-	Offset int
+	Offset int // The column; the offset in bytes from the start of Line.
+	Byte   int // The offset in bytes from the start of the input.
 }
 
 // Start returns the start position of the node.
@@ -36,6 +44,44 @@ func (p Pos) String() string {
 	return fmt.Sprintf("%d:%d", p.Line, p.Offset)
 }
 
+// advance returns the position immediately following the given text, if the
+// text were to start at p.
+func (p Pos) advance(text string) Pos {
+	p.Byte += len(text)
+	if c := strings.Count(text, "\n"); c > 0 {
+		p.Line += c
+		p.Offset = len(text) - strings.LastIndex(text, "\n") - 1
+	} else {
+		p.Offset += len(text)
+	}
+	return p
+}
+
+// Range tracks the start and end position of a Node in the source code.
+type Range struct {
+	Pos        // The position of the first character of the Node.
+	EndPos Pos // The position immediately following the last character of the Node.
+}
+
+// End returns the position immediately following the node.
+func (r Range) End() Pos {
+	return r.EndPos
+}
+
+// setRange sets the start and end position of the node.
+func (r *Range) setRange(start, end Pos) {
+	r.Pos = start
+	r.EndPos = end
+}
+
+// endOf returns the end position of the given Node, or the zero Pos if n is nil.
+func endOf(n Node) Pos {
+	if n == nil {
+		return Pos{}
+	}
+	return n.End()
+}
+
 // ModuleNode represents a root node in the AST.
 type ModuleNode struct {
 	*BodyNode
@@ -45,7 +91,7 @@ type ModuleNode struct {
 
 // NewModuleNode returns a ModuleNode.
 func NewModuleNode(name string, nodes ...Node) *ModuleNode {
-	return &ModuleNode{NewBodyNode(Pos{1, 0}, nodes...), nil, name}
+	return &ModuleNode{NewBodyNode(Pos{Line: 1}, nodes...), nil, name}
 }
 
 // String returns a string representation of a ModuleNode.
@@ -54,14 +100,19 @@ func (l *ModuleNode) String() string {
 }
 
 // BodyNode represents a list of nodes.
+//
+// When the body is enclosed by tags, such as the body of a block, TrimStart
+// and TrimEnd record the whitespace control markers on the tags next to it.
 type BodyNode struct {
-	Pos
-	Nodes []Node
+	Range
+	Nodes     []Node
+	TrimStart bool // True if whitespace at the start of the body should be removed.
+	TrimEnd   bool // True if whitespace at the end of the body should be removed.
 }
 
 // NewBodyNode returns a BodyNode.
 func NewBodyNode(pos Pos, nodes ...Node) *BodyNode {
-	return &BodyNode{pos, nodes}
+	return &BodyNode{Range: Range{Pos: pos}, Nodes: nodes}
 }
 
 // Append a Node to the BodyNode.
@@ -81,13 +132,13 @@ func (l *BodyNode) All() []Node {
 
 // TextNode represents raw, non Stick source code, like plain HTML.
 type TextNode struct {
-	Pos
+	Range
 	Data string // Textual data in the node.
 }
 
 // NewTextNode returns a TextNode.
 func NewTextNode(data string, p Pos) *TextNode {
-	return &TextNode{p, data}
+	return &TextNode{Range{p, p.advance(data)}, data}
 }
 
 // String returns a string representation of a TextNode.
@@ -111,16 +162,29 @@ func NewCommentNode(data string, p Pos) *CommentNode {
 	return &CommentNode{NewTextNode(data, p), TrimmableNode{}}
 }
 
+// VerbatimNode represents raw template source inside a verbatim tag.
+//
+//	{% verbatim %}{{ not evaluated }}{% endverbatim %}
+type VerbatimNode struct {
+	*TextNode
+	TrimmableNode
+}
+
+// NewVerbatimNode returns a VerbatimNode.
+func NewVerbatimNode(data string, p Pos) *VerbatimNode {
+	return &VerbatimNode{NewTextNode(data, p), TrimmableNode{}}
+}
+
 // PrintNode represents a print statement
 type PrintNode struct {
-	Pos
+	Range
 	TrimmableNode
 	X Expr // Expression to print.
 }
 
 // NewPrintNode returns a PrintNode.
 func NewPrintNode(exp Expr, p Pos) *PrintNode {
-	return &PrintNode{p, TrimmableNode{}, exp}
+	return &PrintNode{Range{Pos: p}, TrimmableNode{}, exp}
 }
 
 // String returns a string representation of a PrintNode.
@@ -135,7 +199,7 @@ func (t *PrintNode) All() []Node {
 
 // BlockNode represents a block statement
 type BlockNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Name   string // Name of the block.
 	Body   Node   // Body of the block.
@@ -144,7 +208,7 @@ type BlockNode struct {
 
 // NewBlockNode returns a BlockNode.
 func NewBlockNode(name string, body Node, p Pos) *BlockNode {
-	return &BlockNode{p, TrimmableNode{}, name, body, ""}
+	return &BlockNode{Range{Pos: p}, TrimmableNode{}, name, body, ""}
 }
 
 // String returns a string representation of a BlockNode.
@@ -159,7 +223,7 @@ func (t *BlockNode) All() []Node {
 
 // IfNode represents an if statement
 type IfNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Cond Expr // Condition to test.
 	Body Node // Body to evaluate if Cond is true.
@@ -168,7 +232,7 @@ type IfNode struct {
 
 // NewIfNode returns a IfNode.
 func NewIfNode(cond Expr, body Node, els Node, p Pos) *IfNode {
-	return &IfNode{p, TrimmableNode{}, cond, body, els}
+	return &IfNode{Range{Pos: p}, TrimmableNode{}, cond, body, els}
 }
 
 // String returns a string representation of an IfNode.
@@ -183,14 +247,14 @@ func (t *IfNode) All() []Node {
 
 // ExtendsNode represents an extends statement
 type ExtendsNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Tpl Expr // Name of the template being extended.
 }
 
 // NewExtendsNode returns a ExtendsNode.
 func NewExtendsNode(tplRef Expr, p Pos) *ExtendsNode {
-	return &ExtendsNode{p, TrimmableNode{}, tplRef}
+	return &ExtendsNode{Range{Pos: p}, TrimmableNode{}, tplRef}
 }
 
 // String returns a string representation of an ExtendsNode.
@@ -205,46 +269,63 @@ func (t *ExtendsNode) All() []Node {
 
 // ForNode represents a for loop construct.
 type ForNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Key  string // Name of key variable, or empty string.
-	Val  string // Name of val variable.
+	Val  string // Name of val variable, or empty string if Target is used.
 	X    Expr   // Expression to iterate over.
+	Cond Expr   // Condition items must meet to be looped over, or nil.
 	Body Node   // Body of the for loop.
 	Else Node   // Body of the else section if X is empty.
+
+	Target *TupleExpr // Names each value is unpacked into, or nil if Val is used.
 }
 
 // NewForNode returns a ForNode.
 func NewForNode(k, v string, expr Expr, body, els Node, p Pos) *ForNode {
-	return &ForNode{p, TrimmableNode{}, k, v, expr, body, els}
+	return &ForNode{Range{Pos: p}, TrimmableNode{}, k, v, expr, nil, body, els, nil}
 }
 
 // String returns a string representation of a ForNode.
 func (t *ForNode) String() string {
-	return fmt.Sprintf("For(%s, %s in %s: %s else %s)", t.Key, t.Val, t.X, t.Body, t.Else)
+	var val interface{} = t.Val
+	if t.Target != nil {
+		val = t.Target
+	}
+	if t.Cond != nil {
+		return fmt.Sprintf("For(%s, %s in %s if %s: %s else %s)", t.Key, val, t.X, t.Cond, t.Body, t.Else)
+	}
+	return fmt.Sprintf("For(%s, %s in %s: %s else %s)", t.Key, val, t.X, t.Body, t.Else)
 }
 
 // All returns all the child Nodes in a ForNode.
 func (t *ForNode) All() []Node {
+	if t.Cond != nil {
+		return []Node{t.X, t.Cond, t.Body, t.Else}
+	}
 	return []Node{t.X, t.Body, t.Else}
 }
 
 // IncludeNode is an include statement.
 type IncludeNode struct {
-	Pos
+	Range
 	TrimmableNode
-	Tpl  Expr // Expression evaluating to the name of the template to include.
-	With Expr // Explicit list of variables to include in the included template.
-	Only bool // If true, only vars defined in With will be passed.
+	Tpl           Expr // Expression evaluating to the name of the template, or a list of names, to include.
+	With          Expr // Explicit list of variables to include in the included template.
+	Only          bool // If true, only vars defined in With will be passed.
+	IgnoreMissing bool // If true, nothing is included when the template does not exist.
 }
 
 // NewIncludeNode returns a IncludeNode.
 func NewIncludeNode(tmpl Expr, with Expr, only bool, pos Pos) *IncludeNode {
-	return &IncludeNode{pos, TrimmableNode{}, tmpl, with, only}
+	return &IncludeNode{Range{Pos: pos}, TrimmableNode{}, tmpl, with, only, false}
 }
 
 // String returns a string representation of an IncludeNode.
 func (t *IncludeNode) String() string {
+	if t.IgnoreMissing {
+		return fmt.Sprintf("Include(%s ignore missing with %s %v)", t.Tpl, t.With, t.Only)
+	}
 	return fmt.Sprintf("Include(%s with %s %v)", t.Tpl, t.With, t.Only)
 }
 
@@ -266,6 +347,9 @@ func NewEmbedNode(tmpl Expr, with Expr, only bool, blocks map[string]*BlockNode,
 
 // String returns a string representation of an EmbedNode.
 func (t *EmbedNode) String() string {
+	if t.IgnoreMissing {
+		return fmt.Sprintf("Embed(%s ignore missing with %s %v: %v)", t.Tpl, t.With, t.Only, t.Blocks)
+	}
 	return fmt.Sprintf("Embed(%s with %s %v: %v)", t.Tpl, t.With, t.Only, t.Blocks)
 }
 
@@ -283,7 +367,7 @@ func (t *EmbedNode) All() []Node {
 //
 //	{% use '::blocks.html.twig' with main as base_main, left as base_left %}
 type UseNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Tpl     Expr              // Evaluates to the name of the template to include.
 	Aliases map[string]string // Aliases for included block names, if any.
@@ -291,7 +375,7 @@ type UseNode struct {
 
 // NewUseNode returns a UseNode.
 func NewUseNode(tpl Expr, aliases map[string]string, pos Pos) *UseNode {
-	return &UseNode{pos, TrimmableNode{}, tpl, aliases}
+	return &UseNode{Range{Pos: pos}, TrimmableNode{}, tpl, aliases}
 }
 
 // String returns a string representation of a UseNode.
@@ -320,19 +404,33 @@ func (t *UseNode) All() []Node {
 
 // SetNode is a set operation on the given varName.
 type SetNode struct {
-	Pos
+	Range
 	TrimmableNode
-	Name string // Name of the var to set.
-	X    Node   // Value of the var.
+	Name   string // Name of the var to set, or empty string if Target is not a name.
+	X      Node   // Value of the var.
+	Target Expr   // Target of the assignment; a NameExpr, GetAttrExpr, or TupleExpr.
 }
 
 // NewSetNode returns a SetNode.
 func NewSetNode(varName string, expr Node, pos Pos) *SetNode {
-	return &SetNode{pos, TrimmableNode{}, varName, expr}
+	return &SetNode{Range{Pos: pos}, TrimmableNode{}, varName, expr, NewNameExpr(varName, pos)}
+}
+
+// NewSetTargetNode returns a SetNode that assigns to the given target. If
+// target is a TupleExpr, the value is unpacked into each of its elements.
+func NewSetTargetNode(target Expr, expr Node, pos Pos) *SetNode {
+	n := &SetNode{Range{Pos: pos}, TrimmableNode{}, "", expr, target}
+	if name, ok := target.(*NameExpr); ok {
+		n.Name = name.Name
+	}
+	return n
 }
 
 // String returns a string representation of an SetNode.
 func (t *SetNode) String() string {
+	if t.Name == "" && t.Target != nil {
+		return fmt.Sprintf("Set(%s = %v)", t.Target, t.X)
+	}
 	return fmt.Sprintf("Set(%s = %v)", t.Name, t.X)
 }
 
@@ -343,14 +441,14 @@ func (t *SetNode) All() []Node {
 
 // DoNode simply executes the expression it contains.
 type DoNode struct {
-	Pos
+	Range
 	TrimmableNode
 	X Expr // The expression to evaluate.
 }
 
 // NewDoNode returns a DoNode.
 func NewDoNode(expr Expr, pos Pos) *DoNode {
-	return &DoNode{pos, TrimmableNode{}, expr}
+	return &DoNode{Range{Pos: pos}, TrimmableNode{}, expr}
 }
 
 // String returns a string representation of an DoNode.
@@ -363,47 +461,69 @@ func (t *DoNode) All() []Node {
 	return []Node{t.X}
 }
 
-// FilterNode represents a block of filtered data.
+// FilterNode represents a block of filtered data, created by an apply or
+// filter tag.
 type FilterNode struct {
-	Pos
+	Range
 	TrimmableNode
-	Filters []string // Filters to apply to Body.
-	Body    Node     // Body of the filter tag.
+	Filters []*FilterExpr // Filters to apply to Body, in order. Args do not include the filtered value.
+	Body    Node          // Body of the filter tag.
 }
 
 // NewFilterNode creates a FilterNode.
-func NewFilterNode(filters []string, body Node, p Pos) *FilterNode {
-	return &FilterNode{p, TrimmableNode{}, filters, body}
+func NewFilterNode(filters []*FilterExpr, body Node, p Pos) *FilterNode {
+	return &FilterNode{Range{Pos: p}, TrimmableNode{}, filters, body}
 }
 
 // String returns a string representation of a FilterNode.
 func (t *FilterNode) String() string {
-	return fmt.Sprintf("Filter (%s): %s", strings.Join(t.Filters, "|"), t.Body)
+	names := make([]string, len(t.Filters))
+	for i, f := range t.Filters {
+		if len(f.Args) > 0 {
+			names[i] = fmt.Sprintf("%s%v", f.Name, f.Args)
+		} else {
+			names[i] = f.Name
+		}
+	}
+	return fmt.Sprintf("Filter (%s): %s", strings.Join(names, "|"), t.Body)
 }
 
 // All returns all the child Nodes in a FilterNode.
 func (t *FilterNode) All() []Node {
-	return []Node{t.Body}
+	all := make([]Node, 0, len(t.Filters)+1)
+	for _, f := range t.Filters {
+		all = append(all, f)
+	}
+	return append(all, t.Body)
 }
 
 // MacroNode represents a reusable macro.
 type MacroNode struct {
-	Pos
+	Range
 	TrimmableNode
-	Name   string    // Name of the macro.
-	Args   []string  // Args the macro receives.
-	Body   *BodyNode // Body of the macro.
-	Origin string    // The name where this macro is originally defined.
+	Name     string          // Name of the macro.
+	Args     []string        // Args the macro receives.
+	Defaults map[string]Expr // Default values for args, if any.
+	Body     *BodyNode       // Body of the macro.
+	Origin   string          // The name where this macro is originally defined.
 }
 
 // NewMacroNode returns a MacroNode.
 func NewMacroNode(name string, args []string, body *BodyNode, p Pos) *MacroNode {
-	return &MacroNode{p, TrimmableNode{}, name, args, body, ""}
+	return &MacroNode{Range{Pos: p}, TrimmableNode{}, name, args, make(map[string]Expr), body, ""}
 }
 
 // String returns a string representation of a MacroNode.
 func (t *MacroNode) String() string {
-	return fmt.Sprintf("Macro %s(%s): %s", t.Name, strings.Join(t.Args, ", "), t.Body)
+	args := make([]string, len(t.Args))
+	for i, arg := range t.Args {
+		if def, ok := t.Defaults[arg]; ok {
+			args[i] = fmt.Sprintf("%s = %s", arg, def)
+		} else {
+			args[i] = arg
+		}
+	}
+	return fmt.Sprintf("Macro %s(%s): %s", t.Name, strings.Join(args, ", "), t.Body)
 }
 
 // All returns all the child Nodes in a MacroNode.
@@ -411,9 +531,89 @@ func (t *MacroNode) All() []Node {
 	return []Node{t.Body}
 }
 
+// CallNode represents a macro call that passes its body to the macro. The
+// body is available to the macro as the special caller function.
+//
+//	{% call card.panel('Title') %}Body{% endcall %}
+type CallNode struct {
+	Range
+	TrimmableNode
+	X      Expr       // The macro call.
+	Caller *MacroNode // The body passed to the macro.
+}
+
+// NewCallNode returns a CallNode.
+func NewCallNode(expr Expr, caller *MacroNode, p Pos) *CallNode {
+	return &CallNode{Range{Pos: p}, TrimmableNode{}, expr, caller}
+}
+
+// String returns a string representation of a CallNode.
+func (t *CallNode) String() string {
+	return fmt.Sprintf("Call(%s with %s)", t.X, t.Caller)
+}
+
+// All returns all the child Nodes in a CallNode.
+func (t *CallNode) All() []Node {
+	return []Node{t.X, t.Caller}
+}
+
+// WithNode represents a block with its own scope.
+//
+//	{% with { foo: 42 } only %}{{ foo }}{% endwith %}
+type WithNode struct {
+	Range
+	TrimmableNode
+	With Expr // Variables to define in the inner scope, or nil.
+	Only bool // If true, only vars defined in With are available.
+	Body Node // Body of the with tag.
+}
+
+// NewWithNode returns a WithNode.
+func NewWithNode(with Expr, only bool, body Node, p Pos) *WithNode {
+	return &WithNode{Range{Pos: p}, TrimmableNode{}, with, only, body}
+}
+
+// String returns a string representation of a WithNode.
+func (t *WithNode) String() string {
+	return fmt.Sprintf("With(%v %v: %s)", t.With, t.Only, t.Body)
+}
+
+// All returns all the child Nodes in a WithNode.
+func (t *WithNode) All() []Node {
+	if t.With == nil {
+		return []Node{t.Body}
+	}
+	return []Node{t.With, t.Body}
+}
+
+// AutoEscapeNode represents a block with a specific escaping strategy.
+//
+//	{% autoescape 'js' %}{{ foo }}{% endautoescape %}
+type AutoEscapeNode struct {
+	Range
+	TrimmableNode
+	Strategy string // The escaping strategy, or an empty string if disabled.
+	Body     Node   // Body of the autoescape tag.
+}
+
+// NewAutoEscapeNode returns an AutoEscapeNode.
+func NewAutoEscapeNode(strategy string, body Node, p Pos) *AutoEscapeNode {
+	return &AutoEscapeNode{Range{Pos: p}, TrimmableNode{}, strategy, body}
+}
+
+// String returns a string representation of an AutoEscapeNode.
+func (t *AutoEscapeNode) String() string {
+	return fmt.Sprintf("AutoEscape(%s: %s)", t.Strategy, t.Body)
+}
+
+// All returns all the child Nodes in an AutoEscapeNode.
+func (t *AutoEscapeNode) All() []Node {
+	return []Node{t.Body}
+}
+
 // ImportNode represents importing macros from another template.
 type ImportNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Tpl   Expr   // Evaluates to the name of the template to include.
 	Alias string // Name of the var to be used as the base for any macros.
@@ -421,7 +621,7 @@ type ImportNode struct {
 
 // NewImportNode returns a ImportNode.
 func NewImportNode(tpl Expr, alias string, p Pos) *ImportNode {
-	return &ImportNode{p, TrimmableNode{}, tpl, alias}
+	return &ImportNode{Range{Pos: p}, TrimmableNode{}, tpl, alias}
 }
 
 // String returns a string representation of a ImportNode.
@@ -436,7 +636,7 @@ func (t *ImportNode) All() []Node {
 
 // FromNode represents an alternative form of importing macros.
 type FromNode struct {
-	Pos
+	Range
 	TrimmableNode
 	Tpl     Expr              // Evaluates to the name of the template to include.
 	Imports map[string]string // Imports to fetch from the included template.
@@ -444,7 +644,7 @@ type FromNode struct {
 
 // NewFromNode returns a FromNode.
 func NewFromNode(tpl Expr, imports map[string]string, p Pos) *FromNode {
-	return &FromNode{p, TrimmableNode{}, tpl, imports}
+	return &FromNode{Range{Pos: p}, TrimmableNode{}, tpl, imports}
 }
 
 // String returns a string representation of a FromNode.
@@ -471,3 +671,65 @@ func (t *FromNode) String() string {
 func (t *FromNode) All() []Node {
 	return []Node{t.Tpl}
 }
+
+// BreakNode stops the execution of the enclosing for loop.
+//
+//	{% break %}
+//	{% break if <expr> %}
+type BreakNode struct {
+	Range
+	TrimmableNode
+	Cond Expr // Optional condition; the loop is only stopped if Cond is true.
+}
+
+// NewBreakNode returns a BreakNode.
+func NewBreakNode(cond Expr, p Pos) *BreakNode {
+	return &BreakNode{Range{Pos: p}, TrimmableNode{}, cond}
+}
+
+// String returns a string representation of a BreakNode.
+func (t *BreakNode) String() string {
+	if t.Cond == nil {
+		return "Break"
+	}
+	return fmt.Sprintf("Break(if %s)", t.Cond)
+}
+
+// All returns all the child Nodes in a BreakNode.
+func (t *BreakNode) All() []Node {
+	if t.Cond == nil {
+		return []Node{}
+	}
+	return []Node{t.Cond}
+}
+
+// ContinueNode skips to the next iteration of the enclosing for loop.
+//
+//	{% continue %}
+//	{% continue if <expr> %}
+type ContinueNode struct {
+	Range
+	TrimmableNode
+	Cond Expr // Optional condition; the iteration is only skipped if Cond is true.
+}
+
+// NewContinueNode returns a ContinueNode.
+func NewContinueNode(cond Expr, p Pos) *ContinueNode {
+	return &ContinueNode{Range{Pos: p}, TrimmableNode{}, cond}
+}
+
+// String returns a string representation of a ContinueNode.
+func (t *ContinueNode) String() string {
+	if t.Cond == nil {
+		return "Continue"
+	}
+	return fmt.Sprintf("Continue(if %s)", t.Cond)
+}
+
+// All returns all the child Nodes in a ContinueNode.
+func (t *ContinueNode) All() []Node {
+	if t.Cond == nil {
+		return []Node{}
+	}
+	return []Node{t.Cond}
+}
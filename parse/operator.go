@@ -2,36 +2,76 @@ package parse
 
 import (
 	"regexp"
+	"sort"
 	"strings"
 )
 
 func init() {
-	var ops = make([]string, 0)
+	operatorMatcher = newOperatorMatcher()
+}
+
+// operatorMatcher matches the built-in operators.
+var operatorMatcher *regexp.Regexp
+
+// newOperatorMatcher returns a regexp matching the built-in operators and
+// any additional operators given.
+func newOperatorMatcher(extra ...string) *regexp.Regexp {
+	seen := make(map[string]bool)
+	ops := make([]string, 0)
+	add := func(op string) {
+		if !seen[op] {
+			seen[op] = true
+			ops = append(ops, op)
+		}
+	}
 	for op := range binaryOperators {
-		// Because there is overlap between operators (like "*" and "**") we have to
-		// ensure that some ordering is forced.
-		if op != "**" && op != "is not" && op != "//" && op != "not in" && op != ">=" && op != "<=" {
-			ops = append(ops, regexp.QuoteMeta(op))
+		add(op)
+	}
+	for op := range unaryOperators {
+		add(op)
+	}
+	for _, op := range extra {
+		add(op)
+	}
+	// Because there is overlap between operators (like "*" and "**") the
+	// longest operators must be tried first.
+	sort.Slice(ops, func(i, j int) bool {
+		if len(ops[i]) != len(ops[j]) {
+			return len(ops[i]) > len(ops[j])
 		}
+		return ops[i] < ops[j]
+	})
+	for i, op := range ops {
+		ops[i] = regexp.QuoteMeta(op)
 	}
-	// Additionally, we add the unary "not" operator since it has no binary counterpart.
-	operatorMatcher = regexp.MustCompile(`^(not in|not|\*\*|is not|//|>=|<=|` + strings.Join(ops, "|") + ")")
+	return regexp.MustCompile(`^(` + strings.Join(ops, "|") + ")")
 }
 
-var operatorMatcher *regexp.Regexp
-
-type associativity int
+// Associativity defines the order in which operators of the same precedence
+// are evaluated.
+type Associativity int
 
+// Supported associativity of operators.
 const (
-	opLeftAssoc associativity = iota
-	opRightAssoc
-	opNonAssoc
+	LeftAssoc Associativity = iota
+	RightAssoc
+	NonAssoc
 )
 
+// An Operator defines the precedence and associativity of a user-defined
+// operator. Operators with a higher precedence bind more tightly.
+//
+// For reference, "or" has a precedence of 10, "==" has 20, "+" has 30,
+// "*" has 60 and unary "-" has 500.
+type Operator struct {
+	Precedence int
+	Assoc      Associativity // Ignored for unary operators.
+}
+
 type operator struct {
 	op         string
 	precedence int
-	assoc      associativity
+	assoc      Associativity
 	unary      bool
 }
 
@@ -52,6 +92,7 @@ const (
 	OpBinaryLessEqual    = "<="
 	OpBinaryGreaterThan  = ">"
 	OpBinaryGreaterEqual = ">="
+	OpBinarySpaceship    = "<=>"
 	OpBinaryNotIn        = "not in"
 	OpBinaryIn           = "in"
 	OpBinaryMatches      = "matches"
@@ -75,7 +116,7 @@ func (o operator) Operator() string {
 }
 
 func (o operator) leftAssoc() bool {
-	return o.assoc == opLeftAssoc
+	return o.assoc == LeftAssoc
 }
 
 func (o operator) String() string {
@@ -83,37 +124,77 @@ func (o operator) String() string {
 }
 
 var unaryOperators = map[string]operator{
-	OpUnaryNot:      {OpUnaryNot, 50, opNonAssoc, true},
-	OpUnaryPositive: {OpUnaryPositive, 500, opNonAssoc, true},
-	OpUnaryNegative: {OpUnaryNegative, 500, opNonAssoc, true},
+	OpUnaryNot:      {OpUnaryNot, 50, NonAssoc, true},
+	OpUnaryPositive: {OpUnaryPositive, 500, NonAssoc, true},
+	OpUnaryNegative: {OpUnaryNegative, 500, NonAssoc, true},
 }
 
 var binaryOperators = map[string]operator{
-	OpBinaryOr:           {OpBinaryOr, 10, opLeftAssoc, false},
-	OpBinaryAnd:          {OpBinaryAnd, 15, opLeftAssoc, false},
-	OpBinaryBitwiseOr:    {OpBinaryBitwiseOr, 16, opLeftAssoc, false},
-	OpBinaryBitwiseXor:   {OpBinaryBitwiseXor, 17, opLeftAssoc, false},
-	OpBinaryBitwiseAnd:   {OpBinaryBitwiseAnd, 18, opLeftAssoc, false},
-	OpBinaryEqual:        {OpBinaryEqual, 20, opLeftAssoc, false},
-	OpBinaryNotEqual:     {OpBinaryNotEqual, 20, opLeftAssoc, false},
-	OpBinaryLessThan:     {OpBinaryLessThan, 20, opLeftAssoc, false},
-	OpBinaryLessEqual:    {OpBinaryLessEqual, 20, opLeftAssoc, false},
-	OpBinaryGreaterThan:  {OpBinaryGreaterThan, 20, opLeftAssoc, false},
-	OpBinaryGreaterEqual: {OpBinaryGreaterEqual, 20, opLeftAssoc, false},
-	OpBinaryNotIn:        {OpBinaryNotIn, 20, opLeftAssoc, false},
-	OpBinaryIn:           {OpBinaryIn, 20, opLeftAssoc, false},
-	OpBinaryMatches:      {OpBinaryMatches, 20, opLeftAssoc, false},
-	OpBinaryStartsWith:   {OpBinaryStartsWith, 20, opLeftAssoc, false},
-	OpBinaryEndsWith:     {OpBinaryEndsWith, 20, opLeftAssoc, false},
-	OpBinaryRange:        {OpBinaryRange, 20, opLeftAssoc, false},
-	OpBinaryAdd:          {OpBinaryAdd, 30, opLeftAssoc, false},
-	OpBinarySubtract:     {OpBinarySubtract, 30, opLeftAssoc, false},
-	OpBinaryConcat:       {OpBinaryConcat, 40, opLeftAssoc, false},
-	OpBinaryMultiply:     {OpBinaryMultiply, 60, opLeftAssoc, false},
-	OpBinaryDivide:       {OpBinaryDivide, 60, opLeftAssoc, false},
-	OpBinaryFloorDiv:     {OpBinaryFloorDiv, 60, opLeftAssoc, false},
-	OpBinaryModulo:       {OpBinaryModulo, 60, opLeftAssoc, false},
-	OpBinaryIs:           {OpBinaryIs, 100, opLeftAssoc, false},
-	OpBinaryIsNot:        {OpBinaryIsNot, 100, opLeftAssoc, false},
-	OpBinaryPower:        {OpBinaryPower, 200, opRightAssoc, false},
+	OpBinaryOr:           {OpBinaryOr, 10, LeftAssoc, false},
+	OpBinaryAnd:          {OpBinaryAnd, 15, LeftAssoc, false},
+	OpBinaryBitwiseOr:    {OpBinaryBitwiseOr, 16, LeftAssoc, false},
+	OpBinaryBitwiseXor:   {OpBinaryBitwiseXor, 17, LeftAssoc, false},
+	OpBinaryBitwiseAnd:   {OpBinaryBitwiseAnd, 18, LeftAssoc, false},
+	OpBinaryEqual:        {OpBinaryEqual, 20, LeftAssoc, false},
+	OpBinaryNotEqual:     {OpBinaryNotEqual, 20, LeftAssoc, false},
+	OpBinaryLessThan:     {OpBinaryLessThan, 20, LeftAssoc, false},
+	OpBinaryLessEqual:    {OpBinaryLessEqual, 20, LeftAssoc, false},
+	OpBinaryGreaterThan:  {OpBinaryGreaterThan, 20, LeftAssoc, false},
+	OpBinaryGreaterEqual: {OpBinaryGreaterEqual, 20, LeftAssoc, false},
+	OpBinarySpaceship:    {OpBinarySpaceship, 20, LeftAssoc, false},
+	OpBinaryNotIn:        {OpBinaryNotIn, 20, LeftAssoc, false},
+	OpBinaryIn:           {OpBinaryIn, 20, LeftAssoc, false},
+	OpBinaryMatches:      {OpBinaryMatches, 20, LeftAssoc, false},
+	OpBinaryStartsWith:   {OpBinaryStartsWith, 20, LeftAssoc, false},
+	OpBinaryEndsWith:     {OpBinaryEndsWith, 20, LeftAssoc, false},
+	OpBinaryRange:        {OpBinaryRange, 20, LeftAssoc, false},
+	OpBinaryAdd:          {OpBinaryAdd, 30, LeftAssoc, false},
+	OpBinarySubtract:     {OpBinarySubtract, 30, LeftAssoc, false},
+	OpBinaryConcat:       {OpBinaryConcat, 40, LeftAssoc, false},
+	OpBinaryMultiply:     {OpBinaryMultiply, 60, LeftAssoc, false},
+	OpBinaryDivide:       {OpBinaryDivide, 60, LeftAssoc, false},
+	OpBinaryFloorDiv:     {OpBinaryFloorDiv, 60, LeftAssoc, false},
+	OpBinaryModulo:       {OpBinaryModulo, 60, LeftAssoc, false},
+	OpBinaryIs:           {OpBinaryIs, 100, LeftAssoc, false},
+	OpBinaryIsNot:        {OpBinaryIsNot, 100, LeftAssoc, false},
+	OpBinaryPower:        {OpBinaryPower, 200, RightAssoc, false},
+}
+
+// binaryOperator returns the named binary operator. Built-in operators take
+// precedence over user-defined operators.
+func (t *Tree) binaryOperator(name string) (operator, bool) {
+	if op, ok := binaryOperators[name]; ok {
+		return op, true
+	}
+	if op, ok := t.BinaryOperators[name]; ok {
+		return operator{name, op.Precedence, op.Assoc, false}, true
+	}
+	return operator{}, false
+}
+
+// unaryOperator returns the named unary operator. Built-in operators take
+// precedence over user-defined operators.
+func (t *Tree) unaryOperator(name string) (operator, bool) {
+	if op, ok := unaryOperators[name]; ok {
+		return op, true
+	}
+	if op, ok := t.UnaryOperators[name]; ok {
+		return operator{name, op.Precedence, NonAssoc, true}, true
+	}
+	return operator{}, false
+}
+
+// operatorMatcher returns a regexp matching the operators available to the tree.
+func (t *Tree) operatorMatcher() *regexp.Regexp {
+	if len(t.BinaryOperators) == 0 && len(t.UnaryOperators) == 0 {
+		return operatorMatcher
+	}
+	extra := make([]string, 0, len(t.BinaryOperators)+len(t.UnaryOperators))
+	for op := range t.BinaryOperators {
+		extra = append(extra, op)
+	}
+	for op := range t.UnaryOperators {
+		extra = append(extra, op)
+	}
+	return newOperatorMatcher(extra...)
 }
@@ -20,3 +20,19 @@ func TestOperator(t *testing.T) {
 		}
 	}
 }
+
+func TestCustomOperatorMatcher(t *testing.T) {
+	m := newOperatorMatcher("contains", "=~", "***")
+	for test, expected := range map[string]string{
+		"contains 'a'": "contains",
+		"=~ 'a'":       "=~",
+		"*** 2":        "***",
+		"** 2":         "**",
+		"* 2":          "*",
+		"not in a":     "not in",
+	} {
+		if o := m.FindString(test); o != expected {
+			t.Errorf("got \"%+v\" expected \"%v\"", o, expected)
+		}
+	}
+}
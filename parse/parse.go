@@ -4,7 +4,9 @@ package parse // import "github.com/tyler-sommer/stick/parse"
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"strings"
 )
 
 // A NodeVisitor can be used to modify node contents and structure.
@@ -13,6 +15,27 @@ type NodeVisitor interface {
 	Leave(Node) // Exit is called before leaving the given Node.
 }
 
+// A NodeTransformer is like a NodeVisitor, but can also replace or remove
+// the nodes it visits.
+type NodeTransformer interface {
+	Enter(Node) // Enter is called before the node is traversed.
+
+	// Leave is called before leaving the given Node. It returns the Node to
+	// replace it with, the same Node to keep it, or nil to remove it. Only
+	// Nodes held in a list, such as the children of a BodyNode, can be
+	// removed.
+	Leave(Node) Node
+}
+
+// A PrioritizedVisitor is a NodeVisitor or NodeTransformer with a priority.
+//
+// Visitors and transformers are run one after the other, each traversing the
+// entire tree, in order of priority with the lowest first. Those that do not
+// implement PrioritizedVisitor have a priority of 0.
+type PrioritizedVisitor interface {
+	Priority() int
+}
+
 // Tree represents the state of a parser.
 type Tree struct {
 	lex *lexer
@@ -21,12 +44,29 @@ type Tree struct {
 	blocks []map[string]*BlockNode // Contains each block available to this template.
 	macros map[string]*MacroNode   // All macros defined on this template.
 
+	loops int // Number of for loops enclosing the current position.
+
+	errs   ParsingErrors // Errors encountered so far in recovery mode.
+	failed []string      // Names of tags that failed to parse in recovery mode.
+
 	unread []token // Any tokens received by the lexer but not yet read.
 	read   []token // Tokens that have already been read.
 
 	Name string // A name identifying this tree; the template name.
 
-	Visitors []NodeVisitor
+	Visitors     []NodeVisitor
+	Transformers []NodeTransformer
+	Tags         map[string]TagParser // User-defined tags. Built-in tags cannot be overridden.
+	Delimiters   Delimiters           // Delimiters used to recognize template syntax.
+
+	// Recover enables the recovering parse mode. When true, Parse continues
+	// after a syntax error at the next tag, print or comment boundary, and
+	// returns every error encountered as ParsingErrors. The tree contains
+	// all nodes that parsed successfully.
+	Recover bool
+
+	BinaryOperators map[string]Operator // User-defined binary operators. Built-in operators cannot be overridden.
+	UnaryOperators  map[string]Operator // User-defined unary operators. Built-in operators cannot be overridden.
 }
 
 // NewTree creates a new parser Tree, ready for use.
@@ -46,8 +86,15 @@ func NewNamedTree(name string, input io.Reader) *Tree {
 		unread: make([]token, 0),
 		read:   make([]token, 0),
 
-		Name:     name,
-		Visitors: make([]NodeVisitor, 0),
+		Name:         name,
+		Visitors:     make([]NodeVisitor, 0),
+		Transformers: make([]NodeTransformer, 0),
+		Tags:         make(map[string]TagParser),
+
+		Delimiters: DefaultDelimiters(),
+
+		BinaryOperators: make(map[string]Operator),
+		UnaryOperators:  make(map[string]Operator),
 	}
 }
 
@@ -87,6 +134,84 @@ func (t *Tree) enrichError(err error) error {
 	return err
 }
 
+// errFailedEndTag is returned in recovery mode for the end tag of a tag that
+// failed to parse. It is not reported, as the opening tag already was.
+var errFailedEndTag = errors.New("parse: end tag of a tag that failed to parse")
+
+// recover records the error and skips ahead to the end of the failed tag,
+// print or comment, or to the next opening delimiter if it is not closed. It
+// returns false if the Tree is not in recovery mode, or if the error is not a
+// ParsingError and so cannot be recovered from.
+func (t *Tree) recover(err error) bool {
+	if !t.Recover {
+		return false
+	}
+	if err != errFailedEndTag {
+		perr, ok := err.(ParsingError)
+		if !ok {
+			return false
+		}
+		perr.setTree(t)
+		// An error may be reported again as it propagates from a nested body.
+		if l := len(t.errs); l == 0 || t.errs[l-1].Error() != perr.Error() {
+			t.errs = append(t.errs, perr)
+		}
+	}
+	if !t.inStatement() {
+		return true
+	}
+	for {
+		switch t.peek().tokenType {
+		case tokenTagClose, tokenPrintClose, tokenCommentClose:
+			t.next()
+			return true
+		case tokenTagOpen, tokenPrintOpen, tokenCommentOpen, tokenEOF:
+			return true
+		}
+		t.next()
+	}
+}
+
+// inStatement returns true if the last delimiter that was read opened a tag,
+// print or comment. Text tokens are not considered, as string literals are
+// also lexed as text.
+func (t *Tree) inStatement() bool {
+	for i := len(t.read) - 1; i >= 0; i-- {
+		switch t.read[i].tokenType {
+		case tokenTagOpen, tokenPrintOpen, tokenCommentOpen:
+			return true
+		case tokenTagClose, tokenPrintClose, tokenCommentClose:
+			return false
+		}
+	}
+	return false
+}
+
+// endsFailedTag returns true if name is the end tag of a tag that failed to
+// parse in recovery mode. The failed tag is then forgotten, so that each
+// failed tag ends at most one end tag.
+func (t *Tree) endsFailedTag(name string) bool {
+	if !t.Recover || !strings.HasPrefix(name, "end") {
+		return false
+	}
+	for i := len(t.failed) - 1; i >= 0; i-- {
+		if "end"+t.failed[i] == name {
+			t.failed = append(t.failed[:i], t.failed[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// source returns the source code of the given Node.
+func (t *Tree) source(n Node) string {
+	start, end := n.Start().Byte, n.End().Byte
+	if start < 0 || end < start || end > len(t.lex.input) {
+		return n.String()
+	}
+	return t.lex.input[start:end]
+}
+
 // peek returns the next unread token without advancing the internal cursor.
 func (t *Tree) peek() token {
 	tok := t.next()
@@ -139,6 +264,89 @@ func (t *Tree) next() token {
 	return tok
 }
 
+// last returns the last non-whitespace token that was read.
+func (t *Tree) last() token {
+	for i := len(t.read) - 1; i >= 0; i-- {
+		if t.read[i].tokenType != tokenWhitespace {
+			return t.read[i]
+		}
+	}
+	return token{}
+}
+
+// end returns the position immediately following the last non-whitespace
+// token that was read.
+func (t *Tree) end() Pos {
+	tok := t.last()
+	if tok.Line == 0 {
+		return Pos{Line: 1}
+	}
+	return tok.Pos.advance(tok.value)
+}
+
+// setRange sets the range of the given Node from start to the end of the
+// last token read.
+func (t *Tree) setRange(n Node, start Pos) {
+	if r, ok := n.(interface{ setRange(start, end Pos) }); ok {
+		r.setRange(start, t.end())
+	}
+}
+
+// setEnd sets the end of the given Node to the end of the last token read.
+func (t *Tree) setEnd(n Node) {
+	if n != nil {
+		t.setRange(n, n.Start())
+	}
+}
+
+// setTrim sets whether whitespace around the given Node should be removed,
+// based on the whitespace control markers in its opening and closing
+// delimiters.
+func (t *Tree) setTrim(n Node, open, close token) {
+	if r, ok := n.(interface{ setTrim(before, after bool) }); ok {
+		r.setTrim(t.trims(open), t.trims(close))
+	}
+}
+
+// trims returns true if the given delimiter has a whitespace control marker.
+func (t *Tree) trims(tok token) bool {
+	d := t.lex.delims
+	switch tok.tokenType {
+	case tokenTagOpen:
+		return len(tok.value) > len(d.TagOpen)
+	case tokenPrintOpen:
+		return len(tok.value) > len(d.PrintOpen)
+	case tokenCommentOpen:
+		return len(tok.value) > len(d.CommentOpen)
+	case tokenTagClose:
+		return len(tok.value) > len(d.TagClose)
+	case tokenPrintClose:
+		return len(tok.value) > len(d.PrintClose)
+	case tokenCommentClose:
+		return len(tok.value) > len(d.CommentClose)
+	}
+	return false
+}
+
+// fillEnds sets the end of the given Node and its children, if they are
+// missing one, to the end of their last child. Nodes without children end
+// where they start.
+func fillEnds(n Node) Pos {
+	end := n.Start()
+	for _, c := range children(n) {
+		if e := fillEnds(c); e.Byte > end.Byte {
+			end = e
+		}
+	}
+	if n.End().Line > 0 {
+		return n.End()
+	}
+	if r, ok := n.(interface{ setRange(start, end Pos) }); ok {
+		r.setRange(n.Start(), end)
+	}
+	return end
+}
+
 // nextNonSpace returns the next non-whitespace token.
 func (t *Tree) nextNonSpace() token {
 	var next token
@@ -179,31 +387,6 @@ func (t *Tree) expectValue(typ tokenType, val string) (token, error) {
 	return tok, nil
 }
 
-// Enter is called when the given Node is entered.
-func (t *Tree) enter(n Node) {
-	for _, v := range t.Visitors {
-		v.Enter(n)
-	}
-}
-
-// Leave is called just before the state exits the given Node.
-func (t *Tree) leave(n Node) {
-	for _, v := range t.Visitors {
-		v.Leave(n)
-	}
-}
-
-func (t *Tree) traverse(n Node) {
-	if n == nil {
-		return
-	}
-	t.enter(n)
-	for _, c := range n.All() {
-		t.traverse(c)
-	}
-	t.leave(n)
-}
-
 // Parse parses the given input.
 func Parse(input string) (*Tree, error) {
 	t := NewTree(bytes.NewReader([]byte(input)))
@@ -212,10 +395,17 @@ func Parse(input string) (*Tree, error) {
 
 // Parse begins parsing, returning an error, if any.
 func (t *Tree) Parse() error {
+	t.lex.operators = t.operatorMatcher()
+	t.lex.delims = t.Delimiters.withDefaults()
+	t.lex.recover = t.Recover
 	go t.lex.tokenize()
+	defer t.lex.stop()
 	for {
 		n, err := t.parse()
 		if err != nil {
+			if t.recover(err) {
+				continue
+			}
 			return t.enrichError(err)
 		}
 		if n == nil {
@@ -223,7 +413,17 @@ func (t *Tree) Parse() error {
 		}
 		t.root.Append(n)
 	}
-	t.traverse(t.root)
+	t.setEnd(t.root)
+	fillEnds(t.root)
+	if len(t.errs) > 0 {
+		t.errs.sort()
+		return t.errs
+	}
+	if err := t.visit(); err != nil {
+		return t.enrichError(err)
+	}
+	// Nodes added by transformers may not have an end.
+	fillEnds(t.root)
 	return nil
 }
 
@@ -241,25 +441,31 @@ func (t *Tree) parse() (Node, error) {
 		if err != nil {
 			return nil, err
 		}
-		_, err = t.expect(tokenPrintClose)
+		closeTok, err := t.expect(tokenPrintClose)
 		if err != nil {
 			return nil, err
 		}
-		return NewPrintNode(name, tok.Pos), nil
+		n := NewPrintNode(name, tok.Pos)
+		t.setEnd(n)
+		t.setTrim(n, tok, closeTok)
+		return n, nil
 
 	case tokenTagOpen:
 		return t.parseTag()
 
 	case tokenCommentOpen:
-		tok, err := t.expect(tokenText)
+		txt, err := t.expect(tokenText)
 		if err != nil {
 			return nil, err
 		}
-		_, err = t.expect(tokenCommentClose)
+		closeTok, err := t.expect(tokenCommentClose)
 		if err != nil {
 			return nil, err
 		}
-		return NewCommentNode(tok.value, tok.Pos), nil
+		n := NewCommentNode(txt.value, tok.Pos)
+		t.setEnd(n)
+		t.setTrim(n, tok, closeTok)
+		return n, nil
 
 	case tokenEOF:
 		// expected end of input
@@ -1,7 +1,5 @@
 package parse
 
-import "fmt"
-
 // parseExpr parses an expression.
 func (t *Tree) parseExpr() (Expr, error) {
 	expr, err := t.parseInnerExpr()
@@ -16,7 +14,12 @@ func (t *Tree) parseExpr() (Expr, error) {
 // expression.
 // An outer expression is defined as a modification to an inner expression.
 // Examples include attribute accessing, filter application, or binary operations.
-func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
+func (t *Tree) parseOuterExpr(expr Expr) (res Expr, err error) {
+	defer func() {
+		if err == nil {
+			t.setEnd(res)
+		}
+	}()
 	switch nt := t.nextNonSpace(); nt.tokenType {
 	case tokenParensOpen:
 		switch name := expr.(type) {
@@ -64,7 +67,9 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 					return nil, newUnexpectedTokenError(nt)
 				}
 			}
-			return t.parseOuterExpr(NewGetAttrExpr(expr, attr, args, nt.Pos))
+			getAttr := NewGetAttrExpr(expr, attr, args, expr.Start())
+			t.setEnd(getAttr)
+			return t.parseOuterExpr(getAttr)
 
 		case "|": // Filter application
 
@@ -81,29 +86,42 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 			case *BinaryExpr:
 				switch b := n.Left.(type) {
 				case *NameExpr:
-					v := NewFilterExpr(b.Name, []Expr{expr}, nt.Pos)
+					v := NewFilterExpr(b.Name, []Expr{expr}, expr.Start())
+					v.NamePos = b.Pos
+					v.EndPos = b.End()
 					n.Left = v
+					n.Pos = expr.Start()
 					resultExpr = n
 				case *FuncExpr:
 					b.Args = append([]Expr{expr}, b.Args...)
-					v := NewFilterExpr(b.Name, b.Args, nt.Pos)
+					v := NewFilterExpr(b.Name, b.Args, expr.Start())
+					v.NamePos = b.Pos
+					v.EndPos = b.End()
 					n.Left = v
+					n.Pos = expr.Start()
 					resultExpr = n
 				default:
 					return nil, newUnexpectedTokenError(nt)
 				}
 			case *NameExpr:
-				resultExpr = NewFilterExpr(n.Name, []Expr{expr}, nt.Pos)
+				f := NewFilterExpr(n.Name, []Expr{expr}, expr.Start())
+				f.NamePos = n.Pos
+				resultExpr = f
+				t.setEnd(resultExpr)
 
 			case *FuncExpr:
 				n.Args = append([]Expr{expr}, n.Args...)
-				resultExpr = NewFilterExpr(n.Name, n.Args, n.Pos)
+				f := NewFilterExpr(n.Name, n.Args, expr.Start())
+				f.NamePos = n.Pos
+				resultExpr = f
+				t.setEnd(resultExpr)
 
 			case *FilterExpr:
 				// Handle chained filters: when parsing "filter1|filter2",
 				// filter2 might already be parsed as a FilterExpr
 				// We need to prepend the current expr to its arguments
 				n.Args = append([]Expr{expr}, n.Args...)
+				n.Pos = expr.Start()
 				resultExpr = n
 
 			default:
@@ -134,15 +152,13 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 		}
 
 	case tokenOperator:
-		op, ok := binaryOperators[nt.value]
+		op, ok := t.binaryOperator(nt.value)
 		if !ok {
 			return nil, newUnexpectedTokenError(nt)
 		}
 
-		var right Node
-		var err error
 		if op.op == OpBinaryIs || op.op == OpBinaryIsNot {
-			right, err = t.parseRightTestOperand(nil)
+			right, err := t.parseRightTestOperand(nil)
 			if err != nil {
 				return nil, err
 			}
@@ -150,22 +166,13 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 			if v := t.peekNonSpace(); v.tokenType == tokenPunctuation && v.value == "?" {
 				return t.parseOuterExpr(NewBinaryExpr(expr, op.Operator(), right, expr.Start()))
 			}
-		} else {
-			right, err = t.parseExpr()
-			if err != nil {
-				return nil, err
-			}
-			if v, ok := right.(*BinaryExpr); ok {
-				nxop := binaryOperators[v.Op]
-				if nxop.precedence < op.precedence || (nxop.precedence == op.precedence && op.leftAssoc()) {
-					left := v.Left
-					res := NewBinaryExpr(expr, op.Operator(), left, expr.Start())
-					v.Left = res
-					return v, nil
-				}
-			}
+			return NewBinaryExpr(expr, op.Operator(), right, expr.Start()), nil
 		}
-		return NewBinaryExpr(expr, op.Operator(), right, expr.Start()), nil
+		right, err := t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return t.applyBinary(expr, op, right), nil
 
 	default:
 		t.backup()
@@ -173,6 +180,34 @@ func (t *Tree) parseOuterExpr(expr Expr) (Expr, error) {
 	}
 }
 
+// applyBinary returns a binary expression applying op to left and right.
+// Because right is parsed first, if right is a binary expression with a lower
+// precedence than op, op is applied to its left operand instead.
+func (t *Tree) applyBinary(left Expr, op operator, right Expr) Expr {
+	if v, ok := right.(*BinaryExpr); ok {
+		nxop, _ := t.binaryOperator(v.Op)
+		if nxop.precedence < op.precedence || (nxop.precedence == op.precedence && op.leftAssoc()) {
+			v.Left = NewBinaryExpr(left, op.Operator(), v.Left, left.Start())
+			return v
+		}
+	}
+	return NewBinaryExpr(left, op.Operator(), right, left.Start())
+}
+
+// applyUnary applies the user-defined unary operator to expr. If expr is a
+// binary expression with a lower precedence than the operator, the operator
+// is applied to its left operand instead.
+func (t *Tree) applyUnary(op operator, expr Expr, pos Pos) Expr {
+	if v, ok := expr.(*BinaryExpr); ok {
+		if bop, _ := t.binaryOperator(v.Op); bop.precedence < op.precedence {
+			v.Left = t.applyUnary(op, v.Left, pos)
+			v.Pos = pos
+			return v
+		}
+	}
+	return NewUnaryExpr(op.Operator(), expr, pos)
+}
+
 // parseIsRightOperand handles "is" and "is not" tests, which can
 // themselves be two words, such as "divisible by":
 //
@@ -193,28 +228,37 @@ func (t *Tree) parseRightTestOperand(prev *NameExpr) (*TestExpr, error) {
 	case *NameExpr:
 		if prev != nil {
 			r.Name = prev.Name + " " + r.Name
+			r.Pos = prev.Pos
 		}
-		return NewTestExpr(r.Name, []Expr{}, r.Pos), nil
+		test := NewTestExpr(r.Name, []Expr{}, r.Pos)
+		t.setEnd(test)
+		return test, nil
 
 	case *FuncExpr:
 		if prev != nil {
 			r.Name = prev.Name + " " + r.Name
+			r.Pos = prev.Pos
 		}
 		return &TestExpr{r}, nil
 	default:
-		return nil, fmt.Errorf(`Expected name or function, got "%v"`, right)
+		return nil, newUnexpectedExprError(t, right, "name or function")
 	}
 }
 
 // parseInnerExpr attempts to parse an inner expression.
 // An inner expression is defined as a cohesive expression, such as a literal.
-func (t *Tree) parseInnerExpr() (Expr, error) {
+func (t *Tree) parseInnerExpr() (expr Expr, err error) {
+	defer func() {
+		if err == nil {
+			t.setEnd(expr)
+		}
+	}()
 	switch tok := t.nextNonSpace(); tok.tokenType {
 	case tokenEOF:
 		return nil, newUnexpectedEOFError(tok)
 
 	case tokenOperator:
-		op, ok := unaryOperators[tok.value]
+		op, ok := t.unaryOperator(tok.value)
 		if !ok {
 			return nil, newUnexpectedTokenError(tok)
 		}
@@ -222,7 +266,11 @@ func (t *Tree) parseInnerExpr() (Expr, error) {
 		if err != nil {
 			return nil, err
 		}
-		return NewUnaryExpr(op.Operator(), expr, tok.Pos), nil
+		if _, ok := unaryOperators[tok.value]; ok {
+			// Built-in unary operators apply to the entire expression that follows.
+			return NewUnaryExpr(op.Operator(), expr, tok.Pos), nil
+		}
+		return t.applyUnary(op, expr, tok.Pos), nil
 
 	case tokenParensOpen:
 		inner, err := t.parseExpr()
@@ -255,7 +303,7 @@ func (t *Tree) parseInnerExpr() (Expr, error) {
 			if err != nil {
 				return nil, err
 			}
-			els = append(els, NewKeyValueExpr(keyExpr, valExpr, nxt.Pos))
+			els = append(els, NewKeyValueExpr(keyExpr, valExpr, keyExpr.Start()))
 			nxt = t.peek()
 			if nxt.tokenType == tokenPunctuation {
 				_, err := t.expectValue(tokenPunctuation, ",")
@@ -352,8 +400,13 @@ func (t *Tree) parseInnerExpr() (Expr, error) {
 						}
 						res = NewBinaryExpr(res, OpBinaryConcat, exprs[i], res.Pos)
 					}
+					res.Pos = tok.Pos
 					return res, nil
 				}
+				if str, ok := exprs[0].(*StringExpr); ok {
+					// The range of a string literal includes its quotes.
+					str.Pos = tok.Pos
+				}
 				return exprs[0], nil
 			}
 		}
@@ -393,7 +446,9 @@ func (t *Tree) parseFunc(name *NameExpr) (Expr, error) {
 			}
 
 		case tokenParensClose:
-			return NewFuncExpr(name.Name, args, name.Pos), nil
+			fn := NewFuncExpr(name.Name, args, name.Pos)
+			t.setEnd(fn)
+			return fn, nil
 
 		default:
 			return nil, newUnexpectedTokenError(tok, tokenPunctuation, tokenParensClose)
@@ -2,16 +2,150 @@ package parse
 
 import (
 	"bytes"
-	"errors"
+	"sort"
+	"strings"
 )
 
-// A tagParser can parse the body of a tag, returning the resulting Node or an error.
-// TODO: This will be used to implement user-defined tags.
-type tagParser func(t *Tree, start Pos) (Node, error)
+// A TagParser can parse the body of a tag, returning the resulting Node or an error.
+//
+// TagParsers are used to implement user-defined tags. When called, the name of
+// the tag has already been consumed and start is its position. The TagParser
+// must consume the rest of the tag, including the closing delimiter, and any
+// body and end tag using the Tree's exported parsing methods.
+type TagParser func(t *Tree, start Pos) (Node, error)
+
+// ParseExpr parses an expression.
+func (t *Tree) ParseExpr() (Expr, error) {
+	return t.parseExpr()
+}
+
+// A TokenKind identifies a kind of token, for use with Expect and Peek.
+type TokenKind int
+
+// Kinds of tokens that may appear within a tag.
+const (
+	TokenName        TokenKind = iota // A name, such as "for" or "x".
+	TokenNumber                       // A number, such as "42".
+	TokenString                       // A string without interpolation, such as 'abc'.
+	TokenPunctuation                  // Punctuation, such as "=", "," or ":".
+	TokenOperator                     // An operator, such as "+" or "and".
+	TokenTagClose                     // The closing delimiter of a tag.
+)
+
+// tokenTypes maps each TokenKind to the type of its first token.
+var tokenTypes = map[TokenKind]tokenType{
+	TokenName:        tokenName,
+	TokenNumber:      tokenNumber,
+	TokenString:      tokenStringOpen,
+	TokenPunctuation: tokenPunctuation,
+	TokenOperator:    tokenOperator,
+	TokenTagClose:    tokenTagClose,
+}
+
+// Expect consumes the next token, returning its value. The token must be of
+// the given kind and, if any values are given, have one of them. The value of
+// a string is its contents, without quotes.
+func (t *Tree) Expect(kind TokenKind, values ...string) (string, error) {
+	tok, err := t.expect(tokenTypes[kind])
+	if err != nil {
+		return "", err
+	}
+	if kind == TokenString {
+		tok, err = t.expectStringContents()
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(values) > 0 && !contains(values, tok.value) {
+		return "", newUnexpectedValueError(tok, strings.Join(values, `" or "`))
+	}
+	return tok.value, nil
+}
+
+// expectStringContents consumes the rest of a string whose opening quote was
+// just read, returning a token that holds its contents.
+func (t *Tree) expectStringContents() (token, error) {
+	tok, err := t.expect(tokenText, tokenStringClose)
+	if err != nil {
+		return tok, err
+	}
+	if tok.tokenType == tokenStringClose {
+		return token{"", tokenText, tok.Pos}, nil
+	}
+	_, err = t.expect(tokenStringClose)
+	return tok, err
+}
+
+// Peek returns true if the next token is of the given kind and, if any values
+// are given, has one of them. The token is not consumed.
+func (t *Tree) Peek(kind TokenKind, values ...string) bool {
+	tok := t.peekNonSpace()
+	if tok.tokenType != tokenTypes[kind] {
+		return false
+	}
+	if len(values) == 0 {
+		return true
+	}
+	if kind == TokenString {
+		t.next()
+		switch tok = t.next(); tok.tokenType {
+		case tokenText:
+		case tokenStringClose:
+			tok.value = ""
+		default:
+			t.backup2()
+			return false
+		}
+		t.backup2()
+	}
+	return contains(values, tok.value)
+}
+
+// ExpectTagClose consumes the closing delimiter of the current tag.
+func (t *Tree) ExpectTagClose() error {
+	_, err := t.Expect(TokenTagClose)
+	return err
+}
+
+// ParseUntilEndTag parses the body of the named tag, up to and including
+// the end tag. For example, given "cache", the body is parsed until the
+// end tag "{% endcache %}".
+func (t *Tree) ParseUntilEndTag(name string, start Pos) (*BodyNode, error) {
+	return t.parseUntilEndTag(name, start)
+}
+
+// ParseUntilTag parses a body until it reaches a tag with one of the given
+// names, returning the body and the name of the tag that ended it. Only the
+// name of that tag is consumed, so the caller must parse the rest of it. For
+// example, a "trans" tag may parse its body until "plural" or "endtrans".
+func (t *Tree) ParseUntilTag(start Pos, names ...string) (*BodyNode, string, error) {
+	n, err := t.parseUntilTag(start, names...)
+	if err != nil {
+		return nil, "", err
+	}
+	return n, t.last().value, nil
+}
 
 // parseTag parses the opening of a tag "{%", then delegates to a more specific parser function
 // based on the tag's name.
 func (t *Tree) parseTag() (Node, error) {
+	open := t.last()
+	name := t.peekNonSpace()
+	n, err := t.parseTagName()
+	if err != nil {
+		if t.Recover && err != errFailedEndTag && name.tokenType == tokenName {
+			// The end tag of the failed tag is not reported again.
+			t.failed = append(t.failed, name.value)
+		}
+		return nil, err
+	}
+	t.setRange(n, open.Pos)
+	t.setTrim(n, open, t.last())
+	return n, nil
+}
+
+// parseTagName parses the name of a tag and the rest of the tag.
+func (t *Tree) parseTagName() (Node, error) {
 	name, err := t.expect(tokenName)
 	if err != nil {
 		return nil, err
@@ -35,6 +169,8 @@ func (t *Tree) parseTag() (Node, error) {
 		return parseSet(t, name.Pos)
 	case "do":
 		return parseDo(t, name.Pos)
+	case "apply":
+		return parseApply(t, name.Pos)
 	case "filter":
 		return parseFilter(t, name.Pos)
 	case "macro":
@@ -43,13 +179,53 @@ func (t *Tree) parseTag() (Node, error) {
 		return parseImport(t, name.Pos)
 	case "from":
 		return parseFrom(t, name.Pos)
+	case "call":
+		return parseCall(t, name.Pos)
+	case "with":
+		return parseWith(t, name.Pos)
+	case "autoescape":
+		return parseAutoEscape(t, name.Pos)
 	case "verbatim":
 		return parseVerbatim(t, name.Pos)
+	case "break":
+		return parseBreak(t, name.Pos)
+	case "continue":
+		return parseContinue(t, name.Pos)
 	default:
-		return nil, newUnexpectedTokenError(name)
+		if p, ok := t.Tags[name.value]; ok {
+			return p(t, name.Pos)
+		}
+		if t.endsFailedTag(name.value) {
+			return nil, errFailedEndTag
+		}
+		if contains(builtinTags, name.value) {
+			// An end tag or else without its opening tag.
+			return nil, newUnexpectedTokenError(name)
+		}
+		return nil, newUnknownTagError(name, t.knownTags())
 	}
 }
 
+// builtinTags contains the names of all built-in tags, including the tags
+// that end or continue another tag.
+var builtinTags = []string{
+	"apply", "autoescape", "block", "break", "call", "continue", "do", "else",
+	"elseif", "embed", "endapply", "endautoescape", "endblock", "endcall",
+	"endembed", "endfilter", "endfor", "endif", "endmacro", "endset", "endverbatim",
+	"endwith", "extends", "filter", "for", "from", "if", "import", "include",
+	"macro", "set", "use", "verbatim", "with",
+}
+
+// knownTags returns the names of the built-in and user-defined tags, sorted.
+func (t *Tree) knownTags() []string {
+	res := append([]string{}, builtinTags...)
+	for name := range t.Tags {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
 // parseUntilEndTag parses until it reaches the specified tag's "end", returning a specific error otherwise.
 func (t *Tree) parseUntilEndTag(name string, start Pos) (*BodyNode, error) {
 	tok := t.peek()
@@ -79,7 +255,8 @@ func contains(haystack []string, needle string) bool {
 
 // parseUntilTag parses until it reaches the specified tag node, returning a parse error otherwise.
 func (t *Tree) parseUntilTag(start Pos, names ...string) (*BodyNode, error) {
-	n := NewBodyNode(start)
+	n := NewBodyNode(t.end())
+	n.TrimStart = t.trims(t.last())
 	for {
 		switch tok := t.peek(); tok.tokenType {
 		case tokenEOF:
@@ -87,16 +264,24 @@ func (t *Tree) parseUntilTag(start Pos, names ...string) (*BodyNode, error) {
 
 		case tokenTagOpen:
 			t.next()
-			tok, err := t.expect(tokenName)
+			name, err := t.expect(tokenName)
 			if err != nil {
+				if t.recover(err) {
+					continue
+				}
 				return n, err
 			}
-			if contains(names, tok.value) {
+			if contains(names, name.value) {
+				n.EndPos = tok.Pos
+				n.TrimEnd = t.trims(tok)
 				return n, nil
 			}
 			t.backup3()
 			o, err := t.parse()
 			if err != nil {
+				if t.recover(err) {
+					continue
+				}
 				return n, err
 			}
 			n.Append(o)
@@ -104,6 +289,9 @@ func (t *Tree) parseUntilTag(start Pos, names ...string) (*BodyNode, error) {
 		default:
 			o, err := t.parse()
 			if err != nil {
+				if t.recover(err) {
+					continue
+				}
 				return n, err
 			}
 			n.Append(o)
@@ -132,27 +320,70 @@ func parseExtends(t *Tree, start Pos) (Node, error) {
 }
 
 // parseBlock parses a block and any body it may contain.
-// TODO: {% endblock <name> %} support
 //
 //	{% block <name> %}
-//	{% endblock %}
+//	{% endblock [<name>] %}
+//
+// A block may also be defined using the shortcut form:
+//
+//	{% block <name> <expr> %}
 func parseBlock(t *Tree, start Pos) (Node, error) {
 	blockName, err := t.expect(tokenName)
 	if err != nil {
 		return nil, err
 	}
-	_, err = t.expect(tokenTagClose)
+	var body *BodyNode
+	if tok := t.peekNonSpace(); tok.tokenType != tokenTagClose {
+		expr, err := t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.expect(tokenTagClose)
+		if err != nil {
+			return nil, err
+		}
+		body = NewBodyNode(tok.Pos, NewPrintNode(expr, tok.Pos))
+	} else {
+		t.next()
+		body, err = parseBlockBody(t, blockName.value, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	nod := NewBlockNode(blockName.value, body, start)
+	nod.Origin = t.Name
+	t.setBlock(blockName.value, nod)
+	return nod, nil
+}
+
+// parseBlockBody parses the body of a block up to and including its
+// endblock tag. The endblock tag may repeat the name of the block.
+func parseBlockBody(t *Tree, name string, start Pos) (*BodyNode, error) {
+	// Blocks are executed independently, so loop control inside a block
+	// cannot affect a loop surrounding it.
+	loops := t.loops
+	t.loops = 0
+	defer func() {
+		t.loops = loops
+	}()
+	if tok := t.peek(); tok.tokenType == tokenEOF {
+		return nil, newUnclosedTagError("block", start)
+	}
+	body, err := t.parseUntilTag(start, "endblock")
 	if err != nil {
 		return nil, err
 	}
-	body, err := t.parseUntilEndTag("block", start)
+	if tok := t.peekNonSpace(); tok.tokenType == tokenName {
+		t.next()
+		if tok.value != name {
+			return nil, newUnexpectedValueError(tok, name)
+		}
+	}
+	_, err = t.expect(tokenTagClose)
 	if err != nil {
 		return nil, err
 	}
-	nod := NewBlockNode(blockName.value, body, start)
-	nod.Origin = t.Name
-	t.setBlock(blockName.value, nod)
-	return nod, nil
+	return body, nil
 }
 
 // parseIf parses the opening tag and conditional expression in an if-statement.
@@ -180,17 +411,26 @@ func parseIf(t *Tree, start Pos) (Node, error) {
 //	{% else %}
 //	{% endif %}
 func parseIfBody(t *Tree, start Pos) (body *BodyNode, els *BodyNode, err error) {
-	body = NewBodyNode(start)
+	body = NewBodyNode(t.end())
+	body.TrimStart = t.trims(t.last())
 	for {
 		switch tok := t.peek(); tok.tokenType {
 		case tokenEOF:
 			return nil, nil, newUnclosedTagError("if", start)
 		case tokenTagOpen:
 			t.next()
+			open := tok
 			tok, err := t.expect(tokenName)
 			if err != nil {
+				if t.recover(err) {
+					continue
+				}
 				return nil, nil, err
 			}
+			if tok.value == "else" || tok.value == "elseif" || tok.value == "endif" {
+				body.EndPos = open.Pos
+				body.TrimEnd = t.trims(open)
+			}
 			switch tok.value {
 			case "else":
 				_, err := t.expect(tokenTagClose)
@@ -207,7 +447,8 @@ func parseIfBody(t *Tree, start Pos) (body *BodyNode, els *BodyNode, err error)
 				if err != nil {
 					return nil, nil, err
 				}
-				els = NewBodyNode(tok.Pos, in)
+				els = NewBodyNode(open.Pos, in)
+				t.setEnd(els)
 			case "endif":
 				_, err := t.expect(tokenTagClose)
 				if err != nil {
@@ -218,18 +459,24 @@ func parseIfBody(t *Tree, start Pos) (body *BodyNode, els *BodyNode, err error)
 				t.backup()
 				n, err := t.parseTag()
 				if err != nil {
+					if t.recover(err) {
+						continue
+					}
 					return nil, nil, err
 				}
 				body.Nodes = append(body.Nodes, n)
 				continue
 			}
 			if els == nil {
-				els = NewBodyNode(start)
+				els = NewBodyNode(body.EndPos)
 			}
 			return body, els, nil
 		default:
 			n, err := t.parse()
 			if err != nil {
+				if t.recover(err) {
+					continue
+				}
 				return nil, nil, err
 			}
 			body.Append(n)
@@ -244,30 +491,33 @@ func parseIfBody(t *Tree, start Pos) (body *BodyNode, els *BodyNode, err error)
 //	{% for <name, [name]> in <expr> if <expr> %}
 //	{% else %}
 //	{% endfor %}
+//
+// The value may be unpacked into multiple names:
+//
+//	{% for <name>, (<name>, <name>) in <expr> %}
 func parseFor(t *Tree, start Pos) (*ForNode, error) {
 	var kn, vn string
-	nam, err := t.parseInnerExpr()
+	var target *TupleExpr
+	targets, err := t.parseAssignTargets(false)
 	if err != nil {
 		return nil, err
 	}
-	if nam, ok := nam.(*NameExpr); ok {
-		vn = nam.Name
-	} else {
-		return nil, errors.New("parse error: a parse error occured, expected name")
-	}
-	nxt := t.peekNonSpace()
-	if nxt.tokenType == tokenPunctuation && nxt.value == "," {
-		t.next()
-		kn = vn
-		nam, err = t.parseInnerExpr()
-		if err != nil {
-			return nil, err
-		}
-		if nam, ok := nam.(*NameExpr); ok {
-			vn = nam.Name
+	switch len(targets) {
+	case 1:
+	case 2:
+		if nam, ok := targets[0].(*NameExpr); ok {
+			kn = nam.Name
 		} else {
-			return nil, errors.New("parse error: a parse error occured, expected name")
+			return nil, newUnexpectedExprError(t, targets[0], "name")
 		}
+	default:
+		return nil, newUnexpectedExprError(t, targets[2], `"in"`)
+	}
+	switch nam := targets[len(targets)-1].(type) {
+	case *NameExpr:
+		vn = nam.Name
+	case *TupleExpr:
+		target = nam
 	}
 	tok := t.nextNonSpace()
 	if tok.tokenType != tokenName && tok.value != "in" {
@@ -284,7 +534,7 @@ func parseFor(t *Tree, start Pos) (*ForNode, error) {
 	var ifCond Expr
 	if tok.tokenType == tokenName {
 		if tok.value != "if" {
-			return nil, errors.New("parse error: a parse error occured")
+			return nil, newUnexpectedValueError(tok, "if")
 		}
 		ifCond, err = t.parseExpr()
 		if err != nil {
@@ -296,13 +546,12 @@ func parseFor(t *Tree, start Pos) (*ForNode, error) {
 		}
 	}
 	var body Node
+	t.loops++
 	body, err = t.parseUntilTag(tok.Pos, "endfor", "else")
+	t.loops--
 	if err != nil {
 		return nil, err
 	}
-	if ifCond != nil {
-		body = NewIfNode(ifCond, body, nil, tok.Pos)
-	}
 	t.backup()
 	tok = t.next()
 	var elseBody Node = NewBodyNode(tok.Pos)
@@ -320,21 +569,26 @@ func parseFor(t *Tree, start Pos) (*ForNode, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewForNode(kn, vn, expr, body, elseBody, start), nil
+	n := NewForNode(kn, vn, expr, body, elseBody, start)
+	n.Cond = ifCond
+	n.Target = target
+	return n, nil
 }
 
 // parseInclude parses an include statement.
 func parseInclude(t *Tree, start Pos) (Node, error) {
-	expr, with, only, err := parseIncludeOrEmbed(t)
+	expr, with, only, ignoreMissing, err := parseIncludeOrEmbed(t)
 	if err != nil {
 		return nil, err
 	}
-	return NewIncludeNode(expr, with, only, start), nil
+	n := NewIncludeNode(expr, with, only, start)
+	n.IgnoreMissing = ignoreMissing
+	return n, nil
 }
 
 // parseEmbed parses an embed statement and body.
 func parseEmbed(t *Tree, start Pos) (Node, error) {
-	expr, with, only, err := parseIncludeOrEmbed(t)
+	expr, with, only, ignoreMissing, err := parseIncludeOrEmbed(t)
 	if err != nil {
 		return nil, err
 	}
@@ -356,7 +610,8 @@ func parseEmbed(t *Tree, start Pos) (Node, error) {
 				}
 				break
 			} else if tok.value == "block" {
-				n, err := parseBlock(t, start)
+				t.backup()
+				n, err := t.parseTag()
 				if err != nil {
 					return nil, err
 				}
@@ -369,22 +624,35 @@ func parseEmbed(t *Tree, start Pos) (Node, error) {
 		}
 	}
 	blockRefs := t.popBlockStack()
-	return NewEmbedNode(expr, with, only, blockRefs, start), nil
+	n := NewEmbedNode(expr, with, only, blockRefs, start)
+	n.IgnoreMissing = ignoreMissing
+	return n, nil
 }
 
 // parseIncludeOrEmbed parses an include or embed tag's parameters.
-// TODO: Implement "ignore missing" support
 //
 //	{% include <expr> %}
 //	{% include <expr> with <expr> %}
 //	{% include <expr> with <expr> only %}
 //	{% include <expr> only %}
-func parseIncludeOrEmbed(t *Tree) (expr Expr, with Expr, only bool, err error) {
+//
+// Each form may also specify "ignore missing" after the template expression:
+//
+//	{% include <expr> ignore missing with <expr> only %}
+func parseIncludeOrEmbed(t *Tree) (expr Expr, with Expr, only bool, ignoreMissing bool, err error) {
 	expr, err = t.parseExpr()
 	if err != nil {
 		return
 	}
 	only = false
+	if tok := t.peekNonSpace(); tok.tokenType == tokenName && tok.value == "ignore" {
+		t.next()
+		_, err = t.expectValue(tokenName, "missing")
+		if err != nil {
+			return
+		}
+		ignoreMissing = true
+	}
 	switch tok := t.peekNonSpace(); tok.tokenType {
 	case tokenEOF:
 		err = newUnexpectedEOFError(tok)
@@ -397,7 +665,7 @@ func parseIncludeOrEmbed(t *Tree) (expr Expr, with Expr, only bool, err error) {
 				return
 			}
 			only = true
-			return expr, with, only, nil
+			return expr, with, only, ignoreMissing, nil
 		} else if tok.value != "with" {
 			err = newUnexpectedTokenError(tok)
 			return
@@ -484,19 +752,43 @@ func parseUse(t *Tree, start Pos) (Node, error) {
 //	{% set <var> %}
 //	some value
 //	{% endset %}
+//
+// Multiple vars may be set at once, with one value for each var, and
+// attributes may be set on existing vars:
+//
+//	{% set <var>, <var> = <expr>, <expr> %}
+//	{% set <var>.<attr> = <expr> %}
 func parseSet(t *Tree, start Pos) (Node, error) {
-	tok, err := t.expect(tokenName)
+	targets, err := t.parseAssignTargets(true)
 	if err != nil {
 		return nil, err
 	}
-	var expr Expr
+	var target Expr = targets[0]
+	if len(targets) > 1 {
+		target = NewTupleExpr(target.Start(), targets...)
+	}
+	var expr Node
 	switch tok := t.nextNonSpace(); tok.tokenType {
 	case tokenPunctuation:
-		expr, err = t.parseExpr()
+		if tok.value != "=" {
+			return nil, newUnexpectedValueError(tok, "=")
+		}
+		values, err := t.parseExprList()
 		if err != nil {
 			return nil, err
 		}
+		n := 1
+		if tuple, ok := values.(*TupleExpr); ok {
+			n = len(tuple.Elements)
+		}
+		if n != len(targets) {
+			return nil, newAssignCountError(len(targets), n, values)
+		}
+		expr = values
 	case tokenTagClose:
+		if _, ok := target.(*TupleExpr); ok {
+			return nil, newUnexpectedTokenError(tok, tokenPunctuation)
+		}
 		expr, err = t.parseUntilTag(tok.Pos, "endset")
 		if err != nil {
 			return nil, err
@@ -508,7 +800,102 @@ func parseSet(t *Tree, start Pos) (Node, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewSetNode(tok.value, expr, start), nil
+	return NewSetTargetNode(target, expr, start), nil
+}
+
+// parseAssignTargets parses a comma separated list of assignment targets.
+func (t *Tree) parseAssignTargets(attrs bool) ([]Expr, error) {
+	var targets []Expr
+	for {
+		target, err := t.parseAssignTarget(attrs)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+		nxt := t.peekNonSpace()
+		if nxt.tokenType != tokenPunctuation || nxt.value != "," {
+			return targets, nil
+		}
+		t.next()
+	}
+}
+
+// parseAssignTarget parses the target of an assignment. A target is a name,
+// or a parenthesized list of targets to unpack a value into. If attrs is
+// true, the target may also be an attribute of a name.
+//
+//	<name>
+//	(<name>, <name>)
+//	<name>.<attr>
+//	<name>[<expr>]
+func (t *Tree) parseAssignTarget(attrs bool) (Expr, error) {
+	tok := t.nextNonSpace()
+	switch tok.tokenType {
+	case tokenParensOpen:
+		targets, err := t.parseAssignTargets(attrs)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.expect(tokenParensClose)
+		if err != nil {
+			return nil, err
+		}
+		tuple := NewTupleExpr(tok.Pos, targets...)
+		t.setEnd(tuple)
+		return tuple, nil
+	case tokenName:
+		var target Expr = NewNameExpr(tok.value, tok.Pos)
+		for attrs {
+			switch nxt := t.peekNonSpace(); {
+			case nxt.tokenType == tokenPunctuation && nxt.value == ".":
+				t.next()
+				attr, err := t.expect(tokenName, tokenNumber)
+				if err != nil {
+					return nil, err
+				}
+				target = NewGetAttrExpr(target, NewStringExpr(attr.value, attr.Pos), nil, target.Start())
+				t.setEnd(target)
+			case nxt.tokenType == tokenArrayOpen:
+				t.next()
+				attr, err := t.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				_, err = t.expect(tokenArrayClose)
+				if err != nil {
+					return nil, err
+				}
+				target = NewGetAttrExpr(target, attr, nil, target.Start())
+				t.setEnd(target)
+			default:
+				return target, nil
+			}
+		}
+		return target, nil
+	}
+	return nil, newUnexpectedTokenError(tok, tokenName, tokenParensOpen)
+}
+
+// parseExprList parses a comma separated list of expressions. A TupleExpr is
+// returned if there is more than one expression.
+func (t *Tree) parseExprList() (Expr, error) {
+	var exprs []Expr
+	for {
+		expr, err := t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		nxt := t.peekNonSpace()
+		if nxt.tokenType != tokenPunctuation || nxt.value != "," {
+			break
+		}
+		t.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return NewTupleExpr(exprs[0].Start(), exprs...), nil
 }
 
 // parseDo parses a do statement.
@@ -526,37 +913,56 @@ func parseDo(t *Tree, start Pos) (Node, error) {
 	return NewDoNode(expr, start), nil
 }
 
-// parseFilter parses a filter statement.
+// parseApply parses an apply statement.
+//
+//	{% apply <name> %}
 //
-//	{% filter <name> %}
+// Multiple filters can be applied to a block, and each may receive arguments:
 //
-// Multiple filters can be applied to a block:
+//	{% apply <name>|<name>(<expr>[ , <expr>])|<name> %}
+func parseApply(t *Tree, start Pos) (Node, error) {
+	return parseFilterChain(t, "apply", start)
+}
+
+// parseFilter parses a filter statement. The filter tag is an alias for the
+// apply tag.
 //
-//	{% filter <name>|<name>|<name> %}
+//	{% filter <name>|<name>(<expr>) %}
 func parseFilter(t *Tree, start Pos) (Node, error) {
-	var filters []string
+	return parseFilterChain(t, "filter", start)
+}
+
+// parseFilterChain parses the filters and body of an apply or filter tag.
+func parseFilterChain(t *Tree, tagName string, start Pos) (Node, error) {
+	var filters []*FilterExpr
 	for {
 		tok, err := t.expect(tokenName)
 		if err != nil {
 			return nil, err
 		}
-		filters = append(filters, tok.value)
-		tok = t.peekNonSpace()
-		switch tok.tokenType {
-		case tokenEOF:
-			return nil, newUnexpectedEOFError(tok)
-		case tokenPunctuation:
-			if tok.value != "|" {
-				return nil, newUnexpectedValueError(tok, "|")
+		f := NewFilterExpr(tok.value, []Expr{}, tok.Pos)
+		if nxt := t.peek(); nxt.tokenType == tokenParensOpen {
+			t.next()
+			fn, err := t.parseFunc(NewNameExpr(tok.value, tok.Pos))
+			if err != nil {
+				return nil, err
 			}
-			t.nextNonSpace()
-		case tokenTagClose:
-			t.nextNonSpace()
-			goto body
+			f = &FilterExpr{fn.(*FuncExpr), tok.Pos}
+		}
+		t.setEnd(f)
+		filters = append(filters, f)
+		tok, err = t.expect(tokenPunctuation, tokenTagClose)
+		if err != nil {
+			return nil, err
+		}
+		if tok.tokenType == tokenTagClose {
+			break
+		}
+		if tok.value != "|" {
+			return nil, newUnexpectedValueError(tok, "|")
 		}
 	}
-body:
-	body, err := t.parseUntilEndTag("filter", start)
+	body, err := t.parseUntilEndTag(tagName, start)
 	if err != nil {
 		return nil, err
 	}
@@ -565,7 +971,7 @@ body:
 
 // parseMacro parses a macro definition.
 //
-//	{% macro <name>([ arg [ , arg]) %}
+//	{% macro <name>([ arg [ = <expr> ] [ , arg [ = <expr> ] ]) %}
 //	Macro body
 //	{% endmacro %}
 func parseMacro(t *Tree, start Pos) (Node, error) {
@@ -578,37 +984,178 @@ func parseMacro(t *Tree, start Pos) (Node, error) {
 	if err != nil {
 		return nil, err
 	}
+	args, defaults, err := parseMacroArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.expect(tokenTagClose)
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseMacroBody(t, "macro", name, start)
+	if err != nil {
+		return nil, err
+	}
+	n.Args = args
+	n.Defaults = defaults
+	t.macros[name] = n
+	return n, nil
+}
+
+// parseMacroArgs parses the arguments of a macro definition up to and
+// including the closing parenthesis.
+func parseMacroArgs(t *Tree) ([]string, map[string]Expr, error) {
 	var args []string
+	defaults := make(map[string]Expr)
 	for {
-		tok = t.nextNonSpace()
+		tok := t.nextNonSpace()
 		switch tok.tokenType {
 		case tokenEOF:
-			return nil, newUnexpectedEOFError(tok)
+			return nil, nil, newUnexpectedEOFError(tok)
 		case tokenName:
 			args = append(args, tok.value)
+			if nxt := t.peekNonSpace(); nxt.tokenType == tokenPunctuation && nxt.value == "=" {
+				t.next()
+				def, err := t.parseExpr()
+				if err != nil {
+					return nil, nil, err
+				}
+				defaults[tok.value] = def
+			}
 		case tokenPunctuation:
 			if tok.value != "," {
-				return nil, newUnexpectedValueError(tok, ",")
+				return nil, nil, newUnexpectedValueError(tok, ",")
 			}
 		case tokenParensClose:
-			_, err := t.expect(tokenTagClose)
+			return args, defaults, nil
+		default:
+			return nil, nil, newUnexpectedTokenError(tok)
+		}
+	}
+}
+
+// parseMacroBody parses the body of a macro-like tag until its end tag.
+func parseMacroBody(t *Tree, tagName, name string, start Pos) (*MacroNode, error) {
+	loops := t.loops
+	t.loops = 0
+	body, err := t.parseUntilEndTag(tagName, start)
+	t.loops = loops
+	if err != nil {
+		return nil, err
+	}
+	n := NewMacroNode(name, nil, body, start)
+	n.Origin = t.Name
+	return n, nil
+}
+
+// parseCall parses a call statement. The body of the tag is passed to the
+// called macro, where it can be rendered with the special caller function.
+//
+//	{% call <expr> %}
+//	Body
+//	{% endcall %}
+//
+// The body may also receive arguments:
+//
+//	{% call(<arg>[ , arg]) <expr> %}
+func parseCall(t *Tree, start Pos) (Node, error) {
+	var args []string
+	var defaults map[string]Expr
+	if tok := t.peekNonSpace(); tok.tokenType == tokenParensOpen {
+		t.next()
+		var err error
+		args, defaults, err = parseMacroArgs(t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	expr, err := t.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.expect(tokenTagClose)
+	if err != nil {
+		return nil, err
+	}
+	caller, err := parseMacroBody(t, "call", "caller", start)
+	if err != nil {
+		return nil, err
+	}
+	caller.Args = args
+	if defaults != nil {
+		caller.Defaults = defaults
+	}
+	return NewCallNode(expr, caller, start), nil
+}
+
+// parseWith parses a with statement.
+//
+//	{% with %}
+//	{% with <expr> %}
+//	{% with <expr> only %}
+//	Body
+//	{% endwith %}
+func parseWith(t *Tree, start Pos) (Node, error) {
+	var with Expr
+	only := false
+	if tok := t.peekNonSpace(); tok.tokenType != tokenTagClose {
+		var err error
+		with, err = t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := t.peekNonSpace(); tok.tokenType == tokenName {
+			_, err = t.expectValue(tokenName, "only")
 			if err != nil {
 				return nil, err
 			}
-			goto body
+			only = true
+		}
+	}
+	_, err := t.expect(tokenTagClose)
+	if err != nil {
+		return nil, err
+	}
+	body, err := t.parseUntilEndTag("with", start)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithNode(with, only, body, start), nil
+}
+
+// parseAutoEscape parses an autoescape tag.
+//
+//	{% autoescape [<strategy>|true|false] %}...{% endautoescape %}
+//
+// If no strategy is given, or the strategy is true, the "html" strategy is used.
+// Escaping is disabled when the strategy is false.
+func parseAutoEscape(t *Tree, start Pos) (Node, error) {
+	strategy := "html"
+	if tok := t.peekNonSpace(); tok.tokenType != tokenTagClose {
+		expr, err := t.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		switch e := expr.(type) {
+		case *StringExpr:
+			strategy = e.Text
+		case *BoolExpr:
+			if !e.Value {
+				strategy = ""
+			}
 		default:
-			return nil, newUnexpectedTokenError(tok)
+			return nil, newAutoEscapeStrategyError(tok.Pos)
 		}
 	}
-body:
-	body, err := t.parseUntilEndTag("macro", start)
+	_, err := t.expect(tokenTagClose)
 	if err != nil {
 		return nil, err
 	}
-	n := NewMacroNode(name, args, body, start)
-	n.Origin = t.Name
-	t.macros[name] = n
-	return n, nil
+	body, err := t.parseUntilEndTag("autoescape", start)
+	if err != nil {
+		return nil, err
+	}
+	return NewAutoEscapeNode(strategy, body, start), nil
 }
 
 // parseImport parses an import statement.
@@ -696,20 +1243,74 @@ func parseVerbatim(t *Tree, start Pos) (Node, error) {
 		case tokenEOF:
 			return nil, newUnexpectedEOFError(tok)
 		case tokenTagOpen:
+			raw := t.next().value
 			tok := t.next()
-			tok, err := t.expect(tokenName)
-			if err != nil {
-				return nil, err
+			for ; tok.tokenType == tokenWhitespace; tok = t.next() {
+				raw += tok.value
 			}
-			if tok.value == "end"+tagName {
+			if tok.tokenType == tokenName && tok.value == "end"+tagName {
 				if _, err := t.expect(tokenTagClose); err != nil {
 					return nil, err
 				}
-				return NewTextNode(body.String(), start), nil
+				return NewVerbatimNode(body.String(), start), nil
 			}
+			// Not the end of the verbatim tag, it is included as is.
+			body.WriteString(raw)
+			t.backup()
 		default:
 			tok := t.next()
 			body.WriteString(tok.value)
 		}
 	}
 }
+
+// parseBreak parses a break statement.
+//
+//	{% break %}
+//	{% break if <expr> %}
+func parseBreak(t *Tree, start Pos) (Node, error) {
+	cond, err := parseLoopControl(t, "break", start)
+	if err != nil {
+		return nil, err
+	}
+	return NewBreakNode(cond, start), nil
+}
+
+// parseContinue parses a continue statement.
+//
+//	{% continue %}
+//	{% continue if <expr> %}
+func parseContinue(t *Tree, start Pos) (Node, error) {
+	cond, err := parseLoopControl(t, "continue", start)
+	if err != nil {
+		return nil, err
+	}
+	return NewContinueNode(cond, start), nil
+}
+
+// parseLoopControl parses the optional condition of a break or continue
+// statement. An error is returned if the statement is not inside a for loop.
+func parseLoopControl(t *Tree, name string, start Pos) (Expr, error) {
+	if t.loops == 0 {
+		return nil, newLoopControlError(name, start)
+	}
+	tok, err := t.expect(tokenTagClose, tokenName)
+	if err != nil {
+		return nil, err
+	}
+	if tok.tokenType == tokenTagClose {
+		return nil, nil
+	}
+	if tok.value != "if" {
+		return nil, newUnexpectedValueError(tok, "if")
+	}
+	cond, err := t.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.expect(tokenTagClose)
+	if err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
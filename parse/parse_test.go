@@ -1,6 +1,9 @@
 package parse
 
 import (
+	"bytes"
+	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -15,7 +18,7 @@ type parseTest struct {
 const noError = ""
 
 // Position testing isnt implemented
-var noPos = Pos{0, 0}
+var noPos = Pos{}
 
 func newParseTest(name, input string, expected *ModuleNode) parseTest {
 	return parseTest{name, input, expected, noError}
@@ -31,6 +34,26 @@ func mkModule(nodes ...Node) *ModuleNode {
 	return l
 }
 
+func mkForCond(n *ForNode, cond Expr) *ForNode {
+	n.Cond = cond
+	return n
+}
+
+func mkForTarget(n *ForNode, target *TupleExpr) *ForNode {
+	n.Target = target
+	return n
+}
+
+func mkIgnoreMissing(n *IncludeNode) *IncludeNode {
+	n.IgnoreMissing = true
+	return n
+}
+
+func mkMacroDefaults(n *MacroNode, defaults map[string]Expr) *MacroNode {
+	n.Defaults = defaults
+	return n
+}
+
 var parseTests = []parseTest{
 	// Errors
 	newErrorTest("unclosed block", "{% block test %}", `unclosed tag "block" starting on line 1, column 3`),
@@ -39,10 +62,44 @@ var parseTests = []parseTest{
 	newErrorTest("unclosed parenthesis", "{{ func(arg1 }}", `expected one of [PUNCTUATION, PARENS_CLOSE], got "ERROR" on line 1, column 13`),
 	newErrorTest("unexpected punctuation", "{{ func(arg1? arg2) }}", `expected "PUNCTUATION", got "PARENS_CLOSE"`),
 
+	newErrorTest("break outside loop", "{% if a %}{% break %}{% endif %}", `"break" tag is only allowed inside a "for" loop on line 1, column 13`),
+	newErrorTest("continue in macro in loop", "{% for a in b %}{% macro m() %}{% continue %}{% endmacro %}{% endfor %}", `"continue" tag is only allowed inside a "for" loop`),
+	newErrorTest("endblock name mismatch", "{% block a %}{% endblock b %}", `unexpected "b", expected "a" on line 1, column 25`),
+	newErrorTest("autoescape invalid strategy", "{% autoescape foo %}{% endautoescape %}", `an escaping strategy must be a string or false on line 1, column 14`),
+	newErrorTest("break in for else", "{% for a in b %}{% else %}{% break %}{% endfor %}", `"break" tag is only allowed inside a "for" loop`),
+	newErrorTest("set capture multiple", "{% set a, b %}x{% endset %}", `expected "PUNCTUATION", got "TAG_CLOSE"`),
+	newErrorTest("set more values than variables", "{% set c = 1, 2 %}", `set requires the same number of variables and values, got 1 variables and 2 values on line 1, column 11`),
+	newErrorTest("set fewer values than variables", "{% set a, b = [1, 2] %}", `set requires the same number of variables and values, got 2 variables and 1 values on line 1, column 14`),
 	// Valid
 	newParseTest("text", "some text", mkModule(NewTextNode("some text", noPos))),
 	newParseTest("hello", "Hello {{ name }}", mkModule(NewTextNode("Hello ", noPos), NewPrintNode(NewNameExpr("name", noPos), noPos))),
 	newParseTest("string expr", "Hello {{ 'Tyler' }}", mkModule(NewTextNode("Hello ", noPos), NewPrintNode(NewStringExpr("Tyler", noPos), noPos))),
+	newParseTest(
+		"set multiple",
+		`{% set a, b = 1, 2 %}`,
+		mkModule(NewSetTargetNode(NewTupleExpr(noPos, NewNameExpr("a", noPos), NewNameExpr("b", noPos)), NewTupleExpr(noPos, NewNumberExpr("1", noPos), NewNumberExpr("2", noPos)), noPos)),
+	),
+	newParseTest(
+		"set attribute",
+		`{% set user.name = 'x' %}{% set user['age'] = 1 %}`,
+		mkModule(
+			NewSetTargetNode(NewGetAttrExpr(NewNameExpr("user", noPos), NewStringExpr("name", noPos), nil, noPos), NewStringExpr("x", noPos), noPos),
+			NewSetTargetNode(NewGetAttrExpr(NewNameExpr("user", noPos), NewStringExpr("age", noPos), nil, noPos), NewNumberExpr("1", noPos), noPos),
+		),
+	),
+	newParseTest(
+		"for with unpacking",
+		`{% for id, (name, email) in users %}{% endfor %}`,
+		mkModule(mkForTarget(NewForNode("id", "", NewNameExpr("users", noPos), NewBodyNode(noPos), NewBodyNode(noPos), noPos), NewTupleExpr(noPos, NewNameExpr("name", noPos), NewNameExpr("email", noPos)))),
+	),
+	newParseTest(
+		"for with break and continue",
+		`{% for v in vals %}{% if v %}{% set x %}{% continue %}{% endset %}{% endif %}{% break if v > 2 %}{% endfor %}`,
+		mkModule(NewForNode("", "v", NewNameExpr("vals", noPos), NewBodyNode(noPos,
+			NewIfNode(NewNameExpr("v", noPos), NewBodyNode(noPos, NewSetNode("x", NewBodyNode(noPos, NewContinueNode(nil, noPos)), noPos)), NewBodyNode(noPos), noPos),
+			NewBreakNode(NewBinaryExpr(NewNameExpr("v", noPos), OpBinaryGreaterThan, NewNumberExpr("2", noPos), noPos), noPos),
+		), NewBodyNode(noPos), noPos)),
+	),
 	newParseTest(
 		"string interpolation",
 		`{{ "Hello, #{greeting} #{name|titlecase}." }}`,
@@ -64,6 +121,16 @@ var parseTests = []parseTest{
 		"{% block something %}Body{% endblock %}",
 		mkModule(NewBlockNode("something", NewBodyNode(noPos, NewTextNode("Body", noPos)), noPos)),
 	),
+	newParseTest(
+		"block with named end",
+		"{% block something %}Body{% endblock something %}",
+		mkModule(NewBlockNode("something", NewBodyNode(noPos, NewTextNode("Body", noPos)), noPos)),
+	),
+	newParseTest(
+		"block shortcut",
+		"{% block title page.title|title %}",
+		mkModule(NewBlockNode("title", NewBodyNode(noPos, NewPrintNode(NewFilterExpr("title", []Expr{NewGetAttrExpr(NewNameExpr("page", noPos), NewStringExpr("title", noPos), []Expr{}, noPos)}, noPos), noPos)), noPos)),
+	),
 	newParseTest(
 		"if",
 		"{% if something %}Do Something{% endif %}",
@@ -186,7 +253,7 @@ var parseTests = []parseTest{
 	newParseTest(
 		"for loop",
 		"{% for k, val in something if val %}body{% else %}No results.{% endfor %}",
-		mkModule(NewForNode("k", "val", NewNameExpr("something", noPos), NewIfNode(NewNameExpr("val", noPos), NewBodyNode(noPos, NewTextNode("body", noPos)), nil, noPos), NewBodyNode(noPos, NewTextNode("No results.", noPos)), noPos)),
+		mkModule(mkForCond(NewForNode("k", "val", NewNameExpr("something", noPos), NewBodyNode(noPos, NewTextNode("body", noPos)), NewBodyNode(noPos, NewTextNode("No results.", noPos)), noPos), NewNameExpr("val", noPos))),
 	),
 	newParseTest(
 		"include",
@@ -203,6 +270,11 @@ var parseTests = []parseTest{
 		"{% include '::_subnav.html.twig' with var only %}",
 		mkModule(NewIncludeNode(NewStringExpr("::_subnav.html.twig", noPos), NewNameExpr("var", noPos), true, noPos)),
 	),
+	newParseTest(
+		"include ignore missing",
+		"{% include ['a.twig', 'b.twig'] ignore missing with var only %}",
+		mkModule(mkIgnoreMissing(NewIncludeNode(NewArrayExpr(noPos, NewStringExpr("a.twig", noPos), NewStringExpr("b.twig", noPos)), NewNameExpr("var", noPos), true, noPos))),
+	),
 	newParseTest(
 		"include only",
 		"{% include '::_subnav.html.twig' only %}",
@@ -213,6 +285,15 @@ var parseTests = []parseTest{
 		"{% embed '::_modal.html.twig' %}{% block title %}Hello{% endblock %}{% endembed  %}",
 		mkModule(NewEmbedNode(NewStringExpr("::_modal.html.twig", noPos), nil, false, map[string]*BlockNode{"title": NewBlockNode("title", NewBodyNode(noPos, NewTextNode("Hello", noPos)), noPos)}, noPos)),
 	),
+	newParseTest(
+		"embed nested blocks",
+		"{% embed 'e' %}{% block r %}{% block inner %}I{% endblock %}{% endblock %}{% endembed %}",
+		func() *ModuleNode {
+			inner := NewBlockNode("inner", NewBodyNode(noPos, NewTextNode("I", noPos)), noPos)
+			r := NewBlockNode("r", NewBodyNode(noPos, inner), noPos)
+			return mkModule(NewEmbedNode(NewStringExpr("e", noPos), nil, false, map[string]*BlockNode{"r": r, "inner": inner}, noPos))
+		}(),
+	),
 	newParseTest(
 		"null",
 		"{{ null }}{{ NONE }}{{ NULL }}{{ none }}",
@@ -276,7 +357,16 @@ var parseTests = []parseTest{
 	newParseTest(
 		"filter statement",
 		"{% filter upper|escape %}Some text{% endfilter %}",
-		mkModule(NewFilterNode([]string{"upper", "escape"}, NewBodyNode(noPos, NewTextNode("Some text", noPos)), noPos)),
+		mkModule(NewFilterNode([]*FilterExpr{NewFilterExpr("upper", []Expr{}, noPos), NewFilterExpr("escape", []Expr{}, noPos)}, NewBodyNode(noPos, NewTextNode("Some text", noPos)), noPos)),
+	),
+	newParseTest(
+		"apply statement",
+		"{% apply upper|replace({'a': 'b'})|escape('js') %}Some text{% endapply %}",
+		mkModule(NewFilterNode([]*FilterExpr{
+			NewFilterExpr("upper", []Expr{}, noPos),
+			NewFilterExpr("replace", []Expr{NewHashExpr(noPos, NewKeyValueExpr(NewStringExpr("a", noPos), NewStringExpr("b", noPos), noPos))}, noPos),
+			NewFilterExpr("escape", []Expr{NewStringExpr("js", noPos)}, noPos),
+		}, NewBodyNode(noPos, NewTextNode("Some text", noPos)), noPos)),
 	),
 	newParseTest(
 		"simple macro",
@@ -288,6 +378,37 @@ var parseTests = []parseTest{
 		"{% macro thing(var2) %}Hello{% endmacro %}",
 		mkModule(NewMacroNode("thing", []string{"var2"}, NewBodyNode(noPos, NewTextNode("Hello", noPos)), noPos)),
 	),
+	newParseTest(
+		"call",
+		`{% call(item) list(items) %}{{ item }}{% endcall %}`,
+		mkModule(NewCallNode(
+			NewFuncExpr("list", []Expr{NewNameExpr("items", noPos)}, noPos),
+			NewMacroNode("caller", []string{"item"}, NewBodyNode(noPos, NewPrintNode(NewNameExpr("item", noPos), noPos)), noPos),
+			noPos,
+		)),
+	),
+	newParseTest(
+		"with",
+		`{% with %}a{% endwith %}{% with vars only %}b{% endwith %}`,
+		mkModule(
+			NewWithNode(nil, false, NewBodyNode(noPos, NewTextNode("a", noPos)), noPos),
+			NewWithNode(NewNameExpr("vars", noPos), true, NewBodyNode(noPos, NewTextNode("b", noPos)), noPos),
+		),
+	),
+	newParseTest(
+		"autoescape",
+		`{% autoescape %}a{% endautoescape %}{% autoescape 'js' %}b{% endautoescape %}{% autoescape false %}c{% endautoescape %}`,
+		mkModule(
+			NewAutoEscapeNode("html", NewBodyNode(noPos, NewTextNode("a", noPos)), noPos),
+			NewAutoEscapeNode("js", NewBodyNode(noPos, NewTextNode("b", noPos)), noPos),
+			NewAutoEscapeNode("", NewBodyNode(noPos, NewTextNode("c", noPos)), noPos),
+		),
+	),
+	newParseTest(
+		"macro with defaults",
+		`{% macro input(name, type='text', size=20) %}{% endmacro %}`,
+		mkModule(mkMacroDefaults(NewMacroNode("input", []string{"name", "type", "size"}, NewBodyNode(noPos), noPos), map[string]Expr{"type": NewStringExpr("text", noPos), "size": NewNumberExpr("20", noPos)})),
+	),
 	newParseTest(
 		"import statement",
 		"{% import '::macros.html.twig' as mac %}",
@@ -448,3 +569,547 @@ func TestParse(t *testing.T) {
 		evaluateTest(t, test)
 	}
 }
+
+func TestUserDefinedTags(t *testing.T) {
+	// {% cache <expr> [ttl <expr>] %}...{% endcache %}
+	cache := func(t *Tree, start Pos) (Node, error) {
+		key, err := t.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		n := NewBodyNode(start, NewPrintNode(key, start))
+		if t.Peek(TokenName, "ttl") {
+			if _, err := t.Expect(TokenName, "ttl"); err != nil {
+				return nil, err
+			}
+			ttl, err := t.ParseExpr()
+			if err != nil {
+				return nil, err
+			}
+			n.Append(NewPrintNode(ttl, start))
+		}
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		body, err := t.ParseUntilEndTag("cache", start)
+		if err != nil {
+			return nil, err
+		}
+		n.Append(body)
+		return n, nil
+	}
+	// {% trans ['context'] [count = <expr>] %}...[{% plural %}...]{% endtrans %}
+	trans := func(t *Tree, start Pos) (Node, error) {
+		n := NewBodyNode(start)
+		if t.Peek(TokenString) {
+			ctx, err := t.Expect(TokenString)
+			if err != nil {
+				return nil, err
+			}
+			n.Append(NewTextNode(ctx, start))
+		}
+		if t.Peek(TokenName, "count") {
+			if _, err := t.Expect(TokenName, "count"); err != nil {
+				return nil, err
+			}
+			if _, err := t.Expect(TokenPunctuation, "="); err != nil {
+				return nil, err
+			}
+			count, err := t.ParseExpr()
+			if err != nil {
+				return nil, err
+			}
+			n.Append(NewPrintNode(count, start))
+		}
+		if err := t.ExpectTagClose(); err != nil {
+			return nil, err
+		}
+		body, name, err := t.ParseUntilTag(start, "plural", "endtrans")
+		if err != nil {
+			return nil, err
+		}
+		n.Append(body)
+		if name == "plural" {
+			if err := t.ExpectTagClose(); err != nil {
+				return nil, err
+			}
+			if body, err = t.ParseUntilEndTag("trans", start); err != nil {
+				return nil, err
+			}
+			n.Append(body)
+			return n, nil
+		}
+		return n, t.ExpectTagClose()
+	}
+	tests := []parseTest{
+		newParseTest(
+			"cache",
+			"{% cache 'a' %}A{% endcache %}{% cache 'b' ttl 60 %}{% if x %}B{% endif %}{% endcache %}",
+			mkModule(
+				NewBodyNode(noPos, NewPrintNode(NewStringExpr("a", noPos), noPos), NewBodyNode(noPos, NewTextNode("A", noPos))),
+				NewBodyNode(noPos, NewPrintNode(NewStringExpr("b", noPos), noPos), NewPrintNode(NewNumberExpr("60", noPos), noPos), NewBodyNode(noPos, NewIfNode(NewNameExpr("x", noPos), NewBodyNode(noPos, NewTextNode("B", noPos)), NewBodyNode(noPos), noPos))),
+			),
+		),
+		newErrorTest("unclosed cache", "{% cache 'a' %}A", `unexpected end of input on line 1, column 16`),
+		newErrorTest("cache invalid option", "{% cache 'a' ttl %}A{% endcache %}", `unexpected token "TAG_CLOSE" on line 1, column 17`),
+		newErrorTest("unknown tag", "{% uncache %}", `unknown tag "uncache" on line 1, column 3`),
+		newParseTest(
+			"trans",
+			"{% trans %}Hi{% endtrans %}{% trans 'menu' count = n %}One{% plural %}Many{% endtrans %}",
+			mkModule(
+				NewBodyNode(noPos, NewBodyNode(noPos, NewTextNode("Hi", noPos))),
+				NewBodyNode(noPos, NewTextNode("menu", noPos), NewPrintNode(NewNameExpr("n", noPos), noPos), NewBodyNode(noPos, NewTextNode("One", noPos)), NewBodyNode(noPos, NewTextNode("Many", noPos))),
+			),
+		),
+		newErrorTest("trans wrong punctuation", "{% trans count: n %}x{% endtrans %}", `unexpected ":", expected "=" on line 1, column 14`),
+		newErrorTest("trans interpolated context", `{% trans "a#{b}" %}x{% endtrans %}`, `expected "STRING_CLOSE", got "INTERPOLATE_OPEN" on line 1, column 11`),
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.Tags["cache"] = cache
+		tree.Tags["trans"] = trans
+		err := tree.Parse()
+		if test.err != noError {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s:\ngot error\n\t%v\nexpected error\n\t%v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !nodeEqual(tree.root, test.expected) {
+			t.Errorf("%s:\ngot\n\t%+v\nexpected\n\t%v", test.name, tree.root, test.expected)
+		}
+	}
+}
+
+func TestUserDefinedOperators(t *testing.T) {
+	tests := []parseTest{
+		newParseTest(
+			"binary operator",
+			"{{ a contains b ~ c or d }}",
+			mkModule(NewPrintNode(NewBinaryExpr(NewBinaryExpr(NewNameExpr("a", noPos), "contains", NewBinaryExpr(NewNameExpr("b", noPos), OpBinaryConcat, NewNameExpr("c", noPos), noPos), noPos), OpBinaryOr, NewNameExpr("d", noPos), noPos), noPos)),
+		),
+		newParseTest(
+			"right associative operator",
+			"{{ a => b => c }}",
+			mkModule(NewPrintNode(NewBinaryExpr(NewNameExpr("a", noPos), "=>", NewBinaryExpr(NewNameExpr("b", noPos), "=>", NewNameExpr("c", noPos), noPos), noPos), noPos)),
+		),
+		newParseTest(
+			"unary operator",
+			"{{ abs a + b }}",
+			mkModule(NewPrintNode(NewBinaryExpr(NewUnaryExpr("abs", NewNameExpr("a", noPos), noPos), OpBinaryAdd, NewNameExpr("b", noPos), noPos), noPos)),
+		),
+		newErrorTest("unknown operator", "{{ a contain b }}", `expected "PRINT_CLOSE", got "NAME" on line 1, column 5`),
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.BinaryOperators["contains"] = Operator{Precedence: 20, Assoc: LeftAssoc}
+		tree.BinaryOperators["=>"] = Operator{Precedence: 5, Assoc: RightAssoc}
+		tree.UnaryOperators["abs"] = Operator{Precedence: 500}
+		err := tree.Parse()
+		if test.err != noError {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s:\ngot error\n\t%v\nexpected error\n\t%v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !nodeEqual(tree.root, test.expected) {
+			t.Errorf("%s:\ngot\n\t%+v\nexpected\n\t%v", test.name, tree.root, test.expected)
+		}
+	}
+}
+
+// testTransformer calls leave for each Node it visits.
+type testTransformer struct {
+	priority int
+	leave    func(n Node) Node
+}
+
+func (v *testTransformer) Priority() int {
+	return v.priority
+}
+
+func (v *testTransformer) Enter(n Node) {}
+
+func (v *testTransformer) Leave(n Node) Node {
+	return v.leave(n)
+}
+
+func TestTransformers(t *testing.T) {
+	removeComments := func(n Node) Node {
+		if _, ok := n.(*CommentNode); ok {
+			return nil
+		}
+		return n
+	}
+	foldConcat := func(n Node) Node {
+		if bin, ok := n.(*BinaryExpr); ok && bin.Op == OpBinaryConcat {
+			left, lok := bin.Left.(*StringExpr)
+			right, rok := bin.Right.(*StringExpr)
+			if lok && rok {
+				return NewStringExpr(left.Text+right.Text, bin.Pos)
+			}
+		}
+		return n
+	}
+	tests := []parseTest{
+		newParseTest(
+			"remove",
+			"{# a #}{{ b }}{# c #}",
+			mkModule(NewPrintNode(NewNameExpr("b", noPos), noPos)),
+		),
+		newParseTest(
+			"replace",
+			"{{ 'a' ~ 'b' ~ 'c' }}{% if x %}{{ 'd' ~ x }}{% endif %}",
+			mkModule(
+				NewPrintNode(NewStringExpr("abc", noPos), noPos),
+				NewIfNode(NewNameExpr("x", noPos), NewBodyNode(noPos, NewPrintNode(NewBinaryExpr(NewStringExpr("d", noPos), OpBinaryConcat, NewNameExpr("x", noPos), noPos), noPos)), NewBodyNode(noPos), noPos),
+			),
+		),
+		newParseTest(
+			"replace block",
+			"{% block a %}{{ 'a' ~ 'b' }}{# c #}{% endblock %}",
+			mkModule(NewBlockNode("a", NewBodyNode(noPos, NewPrintNode(NewStringExpr("ab", noPos), noPos)), noPos)),
+		),
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.Transformers = append(tree.Transformers,
+			&testTransformer{leave: removeComments},
+			&testTransformer{leave: foldConcat},
+		)
+		if err := tree.Parse(); err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !nodeEqual(tree.root, test.expected) {
+			t.Errorf("%s:\ngot\n\t%+v\nexpected\n\t%v", test.name, tree.root, test.expected)
+		}
+	}
+
+	tree := NewTree(strings.NewReader("{% block a %}{% endblock %}"))
+	replacement := NewBlockNode("b", NewBodyNode(noPos), noPos)
+	tree.Transformers = append(tree.Transformers, &testTransformer{leave: func(n Node) Node {
+		if _, ok := n.(*BlockNode); ok {
+			return replacement
+		}
+		return n
+	}})
+	if err := tree.Parse(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	} else if _, ok := tree.Blocks()["a"]; ok || tree.Blocks()["b"] != replacement {
+		t.Errorf("expected block a to be replaced by b, got %v", tree.Blocks())
+	}
+
+	for _, replacement := range []*ExtendsNode{NewExtendsNode(NewStringExpr("b", noPos), noPos), nil} {
+		tree = NewTree(strings.NewReader("{% extends 'a' %}"))
+		tree.Transformers = append(tree.Transformers, &testTransformer{leave: func(n Node) Node {
+			if _, ok := n.(*ExtendsNode); ok {
+				if replacement == nil {
+					return nil
+				}
+				return replacement
+			}
+			return n
+		}})
+		if err := tree.Parse(); err != nil {
+			t.Errorf("unexpected error %s", err)
+		} else if tree.Root().Parent != replacement {
+			t.Errorf("expected parent to be replaced by %v, got %v", replacement, tree.Root().Parent)
+		}
+	}
+
+	tree = NewTree(strings.NewReader("{% macro m() %}{% endmacro %}"))
+	tree.Transformers = append(tree.Transformers, &testTransformer{leave: func(n Node) Node {
+		if _, ok := n.(*BodyNode); ok {
+			return NewTextNode("a", noPos)
+		}
+		return n
+	}})
+	expected := "unable to replace *parse.BodyNode in *parse.MacroNode with *parse.TextNode"
+	if err := tree.Parse(); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+
+	tree = NewTree(strings.NewReader("{% if a %}b{% endif %}"))
+	tree.Transformers = append(tree.Transformers, &testTransformer{leave: func(n Node) Node {
+		if _, ok := n.(*NameExpr); ok {
+			return nil
+		}
+		return n
+	}})
+	expected = "unable to remove *parse.NameExpr from *parse.IfNode"
+	if err := tree.Parse(); err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestVisitorPriority(t *testing.T) {
+	var order []int
+	record := func(p int) *testTransformer {
+		return &testTransformer{p, func(n Node) Node {
+			if _, ok := n.(*ModuleNode); ok {
+				order = append(order, p)
+			}
+			return n
+		}}
+	}
+	tree := NewTree(strings.NewReader("{{ a }}"))
+	tree.Transformers = append(tree.Transformers, record(10), record(-5), record(0), record(10), record(3))
+	if err := tree.Parse(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := []int{-5, 0, 3, 10, 10}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected transformers to run in order %v, got %v", expected, order)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{
+			"Hi {{ a.b|upper }}\n{% if not c and d is divisible by(3) %}{# c #}{{ f(1, {k: 'v'}) }}{% endif %}",
+			[]string{
+				"ModuleNode 1:0-2:77 Hi {{ a.b|upper }}\n{% if not c and d is divisible by(3) %}{# c #}{{ f(1, {k: 'v'}) }}{% endif %}",
+				"TextNode 1:0-1:3 Hi ",
+				"PrintNode 1:3-1:18 {{ a.b|upper }}",
+				"FilterExpr 1:6-1:15 a.b|upper",
+				"GetAttrExpr 1:6-1:9 a.b",
+				"NameExpr 1:6-1:7 a",
+				"StringExpr 1:8-1:9 b",
+				"TextNode 1:18-2:0 \n",
+				"IfNode 2:0-2:77 {% if not c and d is divisible by(3) %}{# c #}{{ f(1, {k: 'v'}) }}{% endif %}",
+				"UnaryExpr 2:6-2:36 not c and d is divisible by(3)",
+				"BinaryExpr 2:10-2:36 c and d is divisible by(3)",
+				"NameExpr 2:10-2:11 c",
+				"BinaryExpr 2:16-2:36 d is divisible by(3)",
+				"NameExpr 2:16-2:17 d",
+				"TestExpr 2:21-2:36 divisible by(3)",
+				"NumberExpr 2:34-2:35 3",
+				"BodyNode 2:39-2:66 {# c #}{{ f(1, {k: 'v'}) }}",
+				"CommentNode 2:39-2:46 {# c #}",
+				"PrintNode 2:46-2:66 {{ f(1, {k: 'v'}) }}",
+				"FuncExpr 2:49-2:63 f(1, {k: 'v'})",
+				"NumberExpr 2:51-2:52 1",
+				"HashExpr 2:54-2:62 {k: 'v'}",
+				"KeyValueExpr 2:55-2:61 k: 'v'",
+				"NameExpr 2:55-2:56 k",
+				"StringExpr 2:58-2:61 'v'",
+				"BodyNode 2:66-2:66 ",
+			},
+		},
+		{
+			"{% if a %}A{% elseif b %}B{% endif %}\n{% embed 'e' %}\n  {% block r %}R{% endblock %}\n{% endembed %}",
+			[]string{
+				"ModuleNode 1:0-4:14 {% if a %}A{% elseif b %}B{% endif %}\n{% embed 'e' %}\n  {% block r %}R{% endblock %}\n{% endembed %}",
+				"IfNode 1:0-1:37 {% if a %}A{% elseif b %}B{% endif %}",
+				"NameExpr 1:6-1:7 a",
+				"BodyNode 1:10-1:11 A",
+				"TextNode 1:10-1:11 A",
+				"BodyNode 1:11-1:37 {% elseif b %}B{% endif %}",
+				"IfNode 1:11-1:37 {% elseif b %}B{% endif %}",
+				"NameExpr 1:21-1:22 b",
+				"BodyNode 1:25-1:26 B",
+				"TextNode 1:25-1:26 B",
+				"BodyNode 1:26-1:26 ",
+				"TextNode 1:37-2:0 \n",
+				"EmbedNode 2:0-4:14 {% embed 'e' %}\n  {% block r %}R{% endblock %}\n{% endembed %}",
+				"StringExpr 2:9-2:12 'e'",
+				"BlockNode 3:2-3:30 {% block r %}R{% endblock %}",
+				"BodyNode 3:15-3:16 R",
+				"TextNode 3:15-3:16 R",
+			},
+		},
+	}
+	for _, test := range tests {
+		tree, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("unexpected error %s", err)
+			continue
+		}
+		var res []string
+		Inspect(tree.Root(), func(n Node, path []Node) bool {
+			if n != nil {
+				res = append(res, fmt.Sprintf("%s %s-%s %s", nodeName(n), n.Start(), n.End(), test.input[n.Start().Byte:n.End().Byte]))
+			}
+			return true
+		})
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("got\n\t%s\nexpected\n\t%s", strings.Join(res, "\n\t"), strings.Join(test.expected, "\n\t"))
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	input := "a{{ 1 + }}b{% if x %}c{{ ) }}d{% endif %}{% for a, b, c in d %}{% endfor %}e{{ 'x }}f{{ y }}"
+	tree := NewNamedTree("recover.twig", bytes.NewReader([]byte(input)))
+	tree.Recover = true
+	err := tree.Parse()
+	errs, ok := err.(ParsingErrors)
+	if !ok {
+		t.Fatalf("expected ParsingErrors, got %T: %v", err, err)
+	}
+	var res []string
+	for _, e := range errs {
+		res = append(res, fmt.Sprintf("%s %s", e.Start(), e))
+	}
+	expected := []string{
+		`1:8 parse: unexpected token "PRINT_CLOSE" on line 1, column 8 in recover.twig`,
+		`1:25 parse: unexpected token "PARENS_CLOSE" on line 1, column 25 in recover.twig`,
+		`1:54 parse: unexpected "c", expected "in" on line 1, column 54 in recover.twig`,
+		`1:80 parse: expected one of [TEXT, INTERPOLATE_OPEN, STRING_CLOSE], got "ERROR" on line 1, column 80 in recover.twig`,
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got\n\t%s\nexpected\n\t%s", strings.Join(res, "\n\t"), strings.Join(expected, "\n\t"))
+	}
+	if e, ok := errs[0].(*UnexpectedTokenError); !ok || e.Line != 1 || e.Offset != 8 {
+		t.Errorf("expected an UnexpectedTokenError on line 1, column 8, got %#v", errs[0])
+	}
+	if !strings.HasSuffix(err.Error(), "(and 3 more errors)") {
+		t.Errorf("unexpected error message %q", err)
+	}
+	root := mkModule(
+		NewTextNode("a", noPos),
+		NewTextNode("b", noPos),
+		NewIfNode(NewNameExpr("x", noPos), NewBodyNode(noPos, NewTextNode("c", noPos), NewTextNode("d", noPos)), NewBodyNode(noPos), noPos),
+		NewTextNode("e", noPos),
+		NewPrintNode(NewNameExpr("y", noPos), noPos),
+	)
+	if !nodeEqual(tree.Root(), root) {
+		t.Errorf("partial tree mismatch:\n\t%s\nexpected\n\t%s", tree.Root(), root)
+	}
+
+	// Recovery skips to the end of the failed tag or print, so string
+	// literals inside it do not become text.
+	tests := []struct {
+		input    string
+		errs     []string
+		expected string
+	}{
+		{`{{ a b "hello" }}X`, []string{
+			`parse: expected "PRINT_CLOSE", got "NAME" on line 1, column 5`,
+		}, "Module[Text(X)]"},
+		{`{% include 'x' foo 'bar' %}Y`, []string{
+			`parse: unexpected token "NAME" on line 1, column 15`,
+		}, "Module[Text(Y)]"},
+		{`{% extends "a" %}{% extends "b" %}Z`, []string{
+			`parse: a template may have only one "extends" statement on line 1, column 20`,
+		}, "Module[Extends(StringExpr(a)) Text(Z)]"},
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.Recover = true
+		errs, ok := tree.Parse().(ParsingErrors)
+		if !ok {
+			t.Errorf("%s: expected ParsingErrors, got %v", test.input, errs)
+			continue
+		}
+		var res []string
+		for _, e := range errs {
+			res = append(res, e.Error())
+		}
+		if !reflect.DeepEqual(res, test.errs) {
+			t.Errorf("%s: got\n\t%s\nexpected\n\t%s", test.input, strings.Join(res, "\n\t"), strings.Join(test.errs, "\n\t"))
+		}
+		if actual := tree.Root().String(); actual != test.expected {
+			t.Errorf("%s: partial tree mismatch:\n\t%s\nexpected\n\t%s", test.input, actual, test.expected)
+		}
+	}
+}
+
+func TestRecoverEndTags(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		// The end tag of a tag that failed to parse is not reported, but a
+		// stray end tag is.
+		{"{% for a, b, c in d %}{% if x %}y{% endif %}{% endfor %}{% endfor %}", []string{
+			`parse: unexpected "c", expected "in" on line 1, column 13`,
+			`parse: unexpected token "NAME" on line 1, column 59`,
+		}},
+		{"{% if x %}{% apply %}y{% endapply %}{% endif %}", []string{
+			`parse: expected "NAME", got "TAG_CLOSE" on line 1, column 19`,
+		}},
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.Recover = true
+		errs, ok := tree.Parse().(ParsingErrors)
+		if !ok {
+			t.Errorf("%s: expected ParsingErrors, got %v", test.input, errs)
+			continue
+		}
+		var res []string
+		for _, e := range errs {
+			res = append(res, e.Error())
+		}
+		if !reflect.DeepEqual(res, test.expected) {
+			t.Errorf("%s: got\n\t%s\nexpected\n\t%s", test.input, strings.Join(res, "\n\t"), strings.Join(test.expected, "\n\t"))
+		}
+	}
+}
+
+func TestRecoverEOF(t *testing.T) {
+	// Each input once caused Parse to loop forever.
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"{{ a|", `unexpected end of input on line 1, column 5`},
+		{"{{ a.", `unexpected end of input on line 1, column 5`},
+		{"{% if a|", `unexpected end of input on line 1, column 8`},
+		{"{{ 1", `expected "PRINT_CLOSE", got "EOF" on line 1, column 4`},
+	}
+	for _, test := range tests {
+		for _, rec := range []bool{false, true} {
+			tree := NewTree(strings.NewReader(test.input))
+			tree.Recover = rec
+			if err := tree.Parse(); err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("%s (recover %v): expected error %q, got %v", test.input, rec, test.expected, err)
+			}
+		}
+	}
+}
+
+func TestRecoverDisabled(t *testing.T) {
+	_, err := Parse("{{ 1 + }}{{ ) }}")
+	if _, ok := err.(ParsingErrors); ok {
+		t.Errorf("expected a single error, got %v", err)
+	}
+	if _, ok := err.(ParsingError); !ok {
+		t.Errorf("expected ParsingError, got %T: %v", err, err)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	delims := Delimiters{TagOpen: "<%", TagClose: "%>"}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"<% if a b %>", `expected end of tag "%>", got name "b"`},
+		{"{{ 'a }}", `unclosed string`},
+		{"<% for a in b if %>", `unexpected end of tag "%>"`},
+		{"<% block %>", `expected name, got end of tag "%>"`},
+		{"<% forr a in b %>", `unknown tag "forr"`},
+		{"<% if a %>", `unclosed tag "if"`},
+	}
+	for _, test := range tests {
+		tree := NewTree(strings.NewReader(test.input))
+		tree.Delimiters = delims
+		err := tree.Parse()
+		perr, ok := err.(ParsingError)
+		if !ok {
+			t.Errorf("%s: expected ParsingError, got %T: %v", test.input, err, err)
+			continue
+		}
+		if res := Describe(perr, delims); res != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.input, res, test.expected)
+		}
+	}
+}
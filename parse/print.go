@@ -0,0 +1,589 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Fprint writes the template source of the given Tree to w.
+//
+// The output is formatted canonically, using the delimiters configured in
+// the Tree. Parsing the output produces a Tree equivalent to the original.
+func Fprint(w io.Writer, t *Tree) error {
+	return FprintNode(w, t, t.Root())
+}
+
+// FprintNode writes the template source of the given Node to w, using the
+// delimiters and operators configured in the given Tree.
+func FprintNode(w io.Writer, t *Tree, n Node) error {
+	p := &printer{tree: t, delims: t.Delimiters.withDefaults()}
+	p.node(n)
+	if p.err != nil {
+		return p.err
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// printer contains the state of a Tree being printed.
+type printer struct {
+	buf    bytes.Buffer
+	tree   *Tree
+	delims Delimiters
+	err    error // The first error encountered, if any.
+}
+
+// errorf records an error. Only the first error is kept.
+func (p *printer) errorf(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("parse: "+format, args...)
+	}
+}
+
+// delim writes the given opening and closing delimiters around contents,
+// adding whitespace control markers as necessary.
+func (p *printer) delim(open, close string, trimBefore, trimAfter bool, contents string) {
+	p.buf.WriteString(open)
+	if trimBefore {
+		p.buf.WriteString(delimTrimWhitespace)
+	}
+	p.buf.WriteString(contents)
+	if trimAfter {
+		p.buf.WriteString(delimTrimWhitespace)
+	}
+	p.buf.WriteString(close)
+}
+
+// tag writes a tag with the given contents.
+func (p *printer) tag(trimBefore, trimAfter bool, format string, args ...interface{}) {
+	p.delim(p.delims.TagOpen, p.delims.TagClose, trimBefore, trimAfter, " "+fmt.Sprintf(format, args...)+" ")
+}
+
+// block writes a tag with the given contents, followed by the given body
+// and closing tag.
+func (p *printer) block(trim TrimmableNode, name string, body Node, format string, args ...interface{}) {
+	start, end := bodyTrim(body)
+	p.tag(trim.TrimBefore, start, format, args...)
+	if body != nil {
+		p.node(body)
+	}
+	p.tag(end, trim.TrimAfter, "end%s", name)
+}
+
+// bodyTrim returns whether whitespace at the start and end of the given body
+// should be removed.
+func bodyTrim(n Node) (start, end bool) {
+	if body, ok := n.(*BodyNode); ok && body != nil {
+		return body.TrimStart, body.TrimEnd
+	}
+	return false, false
+}
+
+// node writes the template source of the given Node.
+func (p *printer) node(n Node) {
+	switch node := n.(type) {
+	case *ModuleNode:
+		if node.Parent != nil && !containsNode(node.Nodes, node.Parent) {
+			p.node(node.Parent)
+		}
+		p.node(node.BodyNode)
+	case *BodyNode:
+		for _, c := range node.Nodes {
+			p.node(c)
+		}
+	case *TextNode:
+		p.text(node.Data)
+	case *CommentNode:
+		if strings.Contains(node.Data, p.delims.CommentClose) {
+			p.errorf("unable to print comment containing %q", p.delims.CommentClose)
+		}
+		p.delim(p.delims.CommentOpen, p.delims.CommentClose, node.TrimBefore, node.TrimAfter, node.Data)
+	case *VerbatimNode:
+		p.verbatim(node.TrimmableNode, node.Data)
+	case *PrintNode:
+		p.delim(p.delims.PrintOpen, p.delims.PrintClose, node.TrimBefore, node.TrimAfter, " "+p.expr(node.X)+" ")
+	case *BlockNode:
+		p.block(node.TrimmableNode, "block", node.Body, "block %s", node.Name)
+	case *IfNode:
+		p.ifNode(node, "if")
+	case *ExtendsNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "extends %s", p.expr(node.Tpl))
+	case *ForNode:
+		p.forNode(node)
+	case *EmbedNode:
+		p.tag(node.TrimBefore, false, "embed %s", p.include(node.IncludeNode))
+		// Blocks nested in another block are written as part of its body.
+		for _, blk := range topLevelBlocks(node) {
+			p.node(blk)
+		}
+		p.tag(false, node.TrimAfter, "endembed")
+	case *IncludeNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "include %s", p.include(node))
+	case *UseNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "use %s%s", p.expr(node.Tpl), aliases(" with ", node.Aliases, true))
+	case *SetNode:
+		target := node.Target
+		if target == nil {
+			target = NewNameExpr(node.Name, node.Pos)
+		}
+		if body, ok := node.X.(*BodyNode); ok {
+			p.block(node.TrimmableNode, "set", body, "set %s", p.targets(target))
+			return
+		}
+		x, ok := node.X.(Expr)
+		if !ok {
+			p.errorf("unable to print %T as the value of a set tag", node.X)
+			return
+		}
+		p.tag(node.TrimBefore, node.TrimAfter, "set %s = %s", p.targets(target), p.exprList(x))
+	case *DoNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "do %s", p.expr(node.X))
+	case *FilterNode:
+		filters := make([]string, len(node.Filters))
+		for i, f := range node.Filters {
+			filters[i] = p.call(f.Name, f.Args)
+		}
+		p.block(node.TrimmableNode, "apply", node.Body, "apply %s", strings.Join(filters, "|"))
+	case *MacroNode:
+		p.block(node.TrimmableNode, "macro", node.Body, "macro %s(%s)", node.Name, p.macroArgs(node))
+	case *CallNode:
+		args := ""
+		if node.Caller != nil && len(node.Caller.Args) > 0 {
+			args = "(" + p.macroArgs(node.Caller) + ")"
+		}
+		var body Node
+		if node.Caller != nil {
+			body = node.Caller.Body
+		}
+		p.block(node.TrimmableNode, "call", body, "call%s %s", args, p.expr(node.X))
+	case *WithNode:
+		args := ""
+		if node.With != nil {
+			args = " " + p.expr(node.With)
+		}
+		if node.Only {
+			args += " only"
+		}
+		p.block(node.TrimmableNode, "with", node.Body, "with%s", args)
+	case *AutoEscapeNode:
+		strategy := "false"
+		if node.Strategy != "" {
+			strategy = p.expr(NewStringExpr(node.Strategy, node.Pos))
+		}
+		p.block(node.TrimmableNode, "autoescape", node.Body, "autoescape %s", strategy)
+	case *ImportNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "import %s as %s", p.expr(node.Tpl), node.Alias)
+	case *FromNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "from %s import %s", p.expr(node.Tpl), aliases("", node.Imports, false))
+	case *BreakNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "break%s", p.cond(node.Cond))
+	case *ContinueNode:
+		p.tag(node.TrimBefore, node.TrimAfter, "continue%s", p.cond(node.Cond))
+	case nil:
+	default:
+		p.errorf("unable to print %T", n)
+	}
+}
+
+// text writes the given text. Text containing an opening delimiter is
+// written inside a verbatim tag.
+func (p *printer) text(data string) {
+	for _, open := range []string{p.delims.PrintOpen, p.delims.TagOpen, p.delims.CommentOpen} {
+		if strings.Contains(data, open) {
+			p.verbatim(TrimmableNode{}, data)
+			return
+		}
+	}
+	p.buf.WriteString(data)
+}
+
+// verbatim writes the given data inside a verbatim tag.
+func (p *printer) verbatim(trim TrimmableNode, data string) {
+	if strings.Contains(data, p.delims.TagOpen) {
+		// Only the end tag is a problem, but any tag could look like one.
+		for _, s := range strings.Split(data, p.delims.TagOpen)[1:] {
+			if strings.HasPrefix(strings.TrimLeft(strings.TrimPrefix(s, delimTrimWhitespace), " \t\n"), "endverbatim") {
+				p.errorf("unable to print text containing an endverbatim tag")
+				return
+			}
+		}
+	}
+	p.tag(trim.TrimBefore, false, "verbatim")
+	p.buf.WriteString(data)
+	p.tag(false, trim.TrimAfter, "endverbatim")
+}
+
+// ifNode writes an if statement. An else body that contains only another
+// if statement is written as an elseif tag, which then writes the endif tag.
+func (p *printer) ifNode(node *IfNode, name string) {
+	start, end := bodyTrim(node.Body)
+	p.tag(node.TrimBefore, start, "%s %s", name, p.expr(node.Cond))
+	p.node(node.Body)
+	if body, ok := node.Else.(*BodyNode); ok && len(body.Nodes) == 1 {
+		if elseif, ok := body.Nodes[0].(*IfNode); ok {
+			p.ifNode(elseif, "elseif")
+			return
+		}
+	}
+	if !isEmptyBody(node.Else) {
+		start, elseEnd := bodyTrim(node.Else)
+		p.tag(end, start, "else")
+		p.node(node.Else)
+		end = elseEnd
+	}
+	p.tag(end, node.TrimAfter, "endif")
+}
+
+// forNode writes a for loop.
+func (p *printer) forNode(node *ForNode) {
+	var val string
+	if node.Target != nil {
+		val = p.target(node.Target)
+	} else {
+		val = node.Val
+	}
+	if node.Key != "" {
+		val = node.Key + ", " + val
+	}
+	start, end := bodyTrim(node.Body)
+	p.tag(node.TrimBefore, start, "for %s in %s%s", val, p.expr(node.X), p.cond(node.Cond))
+	p.node(node.Body)
+	if !isEmptyBody(node.Else) {
+		start, elseEnd := bodyTrim(node.Else)
+		p.tag(end, start, "else")
+		p.node(node.Else)
+		end = elseEnd
+	}
+	p.tag(end, node.TrimAfter, "endfor")
+}
+
+// isEmptyBody returns true if n is nil or an empty BodyNode.
+func isEmptyBody(n Node) bool {
+	if isNilNode(n) {
+		return true
+	}
+	body, ok := n.(*BodyNode)
+	return ok && len(body.Nodes) == 0
+}
+
+// include returns the parameters of an include or embed tag.
+func (p *printer) include(node *IncludeNode) string {
+	res := p.expr(node.Tpl)
+	if node.IgnoreMissing {
+		res += " ignore missing"
+	}
+	if node.With != nil {
+		res += " with " + p.expr(node.With)
+	}
+	if node.Only {
+		res += " only"
+	}
+	return res
+}
+
+// aliases returns a sorted, comma separated list of names and their
+// aliases. Names are always followed by their alias if always is true,
+// otherwise only when they differ.
+func aliases(prefix string, names map[string]string, always bool) string {
+	if len(names) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(names))
+	for name := range names {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	res := make([]string, len(keys))
+	for i, name := range keys {
+		if always || names[name] != name {
+			res[i] = name + " as " + names[name]
+		} else {
+			res[i] = name
+		}
+	}
+	return prefix + strings.Join(res, ", ")
+}
+
+// cond returns the optional condition of a for, break or continue tag.
+func (p *printer) cond(cond Expr) string {
+	if cond == nil {
+		return ""
+	}
+	return " if " + p.expr(cond)
+}
+
+// macroArgs returns the arguments and default values of a macro.
+func (p *printer) macroArgs(node *MacroNode) string {
+	args := make([]string, len(node.Args))
+	for i, arg := range node.Args {
+		if def, ok := node.Defaults[arg]; ok {
+			args[i] = arg + " = " + p.expr(def)
+		} else {
+			args[i] = arg
+		}
+	}
+	return strings.Join(args, ", ")
+}
+
+// targets returns the targets of an assignment. Top-level tuples are not
+// enclosed in parentheses.
+func (p *printer) targets(target Expr) string {
+	if tuple, ok := target.(*TupleExpr); ok {
+		res := make([]string, len(tuple.Elements))
+		for i, el := range tuple.Elements {
+			res[i] = p.target(el)
+		}
+		return strings.Join(res, ", ")
+	}
+	return p.target(target)
+}
+
+// target returns a single assignment target.
+func (p *printer) target(target Expr) string {
+	if tuple, ok := target.(*TupleExpr); ok {
+		return "(" + p.targets(tuple) + ")"
+	}
+	return p.expr(target)
+}
+
+// exprList returns the given expression. Top-level tuples are not enclosed
+// in parentheses.
+func (p *printer) exprList(x Expr) string {
+	if tuple, ok := x.(*TupleExpr); ok {
+		return p.exprs(tuple.Elements)
+	}
+	return p.expr(x)
+}
+
+// exprs returns a comma separated list of expressions.
+func (p *printer) exprs(exprs []Expr) string {
+	res := make([]string, len(exprs))
+	for i, x := range exprs {
+		res[i] = p.expr(x)
+	}
+	return strings.Join(res, ", ")
+}
+
+// call returns a function-like call, omitting the parentheses if there are
+// no arguments.
+func (p *printer) call(name string, args []Expr) string {
+	if len(args) == 0 {
+		return name
+	}
+	return name + "(" + p.exprs(args) + ")"
+}
+
+// expr returns the template source of the given expression.
+func (p *printer) expr(x Expr) string {
+	switch exp := x.(type) {
+	case *NameExpr:
+		return exp.Name
+	case *NullExpr:
+		return "null"
+	case *BoolExpr:
+		if exp.Value {
+			return "true"
+		}
+		return "false"
+	case *NumberExpr:
+		return exp.Value
+	case *StringExpr:
+		return p.str(exp.Text)
+	case *FilterExpr:
+		if len(exp.Args) == 0 {
+			return exp.Name
+		}
+		return p.operand(exp.Args[0]) + "|" + p.call(exp.Name, exp.Args[1:])
+	case *TestExpr:
+		return p.call(exp.Name, exp.Args)
+	case *FuncExpr:
+		return exp.Name + "(" + p.exprs(exp.Args) + ")"
+	case *BinaryExpr:
+		return p.binary(exp)
+	case *UnaryExpr:
+		res := p.expr(exp.X)
+		switch exp.X.(type) {
+		case *BinaryExpr, *TernaryIfExpr:
+			res = "(" + res + ")"
+		}
+		if r := exp.Op[len(exp.Op)-1]; r < unicode.MaxASCII && unicode.IsLetter(rune(r)) {
+			return exp.Op + " " + res
+		}
+		return exp.Op + res
+	case *GroupExpr:
+		return "(" + p.expr(exp.X) + ")"
+	case *GetAttrExpr:
+		return p.operand(exp.Cont) + p.attr(exp)
+	case *TernaryIfExpr:
+		cond := p.expr(exp.Cond)
+		if !isOperand(exp.Cond) && !isTest(exp.Cond) {
+			cond = "(" + cond + ")"
+		}
+		return cond + " ? " + p.expr(exp.TrueX) + " : " + p.expr(exp.FalseX)
+	case *KeyValueExpr:
+		return p.expr(exp.Key) + ": " + p.expr(exp.Value)
+	case *HashExpr:
+		res := make([]string, len(exp.Elements))
+		for i, el := range exp.Elements {
+			res[i] = p.expr(el)
+		}
+		return "{" + strings.Join(res, ", ") + "}"
+	case *ArrayExpr:
+		return "[" + p.exprs(exp.Elements) + "]"
+	case *TupleExpr:
+		return "(" + p.exprs(exp.Elements) + ")"
+	}
+	p.errorf("unable to print %T", x)
+	return ""
+}
+
+// operand returns the given expression, enclosed in parentheses if it is
+// an operation that would otherwise bind less tightly than an attribute
+// access or filter.
+func (p *printer) operand(x Expr) string {
+	switch x.(type) {
+	case *BinaryExpr, *UnaryExpr, *TernaryIfExpr:
+		return "(" + p.expr(x) + ")"
+	}
+	return p.expr(x)
+}
+
+// attr returns the attribute access part of a GetAttrExpr.
+func (p *printer) attr(exp *GetAttrExpr) string {
+	if str, ok := exp.Attr.(*StringExpr); ok && p.isAttrName(str.Text) {
+		if len(exp.Args) > 0 {
+			return "." + str.Text + "(" + p.exprs(exp.Args) + ")"
+		}
+		return "." + str.Text
+	}
+	if len(exp.Args) > 0 {
+		p.errorf("unable to print method call with a non-name attribute %s", exp.Attr)
+	}
+	return "[" + p.expr(exp.Attr) + "]"
+}
+
+// isAttrName returns true if the given attribute can be written using the
+// dot notation.
+func (p *printer) isAttrName(name string) bool {
+	if name == "" {
+		return false
+	}
+	switch name {
+	case "null", "NULL", "none", "NONE", "true", "TRUE", "false", "FALSE":
+		return false
+	}
+	if _, ok := p.tree.binaryOperator(name); ok {
+		return false
+	}
+	if _, ok := p.tree.unaryOperator(name); ok {
+		return false
+	}
+	digits := true
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			digits = false
+		}
+	}
+	if digits {
+		return true
+	}
+	for i, r := range name {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
+
+// binary returns the template source of a binary expression, adding
+// parentheses where the operands would otherwise be parsed differently.
+func (p *printer) binary(exp *BinaryExpr) string {
+	op, ok := p.tree.binaryOperator(exp.Op)
+	if !ok {
+		p.errorf("unable to print unknown operator %q", exp.Op)
+		return ""
+	}
+	left, right := p.expr(exp.Left), p.expr(exp.Right)
+	if p.needsParens(exp.Left, exp.Right, op, false) {
+		left = "(" + left + ")"
+	}
+	if p.needsParens(exp.Right, exp.Left, op, true) {
+		right = "(" + right + ")"
+	}
+	return left + " " + exp.Op + " " + right
+}
+
+// needsParens returns true if the given operand of op must be enclosed in
+// parentheses to be parsed as the same expression. other is the remaining
+// operand of op.
+//
+// The parser reads the right side of a binary operator as a whole
+// expression and only reorders it one level deep, built-in unary operators
+// apply to everything that follows them and a ternary condition extends
+// back to the nearest operand only. Operations are therefore only printed
+// without parentheses in the few arrangements that parse back unchanged.
+func (p *printer) needsParens(x, other Expr, op operator, right bool) bool {
+	if isOperand(x) {
+		return false
+	}
+	if !isOperand(other) {
+		return true
+	}
+	switch exp := x.(type) {
+	case *UnaryExpr, *TernaryIfExpr:
+		return !right
+	case *BinaryExpr:
+		if !isOperand(exp.Left) || !isOperand(exp.Right) {
+			return true
+		}
+		if !right && isTest(exp) {
+			return true
+		}
+		xop, ok := p.tree.binaryOperator(exp.Op)
+		if !ok {
+			return true
+		}
+		if xop.precedence != op.precedence {
+			return xop.precedence < op.precedence
+		}
+		if right {
+			return op.leftAssoc()
+		}
+		return !xop.leftAssoc()
+	}
+	return true
+}
+
+// isTest returns true if the given expression is a test of a single
+// operand, which the parser accepts as the condition of a ternary.
+func isTest(x Expr) bool {
+	exp, ok := x.(*BinaryExpr)
+	return ok && (exp.Op == OpBinaryIs || exp.Op == OpBinaryIsNot) && isOperand(exp.Left)
+}
+
+// isOperand returns true if the given expression is not an operation and
+// so never needs parentheses.
+func isOperand(x Expr) bool {
+	switch x.(type) {
+	case *BinaryExpr, *UnaryExpr, *TernaryIfExpr:
+		return false
+	}
+	return true
+}
+
+// str returns a quoted string literal. Single quotes are used unless the
+// text contains one.
+func (p *printer) str(text string) string {
+	if !strings.Contains(text, "'") {
+		return "'" + text + "'"
+	}
+	if !strings.Contains(text, `"`) && !strings.Contains(text, p.delims.InterpolateOpen) {
+		return `"` + text + `"`
+	}
+	p.errorf("unable to print string containing both quotes %q", text)
+	return ""
+}
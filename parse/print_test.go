@@ -0,0 +1,130 @@
+package parse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintRoundTrip(t *testing.T) {
+	for _, test := range parseTests {
+		if test.err != noError {
+			continue
+		}
+		tree, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := Fprint(&buf, tree); err != nil {
+			t.Errorf("%s: unexpected error printing %s", test.name, err)
+			continue
+		}
+		res, err := Parse(buf.String())
+		if err != nil {
+			t.Errorf("%s: unexpected error parsing %q: %s", test.name, buf.String(), err)
+		} else if !nodeEqual(ungroup(res.root), ungroup(tree.root)) {
+			t.Errorf("%s: printed %q\ngot\n\t%v\nexpected\n\t%v", test.name, buf.String(), res.root, tree.root)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"text and print", "Hello, {{name|upper}}!", "Hello, {{ name|upper }}!"},
+		{"whitespace control", "a {{- b -}} c {%- if d -%} e {%- endif -%} f {#- g -#}", "a {{- b -}} c {%- if d -%} e {%- endif -%} f {#- g -#}"},
+		{"whitespace control in tags", "{% block a -%} x {%- endblock %}{% if b -%}1{%- elseif c -%}2{%- else -%}3{%- endif %}{% for d in e -%}4{%- else -%}5{%- endfor %}", "{% block a -%} x {%- endblock %}{% if b -%}1{%- elseif c -%}2{%- else -%}3{%- endif %}{% for d in e -%}4{%- else -%}5{%- endfor %}"},
+		{"comment", "{#a comment#}", "{#a comment#}"},
+		{"verbatim", "{% verbatim %}{{ a }}{% if b %}{%endverbatim%}", "{% verbatim %}{{ a }}{% if b %}{% endverbatim %}"},
+		{"expressions", "{{ (a+b)*-c ~ 'x' ~ \"it's\" }}{{ not (a or b) and c is divisible by(3) }}", "{{ (a + b) * -(c ~ 'x' ~ \"it's\") }}{{ not ((a or b) and c is divisible by(3)) }}"},
+		{"attributes", "{{ a.b['c d'].e(1,2)[f].0 }}{{ {k:v,'l':[1,2]} }}{{ x ? y : z }}", "{{ a.b['c d'].e(1, 2)[f].0 }}{{ {k: v, 'l': [1, 2]} }}{{ x ? y : z }}"},
+		{"interpolation", `{{ "a#{b}c" }}`, "{{ 'a' ~ b ~ 'c' }}"},
+		{"elseif", "{% if a %}1{% elseif b %}2{%else%}3{% endif %}", "{% if a %}1{% elseif b %}2{% else %}3{% endif %}"},
+		{"for", "{% for k,(a,b) in items if a %}{{a}}{% else %}none{% endfor %}", "{% for k, (a, b) in items if a %}{{ a }}{% else %}none{% endfor %}"},
+		{"set", "{% set a, b = 1, 2 %}{% set c %}x{% endset %}{% set d.e = 1 %}", "{% set a, b = 1, 2 %}{% set c %}x{% endset %}{% set d.e = 1 %}"},
+		{"macro and call", "{% macro m(a, b=2) %}{{ caller() }}{% endmacro %}{% call(x) m(1) %}{{ x }}{% endcall %}", "{% macro m(a, b = 2) %}{{ caller() }}{% endmacro %}{% call(x) m(1) %}{{ x }}{% endcall %}"},
+		{"include and embed", "{% include 'a' ignore missing with {b: 1} only %}{% embed 'c' %}x{% block d %}e{% endblock %}{% endembed %}", "{% include 'a' ignore missing with {b: 1} only %}{% embed 'c' %}{% block d %}e{% endblock %}{% endembed %}"},
+		{"embed nested blocks", "{% embed 'e' %}{% block r %}{% block inner %}I{% endblock %}{% endblock %}{% endembed %}", "{% embed 'e' %}{% block r %}{% block inner %}I{% endblock %}{% endblock %}{% endembed %}"},
+		{"imports", "{% import 'a' as b %}{% from 'c' import d, e as f %}{% use 'g' with h as i %}", "{% import 'a' as b %}{% from 'c' import d, e as f %}{% use 'g' with h as i %}"},
+		{"tags", "{% extends 'base' %}{% block a 'b' %}{% autoescape %}{% endautoescape %}{% autoescape false %}{% endautoescape %}{% apply upper|f(1) %}x{% endapply %}{% with {a: 1} only %}{% endwith %}{% do a %}", "{% extends 'base' %}{% block a %}{{ 'b' }}{% endblock %}{% autoescape 'html' %}{% endautoescape %}{% autoescape false %}{% endautoescape %}{% apply upper|f(1) %}x{% endapply %}{% with {a: 1} only %}{% endwith %}{% do a %}"},
+	}
+	for _, test := range tests {
+		tree, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := Fprint(&buf, tree); err != nil {
+			t.Errorf("%s: unexpected error printing %s", test.name, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s:\ngot\n\t%s\nexpected\n\t%s", test.name, buf.String(), test.expected)
+		}
+	}
+}
+
+func TestPrintDelimiters(t *testing.T) {
+	tree := NewTree(strings.NewReader("<% if a %>[[ b ]]<# c #><% endif %>{{ d }}"))
+	tree.Delimiters = Delimiters{PrintOpen: "[[", PrintClose: "]]", TagOpen: "<%", TagClose: "%>", CommentOpen: "<#", CommentClose: "#>"}
+	if err := tree.Parse(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var buf bytes.Buffer
+	if err := Fprint(&buf, tree); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := "<% if a %>[[ b ]]<# c #><% endif %>{{ d }}"
+	if buf.String() != expected {
+		t.Errorf("got\n\t%s\nexpected\n\t%s", buf.String(), expected)
+	}
+}
+
+func TestPrintNode(t *testing.T) {
+	tree := NewTree(strings.NewReader(""))
+	tests := []struct {
+		name     string
+		node     Node
+		expected string
+	}{
+		{"text with delimiters", NewTextNode("{{ a }}", noPos), "{% verbatim %}{{ a }}{% endverbatim %}"},
+		{"precedence", NewPrintNode(NewBinaryExpr(NewBinaryExpr(NewNameExpr("a", noPos), OpBinaryAdd, NewNameExpr("b", noPos), noPos), OpBinaryMultiply, NewNameExpr("c", noPos), noPos), noPos), "{{ (a + b) * c }}"},
+		{"associativity", NewPrintNode(NewBinaryExpr(NewNameExpr("a", noPos), OpBinarySubtract, NewBinaryExpr(NewNameExpr("b", noPos), OpBinarySubtract, NewNameExpr("c", noPos), noPos), noPos), noPos), "{{ a - (b - c) }}"},
+		{"keyword attribute", NewPrintNode(NewGetAttrExpr(NewNameExpr("a", noPos), NewStringExpr("null", noPos), nil, noPos), noPos), "{{ a['null'] }}"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := FprintNode(&buf, tree, test.node); err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if buf.String() != test.expected {
+			t.Errorf("%s:\ngot\n\t%s\nexpected\n\t%s", test.name, buf.String(), test.expected)
+		}
+	}
+	var buf bytes.Buffer
+	err := FprintNode(&buf, tree, NewPrintNode(NewStringExpr(`'"`, noPos), noPos))
+	if err == nil || buf.Len() > 0 {
+		t.Errorf("expected an error and no output, got %v and %q", err, buf.String())
+	}
+}
+
+// ungroup removes all GroupExprs from the given node so that trees which
+// differ only in parentheses compare equal.
+func ungroup(node Node) Node {
+	Inspect(node, func(n Node, path []Node) bool {
+		if n == nil {
+			return false
+		}
+		for _, c := range children(n) {
+			for g, ok := c.(*GroupExpr); ok; g, ok = c.(*GroupExpr) {
+				replaceChild(n, g, g.X)
+				c = g.X
+			}
+		}
+		return true
+	})
+	return node
+}
@@ -0,0 +1,217 @@
+package parse
+
+import (
+	"reflect"
+	"sort"
+)
+
+// priority returns the priority of the given visitor or transformer.
+func priority(v interface{}) int {
+	if p, ok := v.(PrioritizedVisitor); ok {
+		return p.Priority()
+	}
+	return 0
+}
+
+// visit runs each of the Tree's visitors and transformers over the root node,
+// in order of priority.
+func (t *Tree) visit() error {
+	all := make([]interface{}, 0, len(t.Visitors)+len(t.Transformers))
+	for _, v := range t.Visitors {
+		all = append(all, v)
+	}
+	for _, v := range t.Transformers {
+		all = append(all, v)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return priority(all[i]) < priority(all[j])
+	})
+	for _, v := range all {
+		switch v := v.(type) {
+		case NodeTransformer:
+			n, err := t.transform(v, t.root)
+			if err != nil {
+				return err
+			}
+			root, ok := n.(*ModuleNode)
+			if !ok {
+				return newReplaceNodeError(nil, t.root, n)
+			}
+			t.root = root
+		case NodeVisitor:
+			t.traverse(v, t.root)
+		}
+	}
+	return nil
+}
+
+// traverse walks the given Node and its children with the given visitor.
+func (t *Tree) traverse(v NodeVisitor, n Node) {
+	if n == nil {
+		return
+	}
+	v.Enter(n)
+	for _, c := range n.All() {
+		t.traverse(v, c)
+	}
+	v.Leave(n)
+}
+
+// transform walks the given Node and its children with the given transformer,
+// returning the Node that should take the place of n.
+func (t *Tree) transform(v NodeTransformer, n Node) (Node, error) {
+	v.Enter(n)
+	// Children are copied as replacing them may modify the underlying slice.
+	children := append([]Node{}, n.All()...)
+	for _, c := range children {
+		if c == nil {
+			continue
+		}
+		r, err := t.transform(v, c)
+		if err != nil {
+			return nil, err
+		}
+		if r == c {
+			continue
+		}
+		if !replaceChild(n, c, r) {
+			return nil, newReplaceNodeError(n, c, r)
+		}
+		t.replaceReference(c, r)
+	}
+	return v.Leave(n), nil
+}
+
+// replaceReference updates the blocks, macros and parent template known to
+// the Tree when one of them is replaced or removed.
+func (t *Tree) replaceReference(old, new Node) {
+	switch old := old.(type) {
+	case *ExtendsNode:
+		if t.root.Parent != old {
+			return
+		}
+		ext, _ := new.(*ExtendsNode)
+		t.root.Parent = ext
+	case *BlockNode:
+		blocks := t.Blocks()
+		if blocks[old.Name] != old {
+			return
+		}
+		delete(blocks, old.Name)
+		if blk, ok := new.(*BlockNode); ok {
+			blocks[blk.Name] = blk
+		}
+	case *MacroNode:
+		if t.macros[old.Name] != old {
+			return
+		}
+		delete(t.macros, old.Name)
+		if mac, ok := new.(*MacroNode); ok {
+			t.macros[mac.Name] = mac
+		}
+	}
+}
+
+// replaceChild replaces old with new in the fields of parent. If new is nil,
+// old is removed; only elements of slices and maps can be removed. It returns
+// false if old could not be replaced.
+//
+// Fields are inspected using reflection so that any Node, including those
+// defined outside this package, can have its children replaced.
+func replaceChild(parent, old, new Node) bool {
+	v := reflect.ValueOf(parent)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false
+	}
+	return replaceIn(v.Elem(), old, new)
+}
+
+// replaceIn searches the given struct value for a field containing old and
+// replaces it.
+func replaceIn(v reflect.Value, old, new Node) bool {
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		switch f.Kind() {
+		case reflect.Interface:
+			if isNode(f, old) {
+				return setNode(f, new)
+			}
+		case reflect.Ptr:
+			if isNode(f, old) {
+				return setNode(f, new)
+			}
+			if v.Type().Field(i).Anonymous && !f.IsNil() && replaceIn(f.Elem(), old, new) {
+				return true
+			}
+		case reflect.Struct:
+			if v.Type().Field(i).Anonymous && replaceIn(f, old, new) {
+				return true
+			}
+		case reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				if !isNode(f.Index(j), old) {
+					continue
+				}
+				if new == nil {
+					f.Set(reflect.AppendSlice(f.Slice(0, j), f.Slice(j+1, f.Len())))
+					return true
+				}
+				return setNode(f.Index(j), new)
+			}
+		case reflect.Map:
+			iter := f.MapRange()
+			for iter.Next() {
+				if !isNode(iter.Value(), old) {
+					continue
+				}
+				if new == nil {
+					f.SetMapIndex(iter.Key(), reflect.Value{})
+					return true
+				}
+				nv := reflect.ValueOf(new)
+				if !nv.Type().AssignableTo(f.Type().Elem()) {
+					return false
+				}
+				f.SetMapIndex(iter.Key(), nv)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNode returns true if the given value holds the Node n.
+func isNode(v reflect.Value, n Node) bool {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return false
+		}
+	default:
+		return false
+	}
+	if v.Kind() == reflect.Interface && !v.Elem().Type().Comparable() {
+		return false
+	}
+	return v.Interface() == n
+}
+
+// setNode sets the given value to n. It returns false if n is nil, as
+// clearing a field would leave a Node without a required child.
+func setNode(v reflect.Value, n Node) bool {
+	if n == nil {
+		return false
+	}
+	nv := reflect.ValueOf(n)
+	if !nv.Type().AssignableTo(v.Type()) {
+		return false
+	}
+	v.Set(nv)
+	return true
+}
@@ -0,0 +1,166 @@
+package parse
+
+import (
+	"reflect"
+	"sort"
+)
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// The path contains the ancestors of the node, starting with the root.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil, path).
+type Visitor interface {
+	Visit(node Node, path []Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node, path); node must not be nil. If the visitor w returned by
+// v.Visit(node, path) is not nil, Walk is invoked recursively with visitor
+// w for each of the non-nil children of node, followed by a call of
+// w.Visit(nil, path).
+//
+// Unlike Node.All, Walk also visits children that are otherwise only
+// reachable through specific fields, such as the parent reference of a
+// ModuleNode and the unpacking targets of for loops and set tags.
+//
+// The path passed to Visit is reused between calls and must be copied if
+// it is retained.
+func Walk(v Visitor, node Node) {
+	walk(v, node, make([]Node, 0))
+}
+
+func walk(v Visitor, node Node, path []Node) {
+	if v = v.Visit(node, path); v == nil {
+		return
+	}
+	path = append(path, node)
+	for _, c := range children(node) {
+		walk(v, c, path)
+	}
+	v.Visit(nil, path[:len(path)-1])
+}
+
+type inspector func(Node, []Node) bool
+
+func (f inspector) Visit(node Node, path []Node) Visitor {
+	if f(node, path) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node, path); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil, path).
+func Inspect(node Node, f func(node Node, path []Node) bool) {
+	Walk(inspector(f), node)
+}
+
+// Find returns all nodes in the AST with the same type as typ, in the order
+// they are visited by Walk.
+//
+//	prints := parse.Find(tree.Root(), (*parse.PrintNode)(nil))
+func Find(node Node, typ Node) []Node {
+	want := reflect.TypeOf(typ)
+	res := make([]Node, 0)
+	Inspect(node, func(n Node, _ []Node) bool {
+		if n != nil && reflect.TypeOf(n) == want {
+			res = append(res, n)
+		}
+		return true
+	})
+	return res
+}
+
+// children returns the non-nil children of the given Node, including those
+// not returned by Node.All.
+func children(node Node) []Node {
+	var all []Node
+	switch n := node.(type) {
+	case *ModuleNode:
+		all = n.All()
+		if n.Parent != nil && !containsNode(all, n.Parent) {
+			all = append([]Node{n.Parent}, all...)
+		}
+	case *EmbedNode:
+		all = n.IncludeNode.All()
+		for _, blk := range topLevelBlocks(n) {
+			all = append(all, blk)
+		}
+	case *ForNode:
+		all = []Node{n.X}
+		if n.Target != nil {
+			all = append(all, n.Target)
+		}
+		all = append(all, n.Cond, n.Body, n.Else)
+	case *SetNode:
+		all = []Node{n.Target, n.X}
+	case *MacroNode:
+		for _, arg := range n.Args {
+			if def, ok := n.Defaults[arg]; ok {
+				all = append(all, def)
+			}
+		}
+		all = append(all, n.Body)
+	default:
+		all = node.All()
+	}
+	res := make([]Node, 0, len(all))
+	for _, c := range all {
+		if !isNilNode(c) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// topLevelBlocks returns the blocks of the EmbedNode that are not nested in
+// another of its blocks, sorted by name. EmbedNode.Blocks contains every
+// block in the embed, including nested ones, which are reached through the
+// body of their enclosing block.
+func topLevelBlocks(n *EmbedNode) []*BlockNode {
+	nested := make(map[Node]bool)
+	for _, blk := range n.Blocks {
+		if blk.Body == nil {
+			continue
+		}
+		Inspect(blk.Body, func(c Node, path []Node) bool {
+			if _, ok := c.(*BlockNode); ok {
+				nested[c] = true
+			}
+			return true
+		})
+	}
+	names := make([]string, 0, len(n.Blocks))
+	for name, blk := range n.Blocks {
+		if !nested[blk] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := make([]*BlockNode, len(names))
+	for i, name := range names {
+		res[i] = n.Blocks[name]
+	}
+	return res
+}
+
+// containsNode returns true if n is one of the given nodes.
+func containsNode(nodes []Node, n Node) bool {
+	for _, c := range nodes {
+		if c == n {
+			return true
+		}
+	}
+	return false
+}
+
+// isNilNode returns true if n is nil or a nil pointer.
+func isNilNode(n Node) bool {
+	if n == nil {
+		return true
+	}
+	v := reflect.ValueOf(n)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
@@ -0,0 +1,120 @@
+package parse
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// nodeName returns a short name for the given node, for use in tests.
+func nodeName(n Node) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", n), "*parse.")
+}
+
+func TestInspect(t *testing.T) {
+	tree := NewTree(strings.NewReader(`{% extends 'base' %}{% block a %}{% embed 'e' %}{% block c %}{{ c }}{% endblock %}{% block b %}{{ b }}{% endblock %}{% endembed %}{% endblock %}`))
+	if err := tree.Parse(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var res []string
+	Inspect(tree.Root(), func(n Node, path []Node) bool {
+		if n == nil {
+			return true
+		}
+		names := make([]string, len(path)+1)
+		for i, p := range path {
+			names[i] = nodeName(p)
+		}
+		names[len(path)] = nodeName(n)
+		res = append(res, strings.Join(names, "/"))
+		return true
+	})
+	expected := []string{
+		"ModuleNode",
+		"ModuleNode/ExtendsNode",
+		"ModuleNode/ExtendsNode/StringExpr",
+		"ModuleNode/BlockNode",
+		"ModuleNode/BlockNode/BodyNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/StringExpr",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode/PrintNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode/PrintNode/NameExpr",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode/PrintNode",
+		"ModuleNode/BlockNode/BodyNode/EmbedNode/BlockNode/BodyNode/PrintNode/NameExpr",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("got\n\t%s\nexpected\n\t%s", strings.Join(res, "\n\t"), strings.Join(expected, "\n\t"))
+	}
+	names := Find(tree.Root(), (*NameExpr)(nil))
+	if len(names) != 2 || names[0].(*NameExpr).Name != "b" || names[1].(*NameExpr).Name != "c" {
+		t.Errorf("expected embedded blocks to be visited in order, got %v", names)
+	}
+}
+
+func TestInspectNestedEmbedBlocks(t *testing.T) {
+	tree := NewTree(strings.NewReader(`{% embed 'e' %}{% block a %}{% block b %}{% embed 'f' %}{% block c %}{% block d %}{% endblock %}{% endblock %}{% endembed %}{% endblock %}{% endblock %}{% endembed %}`))
+	if err := tree.Parse(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var res []string
+	Inspect(tree.Root(), func(n Node, path []Node) bool {
+		if blk, ok := n.(*BlockNode); ok {
+			names := make([]string, 0, len(path)+1)
+			for _, p := range path {
+				if b, ok := p.(*BlockNode); ok {
+					names = append(names, b.Name)
+				} else if _, ok := p.(*EmbedNode); ok {
+					names = append(names, "embed")
+				}
+			}
+			res = append(res, strings.Join(append(names, blk.Name), "/"))
+		}
+		return true
+	})
+	expected := []string{"embed/a", "embed/a/b", "embed/a/b/embed/c", "embed/a/b/embed/c/d"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected each block to be visited once, got %v", res)
+	}
+	if blocks := Find(tree.Root(), (*BlockNode)(nil)); len(blocks) != 4 {
+		t.Errorf("expected 4 blocks, got %v", blocks)
+	}
+}
+
+func TestInspectHiddenChildren(t *testing.T) {
+	mod := NewModuleNode("", NewForNode("", "", NewNameExpr("items", noPos), NewBodyNode(noPos), nil, noPos))
+	mod.Parent = NewExtendsNode(NewStringExpr("base", noPos), noPos)
+	mod.Nodes[0].(*ForNode).Target = NewTupleExpr(noPos, NewNameExpr("k", noPos), NewNameExpr("v", noPos))
+	var names []string
+	for _, n := range Find(mod, (*NameExpr)(nil)) {
+		names = append(names, n.(*NameExpr).Name)
+	}
+	if expected := []string{"items", "k", "v"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	if res := Find(mod, (*StringExpr)(nil)); len(res) != 1 {
+		t.Errorf("expected the parent reference to be visited, got %v", res)
+	}
+}
+
+func TestInspectPrune(t *testing.T) {
+	tree := NewTree(strings.NewReader(`{{ a }}{% if b %}{{ c }}{% endif %}{{ d }}`))
+	if err := tree.Parse(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	var res []string
+	Inspect(tree.Root(), func(n Node, path []Node) bool {
+		if name, ok := n.(*NameExpr); ok {
+			res = append(res, name.Name)
+		}
+		_, isIf := n.(*IfNode)
+		return !isIf
+	})
+	if expected := []string{"a", "d"}; !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %v, got %v", expected, res)
+	}
+}
@@ -31,13 +31,38 @@ type Filter func(ctx Context, val Value, args ...Value) Value
 // also accept arguments and can consist of two words.
 type Test func(ctx Context, val Value, args ...Value) bool
 
+// A BinaryOperator is a user-defined binary operator, such as "contains" in
+// "list contains 'a'". Operators with a higher precedence bind more tightly.
+// Both operands are evaluated before Eval is called. An error returned by
+// Eval, such as for division by zero, stops execution of the template.
+type BinaryOperator struct {
+	Precedence int
+	Assoc      parse.Associativity
+	Eval       func(ctx Context, left, right Value) (Value, error)
+}
+
+// A UnaryOperator is a user-defined unary operator, applied to the operand
+// that follows it. An error returned by Eval stops execution of the template.
+type UnaryOperator struct {
+	Precedence int
+	Eval       func(ctx Context, val Value) (Value, error)
+}
+
 // Env represents a configured Stick environment.
 type Env struct {
-	Loader    Loader              // Template loader.
-	Functions map[string]Func     // User-defined functions.
-	Filters   map[string]Filter   // User-defined filters.
-	Tests     map[string]Test     // User-defined tests.
-	Visitors  []parse.NodeVisitor // User-defined node visitors.
+	Loader    Loader                     // Template loader.
+	Functions map[string]Func            // User-defined functions.
+	Filters   map[string]Filter          // User-defined filters.
+	Tests     map[string]Test            // User-defined tests.
+	Visitors  []parse.NodeVisitor        // User-defined node visitors.
+	Tags      map[string]parse.TagParser // User-defined tags.
+
+	Transformers []parse.NodeTransformer // User-defined node transformers.
+
+	Delimiters parse.Delimiters // Delimiters used to recognize template syntax. Empty fields use the default.
+
+	BinaryOperators map[string]BinaryOperator // User-defined binary operators.
+	UnaryOperators  map[string]UnaryOperator  // User-defined unary operators.
 }
 
 // An Extension is used to group related functions, filters, visitors, etc.
@@ -77,9 +102,26 @@ type Context interface {
 	Scope() ContextScope   // All defined root-level names.
 	Env() *Env
 
+	// Eval evaluates the given expression in the current scope.
+	Eval(expr parse.Expr) (Value, error)
+
+	// Render executes the given node, writing any output to out.
+	Render(node parse.Node, out io.Writer) error
+
 	noexport() // Prevent other packages from satisfying this interface.
 }
 
+// An ExecutableNode is a user-defined Node that knows how to execute itself.
+//
+// TagParsers registered in Env.Tags may return an ExecutableNode. When the
+// node is reached during execution, its Execute method is called with the
+// current Context and output. The Context can be used to evaluate expressions
+// and render child nodes.
+type ExecutableNode interface {
+	parse.Node
+	Execute(ctx Context, out io.Writer) error
+}
+
 // New creates an empty Env.
 // If nil is passed as loader, a StringLoader is used.
 func New(loader Loader) *Env {
@@ -92,6 +134,12 @@ func New(loader Loader) *Env {
 		Filters:   make(map[string]Filter),
 		Tests:     make(map[string]Test),
 		Visitors:  make([]parse.NodeVisitor, 0),
+		Tags:      make(map[string]parse.TagParser),
+
+		Transformers: make([]parse.NodeTransformer, 0),
+
+		BinaryOperators: make(map[string]BinaryOperator),
+		UnaryOperators:  make(map[string]UnaryOperator),
 	}
 }
 
@@ -101,6 +149,9 @@ func (env *Env) Register(e Extension) error {
 }
 
 // Execute parses and executes the given template.
+//
+// Maps, slices and struct pointers in ctx are not copied. A set tag with an
+// attribute target, such as {% set user.name = 'x' %}, modifies them in place.
 func (env *Env) Execute(tpl string, out io.Writer, ctx map[string]Value) error {
 	return execute(tpl, out, ctx, env)
 }
@@ -119,3 +170,18 @@ func (env *Env) ExecuteSafe(tpl string, out io.Writer, ctx map[string]Value) err
 func (env *Env) Parse(name string) (*parse.Tree, error) {
 	return env.load(name)
 }
+
+// ParseRecover loads and parses the given template in the recovering parse
+// mode, reporting every syntax error instead of stopping at the first.
+//
+// The returned Tree contains all nodes that parsed successfully, even when
+// an error is returned. Syntax errors are returned as parse.ParsingErrors.
+// The Tree is nil only if the template could not be loaded.
+func (env *Env) ParseRecover(name string) (*parse.Tree, error) {
+	tree, err := env.newTree(name)
+	if err != nil {
+		return nil, err
+	}
+	tree.Recover = true
+	return tree, tree.Parse()
+}
@@ -12,20 +12,44 @@ import (
 // Escapers should expect to receive unescaped input.
 type Escaper func(string) string
 
+// A StrategyFunc returns the escaping strategy for the template with the
+// given name. An empty string disables automatic escaping for the template.
+type StrategyFunc func(name string) string
+
 // AutoEscapeExtension provides Twig equivalent escaping for Stick templates.
 type AutoEscapeExtension struct {
 	Escapers map[string]Escaper
+	Strategy StrategyFunc // Determines the default strategy for a template. If nil, GuessStrategy is used.
 }
 
 // Init registers the escape functionality with the given Env.
+//
+// An AutoEscapeExtension registered earlier, such as the one registered by
+// New, is replaced so that output is only escaped once.
 func (e *AutoEscapeExtension) Init(env *stick.Env) error {
-	env.Visitors = append(env.Visitors, &autoEscapeVisitor{})
+	strategy := e.Strategy
+	if strategy == nil {
+		strategy = GuessStrategy
+	}
+	visitors := make([]parse.NodeVisitor, 0, len(env.Visitors)+1)
+	for _, v := range env.Visitors {
+		if _, ok := v.(*autoEscapeVisitor); !ok {
+			visitors = append(visitors, v)
+		}
+	}
+	env.Visitors = append(visitors, &autoEscapeVisitor{strategy: strategy})
 	env.Filters["escape"] = func(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 		ct := "html"
 		if len(args) > 0 {
 			ct = stick.CoerceString(args[0])
 		}
 
+		// Automatic escaping passes true as the second argument. Rendered
+		// template output is only exempt from automatic escaping.
+		if len(args) > 1 && stick.CoerceBool(args[1]) && stick.IsMarkup(val) {
+			return val
+		}
+
 		if sval, ok := val.(stick.SafeValue); ok {
 			if sval.IsSafe(ct) {
 				return val
@@ -53,14 +77,36 @@ func NewAutoEscapeExtension() *AutoEscapeExtension {
 			"js":        escape.JS,
 			"css":       escape.CSS,
 			"url":       escape.URLQueryParam,
+			"json":      escape.JSON,
 		},
+		Strategy: GuessStrategy,
+	}
+}
+
+// GuessStrategy returns an escaping strategy based on the extension of the
+// given template name, ignoring any ".twig" suffix. Plain text and markdown
+// templates are not escaped, and templates without an extension are escaped
+// as html.
+func GuessStrategy(name string) string {
+	name = strings.TrimSuffix(name, ".twig")
+	p := strings.LastIndex(name, ".")
+	if p < 0 {
+		// Default to html
+		return "html"
+	}
+	switch ext := name[p+1:]; ext {
+	case "txt", "md":
+		return ""
+	default:
+		return ext
 	}
 }
 
 // AutoEscapeVisitor can be used to automatically apply the "escape" filter
 // to any PrintNode.
 type autoEscapeVisitor struct {
-	stack []string
+	strategy StrategyFunc
+	stack    []string
 }
 
 // push adds the given name on top of the stack.
@@ -83,18 +129,32 @@ func (v *autoEscapeVisitor) current() string {
 	return v.stack[len(v.stack)-1]
 }
 
+// Priority returns the priority of the visitor. Visitors and transformers
+// that optimize the tree should use a higher priority so that they run after
+// escaping has been applied.
+func (v *autoEscapeVisitor) Priority() int {
+	return 0
+}
+
 func (v *autoEscapeVisitor) Enter(n parse.Node) {
 	switch node := n.(type) {
 	case *parse.ModuleNode:
-		v.push(v.guessTypeFromName(node.Origin))
+		v.push(v.strategy(node.Origin))
 	case *parse.BlockNode:
-		v.push(v.guessTypeFromName(node.Origin))
+		// Blocks inherit the strategy of their surroundings.
+		v.push(v.current())
+	case *parse.AutoEscapeNode:
+		v.push(node.Strategy)
 	case *parse.PrintNode:
 		ct := v.current()
+		if ct == "" {
+			// Escaping is disabled.
+			return
+		}
 		v := node.X
 		r := parse.NewFilterExpr(
 			"escape",
-			[]parse.Expr{v, parse.NewStringExpr(ct, v.Start())},
+			[]parse.Expr{v, parse.NewStringExpr(ct, v.Start()), parse.NewBoolExpr(true, v.Start())},
 			v.Start(),
 		)
 		node.X = r
@@ -103,17 +163,7 @@ func (v *autoEscapeVisitor) Enter(n parse.Node) {
 
 func (v *autoEscapeVisitor) Leave(n parse.Node) {
 	switch n.(type) {
-	case *parse.ModuleNode, *parse.BlockNode:
+	case *parse.ModuleNode, *parse.BlockNode, *parse.AutoEscapeNode:
 		v.pop()
 	}
 }
-
-func (v *autoEscapeVisitor) guessTypeFromName(name string) string {
-	name = strings.TrimSuffix(name, ".twig")
-	p := strings.LastIndex(name, ".")
-	if p < 0 {
-		// Default to html
-		return "html"
-	}
-	return name[p+1:]
-}
@@ -3,6 +3,7 @@ package escape // import "github.com/tyler-sommer/stick/twig/escape"
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 )
 
@@ -109,3 +110,15 @@ func URLQueryParam(in string) string {
 	}
 	return out.String()
 }
+
+// JSON escapes the input for use inside a JSON string. The surrounding
+// quotes are not included. Characters significant to HTML are also escaped
+// so that the output can be embedded in a script tag.
+func JSON(in string) string {
+	b, err := json.Marshal(in)
+	if err != nil {
+		// Invalid UTF-8 is coerced by json.Marshal, so this should not happen.
+		return ""
+	}
+	return string(b[1 : len(b)-1])
+}
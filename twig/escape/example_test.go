@@ -40,3 +40,10 @@ func ExampleURLQueryParam() {
 	// Output:
 	// ?who=%D7%9E%D7%99%D7%99%D7%9F%20%D7%9E%D7%90%D7%9E%D7%A2%D7%9D
 }
+
+func ExampleJSON() {
+	input := "some \"<bad>\" json\n"
+	fmt.Printf(`{"test": "%s"}`, escape.JSON(input))
+	// Output:
+	// {"test": "some \"\u003cbad\u003e\" json\n"}
+}
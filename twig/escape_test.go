@@ -95,3 +95,112 @@ func TestAutoEscapeExtension(t *testing.T) {
 		t.Errorf("expected output to be escaped, but got: %s", actual)
 	}
 }
+
+func TestApplyEscape(t *testing.T) {
+	env := twig.New(nil)
+	buf := bytes.Buffer{}
+	err := env.Execute(`{% apply upper|replace({'A': 'b'})|escape('js')|escape('js') %}a'{% endapply %}`, &buf, nil)
+	if err != nil {
+		t.Errorf("unexpected error executing template: %s", err)
+	}
+	expected := `b\u0027`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %s, got: %s", expected, actual)
+	}
+}
+
+func TestAutoEscapeTag(t *testing.T) {
+	env := twig.New(nil)
+	buf := bytes.Buffer{}
+	err := env.Execute(`{{ v }} {% autoescape 'js' %}{{ v }}{% endautoescape %} {% autoescape false %}{{ v }}{% endautoescape %} {% autoescape %}{{ v }}{% endautoescape %}`, &buf, map[string]stick.Value{"v": "<'>"})
+	if err != nil {
+		t.Errorf("unexpected error executing template: %s", err)
+	}
+	expected := `&lt;&#39;&gt; \u003C\u0027\u003E <'> &lt;&#39;&gt;`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %s, got: %s", expected, actual)
+	}
+}
+
+func TestAutoEscapeStrategy(t *testing.T) {
+	tpls := map[string]string{
+		"notes.txt":       `{{ v }}`,
+		"readme.md":       `{{ v }}`,
+		"data.json.twig":  `{"v": "{{ v }}"}`,
+		"page.html.twig":  `{{ v }}`,
+		"custom.tpl.twig": `{{ v }}`,
+		"nested.tpl.twig": `{{ v }}{% autoescape 'html' %}{{ v }}{% endautoescape %}`,
+	}
+	tests := []struct {
+		name     string
+		strategy twig.StrategyFunc
+		expected string
+	}{
+		{"notes.txt", nil, `<"a">`},
+		{"readme.md", nil, `<"a">`},
+		{"data.json.twig", nil, `{"v": "\u003c\"a\"\u003e"}`},
+		{"page.html.twig", nil, `&lt;&quot;a&quot;&gt;`},
+		{"custom.tpl.twig", func(name string) string { return "url" }, `%3C%22a%22%3E`},
+		{"page.html.twig", func(name string) string { return "" }, `<"a">`},
+		{"nested.tpl.twig", func(name string) string { return "url" }, `%3C%22a%22%3E&lt;&quot;a&quot;&gt;`},
+	}
+	for _, test := range tests {
+		env := twig.New(&stick.MemoryLoader{Templates: tpls})
+		if test.strategy != nil {
+			ext := twig.NewAutoEscapeExtension()
+			ext.Strategy = test.strategy
+			if err := env.Register(ext); err != nil {
+				t.Errorf("%s: unexpected error registering extension: %s", test.name, err)
+				continue
+			}
+		}
+		buf := bytes.Buffer{}
+		err := env.Execute(test.name, &buf, map[string]stick.Value{"v": `<"a">`})
+		if err != nil {
+			t.Errorf("%s: unexpected error executing template: %s", test.name, err)
+			continue
+		}
+		if actual := buf.String(); actual != test.expected {
+			t.Errorf("%s: expected %s, got: %s", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestAutoEscapeRenderedOutput(t *testing.T) {
+	env := twig.New(&stick.MemoryLoader{Templates: map[string]string{
+		"base.html.twig": `{% block content %}<p>{{ v }}</p>{% endblock %}`,
+		"child.html.twig": `{% extends 'base.html.twig' %}` +
+			`{% macro wrap(v) %}<b>{{ v }}</b>{% endmacro %}` +
+			`{% block content %}{% import _self as m %}{% set x %}<i>{{ v }}</i>{% endset %}{{ x }}{{ m.wrap(v) }}{{ parent() }}{{ block('other') }}{% endblock %}` +
+			`{% block other %}<u>{{ v }}</u>{% endblock %}`,
+	}})
+	buf := bytes.Buffer{}
+	err := env.Execute("child.html.twig", &buf, map[string]stick.Value{"v": "&"})
+	if err != nil {
+		t.Errorf("unexpected error executing template: %s", err)
+	}
+	expected := `<i>&amp;</i><b>&amp;</b><p>&amp;</p><u>&amp;</u>`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %s, got: %s", expected, actual)
+	}
+}
+
+func TestExplicitEscapeRenderedOutput(t *testing.T) {
+	env := twig.New(&stick.MemoryLoader{Templates: map[string]string{
+		"page.html.twig": `{% macro m(v) %}{{ v }}{% endmacro %}{% import _self as f %}` +
+			`{% set x %}{{ v }}{% endset %}` +
+			`<script>var s='{{ x|escape('js') }}';</script><a href="?q={{ f.m(v)|escape('url') }}">{{ x|escape('html') }}</a>`,
+	}})
+	buf := bytes.Buffer{}
+	err := env.Execute("page.html.twig", &buf, map[string]stick.Value{"v": "</script><script>alert(1)//"})
+	if err != nil {
+		t.Errorf("unexpected error executing template: %s", err)
+	}
+	// The captured output is html escaped when rendered, and escaped again
+	// for the content type requested explicitly.
+	expected := `<script>var s='\u0026lt\u003B\u002Fscript\u0026gt\u003B\u0026lt\u003Bscript\u0026gt\u003Balert\u00281\u0029\u002F\u002F';</script>` +
+		`<a href="?q=%26lt%3B%2Fscript%26gt%3B%26lt%3Bscript%26gt%3Balert%281%29%2F%2F">&amp;lt;/script&amp;gt;&amp;lt;script&amp;gt;alert(1)//</a>`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("expected %s, got: %s", expected, actual)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"math"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
@@ -85,11 +86,10 @@ func filterBatch(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		// TODO: This would trigger an E_WARNING in PHP.
 		return nil
 	}
-	l, _ := stick.Len(val)
-	numSlices := int(math.Ceil(float64(l) / float64(perSlice)))
-	out := make([][]stick.Value, numSlices)
+	// The length is not known upfront for lazily iterated values, such as
+	// channels, so batches are appended as they fill up.
+	out := [][]stick.Value{}
 	curr := []stick.Value{}
-	i := 0
 	j := 0
 	_, err := stick.Iterate(val, func(k, v stick.Value, l stick.Loop) (bool, error) {
 		// Use a variable length slice and append(). This maintains
@@ -97,9 +97,8 @@ func filterBatch(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		curr = append(curr, v)
 		j++
 		if j == perSlice {
-			out[i] = curr
+			out = append(out, curr)
 			curr = []stick.Value{}
-			i++
 			j = 0
 		}
 		return false, nil
@@ -108,11 +107,11 @@ func filterBatch(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		// TODO: Report error
 		return nil
 	}
-	if i != numSlices {
+	if j > 0 {
 		for ; blankValue != nil && j < perSlice; j++ {
 			curr = append(curr, blankValue)
 		}
-		out[i] = curr
+		out = append(out, curr)
 	}
 	return out
 }
@@ -245,6 +244,15 @@ func filterFirst(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		return arr.Index(0).Interface()
 	}
 
+	if m, ok := val.(*stick.OrderedMap); ok {
+		keys := m.Keys()
+		if len(keys) == 0 {
+			return nil
+		}
+		v, _ := m.Get(keys[0])
+		return v
+	}
+
 	if stick.IsMap(val) {
 		// TODO: Trigger runtime error, Golang randomises map keys so getting the "First" does not make sense
 		return nil
@@ -295,6 +303,10 @@ func filterJSONEncode(ctx stick.Context, val stick.Value, args ...stick.Value) s
 }
 
 func filterKeys(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if m, ok := val.(*stick.OrderedMap); ok {
+		// OrderedMap keys are returned in insertion order rather than sorted.
+		return m.Keys()
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array:
@@ -323,6 +335,15 @@ func filterLast(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 		return arr.Index(arr.Len() - 1).Interface()
 	}
 
+	if m, ok := val.(*stick.OrderedMap); ok {
+		keys := m.Keys()
+		if len(keys) == 0 {
+			return nil
+		}
+		v, _ := m.Get(keys[len(keys)-1])
+		return v
+	}
+
 	if stick.IsMap(val) {
 		// TODO: Trigger runtime error, Golang randomises map keys so getting the "Last" does not make sense
 		return nil
@@ -338,6 +359,9 @@ func filterLast(ctx stick.Context, val stick.Value, args ...stick.Value) stick.V
 
 // filterLength returns the length of val.
 func filterLength(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
+	if sv, ok := val.(stick.SafeValue); ok {
+		val = sv.Value()
+	}
 	if v, ok := val.(string); ok {
 		return utf8.RuneCountInString(v)
 	}
@@ -360,9 +384,42 @@ func filterMerge(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 		return nil
 	}
 
+	if m, ok := val.(*stick.OrderedMap); ok {
+		// Keys from val keep their position, new keys from the argument
+		// are appended in the order they are iterated.
+		out := stick.NewOrderedMap()
+		for _, k := range m.Keys() {
+			v, _ := m.Get(k)
+			out.Set(k, v)
+		}
+		if stick.IsMap(args[0]) {
+			stick.Iterate(args[0], func(k, v stick.Value, l stick.Loop) (bool, error) {
+				out.Set(stick.CoerceString(k), v)
+				return false, nil
+			})
+		} else {
+			// Values from a list are appended with the next integer keys,
+			// like PHP's array_merge.
+			next := nextIntKey(out)
+			stick.Iterate(args[0], func(k, v stick.Value, l stick.Loop) (bool, error) {
+				out.Set(strconv.Itoa(next), v)
+				next++
+				return false, nil
+			})
+		}
+		return out
+	}
+
 	outMap, isObject := val.(map[string]stick.Value)
 
 	if isObject {
+		if m, ok := args[0].(*stick.OrderedMap); ok {
+			for _, k := range m.Keys() {
+				outMap[k], _ = m.Get(k)
+			}
+			return outMap
+		}
+
 		argMap, ok := args[0].(map[string]stick.Value)
 
 		if ok {
@@ -389,6 +446,18 @@ func filterMerge(ctx stick.Context, val stick.Value, args ...stick.Value) stick.
 	}
 }
 
+// nextIntKey returns one more than the largest integer key in m, or 0 if m
+// has no integer keys.
+func nextIntKey(m *stick.OrderedMap) int {
+	next := 0
+	for _, k := range m.Keys() {
+		if n, err := strconv.Atoi(k); err == nil && strconv.Itoa(n) == k && n >= next {
+			next = n + 1
+		}
+	}
+	return next
+}
+
 func filterNL2BR(ctx stick.Context, val stick.Value, args ...stick.Value) stick.Value {
 	// TODO: Implement Me
 	return val
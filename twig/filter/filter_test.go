@@ -46,6 +46,7 @@ func TestFilters(t *testing.T) {
 		{"abs invalid", func() stick.Value { return filterAbs(nil, "invalid") }, 0.0},
 		{"len string", func() stick.Value { return filterLength(nil, "hello") }, 5},
 		{"len nil", func() stick.Value { return filterLength(nil, nil) }, 0},
+		{"len safe string", func() stick.Value { return filterLength(nil, stick.NewSafeValue("héllo", "html")) }, 5},
 		{"len slice", func() stick.Value { return filterLength(nil, []string{"h", "e"}) }, 2},
 		{"capitalize", func() stick.Value { return filterCapitalize(nil, "word") }, "Word"},
 		{"lower", func() stick.Value { return filterLower(nil, "HELLO, WORLD!") }, "hello, world!"},
@@ -57,6 +58,14 @@ func TestFilters(t *testing.T) {
 		{"batch full", newBatchFunc([]int{1, 2, 3, 4}, 2), "1.2..3.4.."},
 		{"batch empty", newBatchFunc([]int{}, 10), ""},
 		{"batch nil", newBatchFunc(nil, 10), ""},
+		{"batch channel", func() stick.Value {
+			ch := make(chan int, 3)
+			ch <- 1
+			ch <- 2
+			ch <- 3
+			close(ch)
+			return newBatchFunc(ch, 2, 0)()
+		}, "1.2..3.0.."},
 		{"first array", func() stick.Value { return filterFirst(nil, []string{"1", "2", "3", "4"}) }, "1"},
 		{"first string", func() stick.Value { return filterFirst(nil, "1234") }, "1"},
 		{"first string utf8", func() stick.Value { return filterFirst(nil, "東京") }, "東"},
@@ -131,6 +140,24 @@ func TestFilters(t *testing.T) {
 				return
 			},
 		},
+		{"keys ordered map", func() stick.Value {
+			return stickSliceToString(filterKeys(nil, newOrderedMap("c", 1, "a", 2, "b", 3)))
+		}, `c.a.b`},
+		{"merge ordered map", func() stick.Value {
+			return filterJSONEncode(nil, filterMerge(nil, newOrderedMap("c", 1, "a", 2), newOrderedMap("b", 3, "c", 4)))
+		}, `{"c":4,"a":2,"b":3}`},
+		{"merge list into ordered map", func() stick.Value {
+			return filterJSONEncode(nil, filterMerge(nil, newOrderedMap("a", 1, "3", 2), []string{"x", "y"}))
+		}, `{"a":1,"3":2,"4":"x","5":"y"}`},
+		{"merge list into ordered map without integer keys", func() stick.Value {
+			return filterJSONEncode(nil, filterMerge(nil, newOrderedMap("a", 1), []string{"x"}))
+		}, `{"a":1,"0":"x"}`},
+		{"first ordered map", func() stick.Value { return filterFirst(nil, newOrderedMap("c", 1, "a", 2, "b", 3)) }, "1"},
+		{"last ordered map", func() stick.Value { return filterLast(nil, newOrderedMap("c", 1, "a", 2, "b", 3)) }, "3"},
+		{"first empty ordered map", func() stick.Value { return filterFirst(nil, stick.NewOrderedMap()) }, nil},
+		{"json encode ordered map", func() stick.Value {
+			return filterJSONEncode(nil, newOrderedMap("z", 1, "y", newOrderedMap("b", true, "a", nil)))
+		}, `{"z":1,"y":{"b":true,"a":null}}`},
 		{"urlencode", func() stick.Value { return filterURLEncode(nil, "http://test.com/dude?sweet=33&1=2") }, "http%3A%2F%2Ftest.com%2Fdude%3Fsweet%3D33%261%3D2"},
 		{"raw", func() stick.Value {
 			safeVal, ok := filterRaw(nil, "<p>test</p>").(stick.SafeValue)
@@ -174,3 +201,11 @@ func stickSliceToString(value stick.Value) (output string) {
 
 	return strings.Join(slice, ".")
 }
+
+func newOrderedMap(kvs ...stick.Value) *stick.OrderedMap {
+	m := stick.NewOrderedMap()
+	for i := 0; i+1 < len(kvs); i += 2 {
+		m.Set(stick.CoerceString(kvs[i]), kvs[i+1])
+	}
+	return m
+}
@@ -0,0 +1,20 @@
+// Package test provides built-in tests for Twig-compatibility.
+package test // import "github.com/tyler-sommer/stick/twig/test"
+
+import "github.com/tyler-sommer/stick"
+
+// TwigTests returns a map containing built-in Twig tests.
+func TwigTests() map[string]stick.Test {
+	return map[string]stick.Test{
+		"same as": testSameAs,
+	}
+}
+
+// testSameAs checks if a value is identical to another, without any type
+// conversion. This is the equivalent of PHP's "===" operator.
+func testSameAs(ctx stick.Context, val stick.Value, args ...stick.Value) bool {
+	if len(args) != 1 {
+		return false
+	}
+	return stick.Same(val, args[0])
+}
@@ -0,0 +1,21 @@
+package test
+
+import "testing"
+
+func TestSameAs(t *testing.T) {
+	tests := []struct {
+		val, arg interface{}
+		expected bool
+	}{
+		{1, 1, true},
+		{1, "1", false},
+		{1, 1.0, false},
+		{nil, nil, true},
+		{"a", "a", true},
+	}
+	for _, test := range tests {
+		if res := testSameAs(nil, test.val, test.arg); res != test.expected {
+			t.Errorf("%#v same as %#v: expected %v, got %v", test.val, test.arg, test.expected, res)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"github.com/tyler-sommer/stick"
 	"github.com/tyler-sommer/stick/parse"
 	"github.com/tyler-sommer/stick/twig/filter"
+	"github.com/tyler-sommer/stick/twig/test"
 )
 
 // New creates a new, default Env that aims to be compatible with Twig.
@@ -41,8 +42,14 @@ func New(loader stick.Loader) *stick.Env {
 		Loader:    loader,
 		Functions: make(map[string]stick.Func),
 		Filters:   filter.TwigFilters(),
-		Tests:     make(map[string]stick.Test),
+		Tests:     test.TwigTests(),
 		Visitors:  make([]parse.NodeVisitor, 0),
+		Tags:      make(map[string]parse.TagParser),
+
+		Transformers: make([]parse.NodeTransformer, 0),
+
+		BinaryOperators: make(map[string]stick.BinaryOperator),
+		UnaryOperators:  make(map[string]stick.UnaryOperator),
 	}
 	env.Register(NewAutoEscapeExtension())
 	return env
@@ -0,0 +1,41 @@
+package twig_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tyler-sommer/stick"
+	"github.com/tyler-sommer/stick/twig"
+)
+
+type name string
+
+func (n name) String() string {
+	return string(n)
+}
+
+func TestSameAs(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      map[string]stick.Value
+		expected string
+	}{
+		{"string and string", map[string]stick.Value{"a": "x", "b": "x"}, "yes"},
+		{"different strings", map[string]stick.Value{"a": "x", "b": "y"}, "no"},
+		{"stringer and string", map[string]stick.Value{"a": name("x"), "b": "x"}, "no"},
+		{"string and stringer", map[string]stick.Value{"a": "x", "b": name("x")}, "no"},
+		{"int and string", map[string]stick.Value{"a": 1, "b": "1"}, "no"},
+	}
+	env := twig.New(nil)
+	for _, test := range tests {
+		buf := bytes.Buffer{}
+		err := env.Execute("{% if a is same as(b) %}yes{% else %}no{% endif %}", &buf, test.ctx)
+		if err != nil {
+			t.Errorf("%s: unexpected error executing template: %s", test.name, err)
+			continue
+		}
+		if actual := buf.String(); actual != test.expected {
+			t.Errorf("%s: expected %s, got: %s", test.name, test.expected, actual)
+		}
+	}
+}
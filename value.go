@@ -1,9 +1,12 @@
 package stick
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 
 	"github.com/shopspring/decimal"
 )
@@ -63,6 +66,118 @@ func (v safeValue) SafeFor() []string {
 	return r
 }
 
+// markup is the rendered output of part of a template, such as captured
+// output or the result of a macro. Any escaping was applied while it was
+// rendered, so like Twig's Markup it is not escaped again by automatic
+// escaping. It is not known to be safe for any particular content type, so
+// escaping it explicitly escapes it again.
+type markup string
+
+func newMarkup(out string) SafeValue {
+	return markup(out)
+}
+
+func (m markup) Value() Value {
+	return string(m)
+}
+
+func (m markup) IsSafe(typ string) bool {
+	return false
+}
+
+func (m markup) SafeFor() []string {
+	return nil
+}
+
+// IsMarkup returns true if val is rendered template output, such as the
+// output captured by a set tag, the result of a macro, or a rendered block.
+// Automatic escaping should leave such values unchanged.
+func IsMarkup(val Value) bool {
+	_, ok := val.(markup)
+	return ok
+}
+
+// An OrderedMap is a map of string keys to Values that remembers the order
+// in which keys were first inserted.
+//
+// Hash literals in templates, such as `{ 'b': 1, 'a': 2 }`, evaluate to an
+// OrderedMap so that iteration follows the order written in the template.
+type OrderedMap struct {
+	keys   []string
+	values map[string]Value
+}
+
+// NewOrderedMap creates an empty OrderedMap.
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{make([]string, 0), make(map[string]Value)}
+}
+
+// Set sets the value for the given key. If the key already exists, its
+// position is retained.
+func (m *OrderedMap) Set(key string, val Value) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = val
+}
+
+// Get returns the value for the given key. The second return value is false
+// if the key does not exist.
+func (m *OrderedMap) Get(key string) (Value, bool) {
+	v, ok := m.values[key]
+	return v, ok
+}
+
+// Delete removes the given key from the map.
+func (m *OrderedMap) Delete(key string) {
+	if _, ok := m.values[key]; !ok {
+		return
+	}
+	delete(m.values, key)
+	for i, k := range m.keys {
+		if k == key {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys in the map, in insertion order.
+func (m *OrderedMap) Keys() []string {
+	res := make([]string, len(m.keys))
+	copy(res, m.keys)
+	return res
+}
+
+// Len returns the number of entries in the map.
+func (m *OrderedMap) Len() int {
+	return len(m.keys)
+}
+
+// MarshalJSON encodes the map as a JSON object, preserving key order.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 // Stringer is implemented by any value that has a String method.
 type Stringer interface {
 	fmt.Stringer
@@ -214,6 +329,15 @@ func CoerceString(v Value) string {
 
 // GetAttr attempts to access the given value and return the specified attribute.
 func GetAttr(v Value, attr Value, args ...Value) (Value, error) {
+	if m, ok := v.(*OrderedMap); ok {
+		if val, ok := m.Get(CoerceString(attr)); ok {
+			return val, nil
+		}
+		return nil, fmt.Errorf("getattr: unable to locate attribute \"%s\" on \"%v\"", attr, v)
+	}
+	if l, ok := v.(*loopValue); ok {
+		return l.attr(CoerceString(attr), args...)
+	}
 	r := reflect.Indirect(reflect.ValueOf(v))
 	if !r.IsValid() {
 		return nil, fmt.Errorf("getattr: value does not support attribute lookup: %v", v)
@@ -262,6 +386,97 @@ func GetAttr(v Value, attr Value, args ...Value) (Value, error) {
 	return retval.Interface(), nil
 }
 
+// SetAttr sets the attribute on the given Value to val. Attributes can be
+// set on OrderedMaps, maps, slices, and exported fields of struct pointers.
+// Numbers are converted to the numeric type of the target, if they fit.
+//
+// The Value is modified in place, not copied. Setting an attribute on a map,
+// slice or struct pointer owned by the caller changes the caller's value.
+func SetAttr(v Value, attr Value, val Value) error {
+	if m, ok := v.(*OrderedMap); ok {
+		m.Set(CoerceString(attr), val)
+		return nil
+	}
+	r := reflect.ValueOf(v)
+	switch r.Kind() {
+	case reflect.Map:
+		if r.IsNil() {
+			break
+		}
+		t := r.Type()
+		k, ok := valueOfType(attr, t.Key())
+		if !ok {
+			break
+		}
+		if x, ok := valueOfType(val, t.Elem()); ok {
+			r.SetMapIndex(k, x)
+			return nil
+		}
+	case reflect.Slice:
+		index := int(CoerceNumber(attr))
+		if index < 0 || index >= r.Len() {
+			break
+		}
+		if x, ok := valueOfType(val, r.Type().Elem()); ok {
+			r.Index(index).Set(x)
+			return nil
+		}
+	case reflect.Ptr:
+		e := r.Elem()
+		if e.Kind() != reflect.Struct {
+			break
+		}
+		f := e.FieldByName(CoerceString(attr))
+		if !f.IsValid() || !f.CanSet() {
+			break
+		}
+		if x, ok := valueOfType(val, f.Type()); ok {
+			f.Set(x)
+			return nil
+		}
+	}
+	return fmt.Errorf("setattr: unable to set attribute \"%s\" on \"%v\"", attr, v)
+}
+
+// valueOfType returns val as a reflect.Value assignable to the given type.
+// Strings are coerced if the type is a string type.
+func valueOfType(val Value, t reflect.Type) (reflect.Value, bool) {
+	if val == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			return reflect.Zero(t), true
+		}
+		return reflect.Value{}, false
+	}
+	r := reflect.ValueOf(val)
+	if r.Type().AssignableTo(t) {
+		return r, true
+	}
+	if t.Kind() == reflect.String {
+		return reflect.ValueOf(CoerceString(val)).Convert(t), true
+	}
+	if isNumericKind(r.Kind()) && isNumericKind(t.Kind()) {
+		// Only convert if no precision is lost, such as when assigning 5 to
+		// an int field or 1.5 to a float32.
+		x := r.Convert(t)
+		if x.Convert(r.Type()).Interface() == r.Interface() {
+			return x, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// isNumericKind returns true if k is an integer or floating point kind.
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
 func getMethod(v Value, name string) (reflect.Value, error) {
 	var retVal reflect.Value
 	value := reflect.ValueOf(v)
@@ -290,6 +505,10 @@ func getMethod(v Value, name string) (reflect.Value, error) {
 type Iteratee func(k, v Value, l Loop) (brk bool, err error)
 
 // Loop contains metadata about the current state of a loop.
+//
+// When iterating over a value that cannot report its length upfront, such
+// as a channel or an Iterator that is not Countable, Length is -1 and Last,
+// Revindex, and Revindex0 are not computed.
 type Loop struct {
 	Last      bool
 	Index     int
@@ -300,6 +519,57 @@ type Loop struct {
 	Length    int
 }
 
+// newLoop returns the Loop for the first step over ln items. A negative ln
+// means the number of items is unknown.
+func newLoop(ln int) Loop {
+	if ln < 0 {
+		return Loop{false, 1, 0, 0, 0, true, -1}
+	}
+	return Loop{ln == 1, 1, 0, ln, ln - 1, true, ln}
+}
+
+// advance moves the Loop forward one step.
+func (l *Loop) advance() {
+	l.Index++
+	l.Index0++
+	l.First = false
+	if l.Length >= 0 {
+		l.Last = l.Length == l.Index
+		l.Revindex--
+		l.Revindex0--
+	}
+}
+
+// An Iterator produces a sequence of keys and values that can be looped
+// over in a template. Iterators are consumed lazily, one item per step.
+type Iterator interface {
+	// Next returns the next key and value. The third return value is false
+	// when there are no more items.
+	Next() (Value, Value, bool)
+}
+
+// Countable is implemented by any value that has a Len method.
+//
+// An Iterator that is also Countable allows loop metadata like
+// loop.length and loop.last to be computed.
+type Countable interface {
+	// Len returns the number of items in the value.
+	Len() int
+}
+
+// isSeqFunc returns true if the given type matches the signature of an
+// iter.Seq or iter.Seq2 function.
+func isSeqFunc(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	y := t.In(0)
+	if y.Kind() != reflect.Func || y.NumOut() != 1 || y.Out(0).Kind() != reflect.Bool {
+		return false
+	}
+	return y.NumIn() == 1 || y.NumIn() == 2
+}
+
 // IsArray returns true if the given Value is a slice or array.
 func IsArray(val Value) bool {
 	r := reflect.Indirect(reflect.ValueOf(val))
@@ -310,88 +580,185 @@ func IsArray(val Value) bool {
 	return false
 }
 
-// IsMap returns true if the given Value is a map.
+// IsMap returns true if the given Value is a map or OrderedMap.
 func IsMap(val Value) bool {
+	if _, ok := val.(*OrderedMap); ok {
+		return true
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	return r.Kind() == reflect.Map
 }
 
-// IsIterable returns true if the given Value is a slice, array, or map.
+// IsIterable returns true if the given Value is a slice, array, map,
+// OrderedMap, channel, Iterator, or iter.Seq or iter.Seq2 function.
 func IsIterable(val Value) bool {
 	if val == nil {
 		return true
 	}
+	switch val.(type) {
+	case *OrderedMap, Iterator:
+		return true
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array, reflect.Map:
 		return true
+	case reflect.Chan:
+		// Send-only channels cannot be read from.
+		return r.Type().ChanDir()&reflect.RecvDir != 0
+	case reflect.Func:
+		return isSeqFunc(r.Type())
 	}
 	return false
 }
 
 // Iterate calls the Iteratee func for every item in the Value.
+//
+// Channels, Iterators, and iter.Seq and iter.Seq2 functions are consumed
+// lazily. Channels are read until they are closed.
 func Iterate(val Value, it Iteratee) (int, error) {
 	if val == nil {
 		return 0, nil
 	}
+	switch vc := val.(type) {
+	case *OrderedMap:
+		return iterateOrderedMap(vc, it)
+	case Iterator:
+		return iterateIterator(vc, it)
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array:
 		ln := r.Len()
-		l := Loop{
-			ln == 1,
-			1,
-			0,
-			ln,
-			ln - 1,
-			true,
-			ln,
-		}
+		l := newLoop(ln)
 		for i := 0; i < ln; i++ {
 			v := r.Index(i)
 			brk, err := it(i, v.Interface(), l)
 			if brk || err != nil {
 				return i + 1, err
 			}
-
-			l.Index++
-			l.Index0++
-			l.Last = ln == l.Index
-			l.Revindex--
-			l.Revindex0--
-			l.First = false
+			l.advance()
 		}
 		return ln, nil
 	case reflect.Map:
 		keys := r.MapKeys()
 		ln := r.Len()
-		l := Loop{
-			ln == 1,
-			1,
-			0,
-			ln,
-			ln - 1,
-			true,
-			ln,
-		}
+		l := newLoop(ln)
 		for i, k := range keys {
 			v := r.MapIndex(k)
 			brk, err := it(k.Interface(), v.Interface(), l)
 			if brk || err != nil {
 				return i + 1, err
 			}
-
-			l.Index++
-			l.Index0++
-			l.Last = ln == l.Index
-			l.Revindex--
-			l.Revindex0--
-			l.First = false
+			l.advance()
 		}
 		return ln, nil
-	default:
-		return 0, fmt.Errorf(`stick: unable to iterate over %s "%v"`, r.Kind(), val)
+	case reflect.Chan:
+		if r.Type().ChanDir()&reflect.RecvDir == 0 {
+			return 0, fmt.Errorf(`stick: unable to iterate over send-only channel "%v"`, val)
+		}
+		if r.IsNil() {
+			return 0, nil
+		}
+		return iterateLazy(-1, func(yield func(k, v Value) bool) {
+			for i := 0; ; i++ {
+				v, ok := r.Recv()
+				if !ok || !yield(i, v.Interface()) {
+					return
+				}
+			}
+		}, it)
+	case reflect.Func:
+		if !isSeqFunc(r.Type()) {
+			break
+		}
+		if r.IsNil() {
+			return 0, nil
+		}
+		return iterateSeqFunc(r, it)
+	}
+	return 0, fmt.Errorf(`stick: unable to iterate over %s "%v"`, r.Kind(), val)
+}
+
+// iterateOrderedMap calls the Iteratee func for every entry in the OrderedMap,
+// in insertion order.
+func iterateOrderedMap(m *OrderedMap, it Iteratee) (int, error) {
+	keys := m.Keys()
+	ln := len(keys)
+	l := newLoop(ln)
+	for i, k := range keys {
+		v, _ := m.Get(k)
+		brk, err := it(k, v, l)
+		if brk || err != nil {
+			return i + 1, err
+		}
+		l.advance()
+	}
+	return ln, nil
+}
+
+// iterateIterator calls the Iteratee func for every item produced by the
+// Iterator. Loop length is only known if the Iterator is also Countable.
+func iterateIterator(iter Iterator, it Iteratee) (int, error) {
+	ln := -1
+	if c, ok := iter.(Countable); ok {
+		ln = c.Len()
 	}
+	return iterateLazy(ln, func(yield func(k, v Value) bool) {
+		for {
+			k, v, ok := iter.Next()
+			if !ok || !yield(k, v) {
+				return
+			}
+		}
+	}, it)
+}
+
+// iterateSeqFunc calls the Iteratee func for every item produced by an
+// iter.Seq or iter.Seq2 function. For an iter.Seq, the key is the index of
+// the item.
+func iterateSeqFunc(fn reflect.Value, it Iteratee) (int, error) {
+	yt := fn.Type().In(0)
+	return iterateLazy(-1, func(yield func(k, v Value) bool) {
+		i := 0
+		y := reflect.MakeFunc(yt, func(args []reflect.Value) []reflect.Value {
+			var cont bool
+			if len(args) == 2 {
+				cont = yield(args[0].Interface(), args[1].Interface())
+			} else {
+				cont = yield(i, args[0].Interface())
+			}
+			i++
+			return []reflect.Value{reflect.ValueOf(cont).Convert(yt.Out(0))}
+		})
+		fn.Call([]reflect.Value{y})
+	}, it)
+}
+
+// iterateLazy drives an Iteratee using the given sequence function. The
+// sequence function must stop producing items once yield returns false.
+// A negative ln means the number of items is unknown.
+func iterateLazy(ln int, seq func(yield func(k, v Value) bool), it Iteratee) (int, error) {
+	var err error
+	n := 0
+	done := false
+	l := newLoop(ln)
+	seq(func(k, v Value) bool {
+		if done {
+			// The sequence did not stop when asked to.
+			return false
+		}
+		n++
+		var brk bool
+		brk, err = it(k, v, l)
+		if brk || err != nil {
+			done = true
+			return false
+		}
+		l.advance()
+		return true
+	})
+	return n, err
 }
 
 // Len returns the Length of Value.
@@ -399,6 +766,9 @@ func Len(val Value) (int, error) {
 	if val == nil {
 		return 0, nil
 	}
+	if c, ok := val.(Countable); ok {
+		return c.Len(), nil
+	}
 	r := reflect.Indirect(reflect.ValueOf(val))
 	switch r.Kind() {
 	case reflect.Slice, reflect.Array, reflect.Map:
@@ -407,14 +777,25 @@ func Len(val Value) (int, error) {
 	return 0, fmt.Errorf(`stick: could not get Length of %s "%v"`, r.Kind(), val)
 }
 
-// Equal returns true if the two Values are considered equal.
-func Equal(left Value, right Value) bool {
-	// TODO: Stop-gap for now, this will need to be much more sophisticated.
-	return CoerceString(left) == CoerceString(right)
-}
-
-// Contains returns true if the haystack Value contains needle.
+// Contains returns true if the haystack Value contains needle. This is the
+// "in" operator.
+//
+// If haystack is a string, Contains returns true if needle is a string or
+// number that is a substring of haystack. Otherwise, haystack is iterated
+// and Contains returns true if any value is loosely equal to needle; for maps
+// the values are checked, not the keys. A nil haystack contains nothing.
 func Contains(haystack Value, needle Value) (bool, error) {
+	haystack, needle = unwrapSafe(haystack), unwrapSafe(needle)
+	if haystack == nil {
+		return false, nil
+	}
+	if !IsIterable(haystack) && kindOf(haystack) == kindString {
+		switch kindOf(needle) {
+		case kindString, kindInt, kindFloat:
+			return strings.Contains(CoerceString(haystack), CoerceString(needle)), nil
+		}
+		return false, nil
+	}
 	res := false
 	_, err := Iterate(haystack, func(k Value, v Value, l Loop) (bool, error) {
 		if Equal(v, needle) {
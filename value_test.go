@@ -1,6 +1,7 @@
 package stick
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"strings"
@@ -199,6 +200,12 @@ func TestIsIterable(t *testing.T) {
 		{"is iterable array", [4]int{}, true},
 		{"is iterable slice", []int{}, true},
 		{"is iterable map", map[string]string{}, true},
+		{"is iterable channel", make(chan int), true},
+		{"is iterable send-only channel", make(chan<- int), false},
+		{"is iterable seq", func(yield func(int) bool) {}, true},
+		{"is iterable seq2", func(yield func(string, int) bool) {}, true},
+		{"is iterable iterator", &sliceIterator{}, true},
+		{"is iterable func", func(a int) {}, false},
 		{"is iterable string", "a string", false},
 		{"is iterable struct", struct{ name string }{"world"}, false},
 	}
@@ -264,6 +271,8 @@ func TestLen(t *testing.T) {
 		{"len empty slice", []int{}, 0, false},
 		{"len empty map", map[string]string{}, 0, false},
 		{"len map", map[string]string{"a": "A", "b": "B"}, 2, false},
+		{"len countable iterator", &sliceIterator{vals: []Value{1, 2, 3}}, 3, false},
+		{"len channel", make(chan int), 0, true},
 		{"len empty string", "", 0, true},
 		{"len string", "a string", 0, true},
 		{"len struct", struct{ name string }{"world"}, 0, true},
@@ -386,3 +395,217 @@ func TestIterate_error(t *testing.T) {
 		t.Errorf("expected 'hello world' got '%s'", v)
 	}
 }
+
+func TestOrderedMap(t *testing.T) {
+	m := NewOrderedMap()
+	m.Set("b", 1)
+	m.Set("a", 2)
+	m.Set("c", 3)
+	m.Set("b", 4)
+	m.Delete("c")
+	if v := strings.Join(m.Keys(), ","); v != "b,a" {
+		t.Errorf("expected keys 'b,a', got '%s'", v)
+	}
+	if l, _ := Len(m); l != 2 {
+		t.Errorf("expected length 2, got %d", l)
+	}
+	if v, err := GetAttr(m, "b"); err != nil || v != 4 {
+		t.Errorf("expected 4, got %v (err: %v)", v, err)
+	}
+	if _, err := GetAttr(m, "c"); err == nil {
+		t.Errorf("expected error for missing key, got none")
+	}
+	res := []string{}
+	_, err := Iterate(m, func(k, v Value, l Loop) (bool, error) {
+		res = append(res, fmt.Sprintf("%s:%s", CoerceString(k), CoerceString(v)))
+		return false, nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if v := strings.Join(res, " "); v != "b:4 a:2" {
+		t.Errorf("expected 'b:4 a:2', got '%s'", v)
+	}
+	if ok, _ := Contains(m, 2); !ok {
+		t.Errorf("expected map to contain 2")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if v := string(b); v != `{"b":4,"a":2}` {
+		t.Errorf(`expected '{"b":4,"a":2}', got '%s'`, v)
+	}
+}
+
+// sliceIterator is a Countable Iterator over a slice.
+type sliceIterator struct {
+	vals []Value
+	pos  int
+}
+
+func (it *sliceIterator) Next() (Value, Value, bool) {
+	if it.pos >= len(it.vals) {
+		return nil, nil, false
+	}
+	it.pos++
+	return it.pos - 1, it.vals[it.pos-1], true
+}
+
+func (it *sliceIterator) Len() int {
+	return len(it.vals)
+}
+
+// uncountableIterator hides the Len method of a sliceIterator.
+type uncountableIterator struct {
+	it *sliceIterator
+}
+
+func (it uncountableIterator) Next() (Value, Value, bool) {
+	return it.it.Next()
+}
+
+func TestIterate_lazy(t *testing.T) {
+	ch := make(chan string, 3)
+	ch <- "a"
+	ch <- "b"
+	ch <- "c"
+	close(ch)
+	ts := []struct {
+		name     string
+		input    Value
+		expected string
+	}{
+		{"channel", ch, "0:a:? 1:b:? 2:c:?"},
+		{"seq", func(yield func(string) bool) {
+			for _, v := range []string{"a", "b"} {
+				if !yield(v) {
+					return
+				}
+			}
+		}, "0:a:? 1:b:?"},
+		{"seq2", func(yield func(string, int) bool) {
+			if yield("x", 1) {
+				yield("y", 2)
+			}
+		}, "x:1:? y:2:?"},
+		{"countable iterator", &sliceIterator{vals: []Value{"a", "b"}}, "0:a:false 1:b:true"},
+		{"iterator", uncountableIterator{&sliceIterator{vals: []Value{"a", "b"}}}, "0:a:? 1:b:?"},
+	}
+	for _, test := range ts {
+		res := []string{}
+		n, err := Iterate(test.input, func(k, v Value, l Loop) (bool, error) {
+			last := "?"
+			if l.Length >= 0 {
+				last = fmt.Sprintf("%v", l.Last)
+			}
+			res = append(res, fmt.Sprintf("%s:%s:%s", CoerceString(k), CoerceString(v), last))
+			return false, nil
+		})
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected error: %s", test.name, err)
+		}
+		if n != len(res) {
+			t.Errorf("%s:\n\texpected to iterate over %d items, got %d", test.name, len(res), n)
+		}
+		if v := strings.Join(res, " "); v != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, v)
+		}
+	}
+}
+
+func TestIterate_breakLazy(t *testing.T) {
+	produced := 0
+	seq := func(yield func(int) bool) {
+		for i := 0; ; i++ {
+			produced++
+			if !yield(i) {
+				return
+			}
+		}
+	}
+	n, err := Iterate(seq, func(k, v Value, l Loop) (bool, error) {
+		return l.Index == 3, nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n != 3 || produced != 3 {
+		t.Errorf("expected to consume 3 items, iterated %d and produced %d", n, produced)
+	}
+}
+
+func TestContains(t *testing.T) {
+	ts := []struct {
+		name     string
+		haystack Value
+		needle   Value
+		expected bool
+		err      bool
+	}{
+		{"contains nil", nil, 1, false, false},
+		{"contains substring", "hello", "ell", true, false},
+		{"contains missing substring", "hello", "elk", false, false},
+		{"contains number in string", "2019", 1, true, false},
+		{"contains slice in string", "hello", []string{"h"}, false, false},
+		{"contains safe string", NewSafeValue("hello"), "ell", true, false},
+		{"contains slice", []int{1, 2}, "2", true, false},
+		{"contains slice loose", []string{"a"}, 0, false, false},
+		{"contains map value", map[string]int{"a": 1}, 1, true, false},
+		{"contains map key", map[string]int{"a": 1}, "a", false, false},
+		{"contains iterator", &sliceIterator{vals: []Value{"a", "b"}}, "b", true, false},
+		{"contains struct", struct{ name string }{"world"}, "world", false, true},
+	}
+	for _, test := range ts {
+		actual, err := Contains(test.haystack, test.needle)
+		if err == nil && test.err {
+			t.Errorf("%s:\n\texpected error, got none.", test.name)
+		} else if err != nil && !test.err {
+			t.Errorf("%s:\n\tunexpected error: %v", test.name, err)
+		}
+		if actual != test.expected {
+			t.Errorf("%s:\n\texpected: %v\n\tgot: %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestSetAttr(t *testing.T) {
+	m := map[string]int{"a": 1}
+	if err := SetAttr(m, "b", 2); err != nil || m["b"] != 2 {
+		t.Errorf("expected map attribute to be set, got %v: %v", m, err)
+	}
+	if err := SetAttr(m, "c", "x"); err == nil {
+		t.Errorf("expected error setting string in map of int")
+	}
+	if err := SetAttr(m, "d", int64(5)); err != nil || m["d"] != 5 {
+		t.Errorf("expected int64 to be converted to int, got %v: %v", m, err)
+	}
+	if err := SetAttr(m, "e", 1.5); err == nil {
+		t.Errorf("expected error setting fractional number in map of int")
+	}
+	f := map[string]float32{}
+	if err := SetAttr(f, "a", 2.5); err != nil || f["a"] != 2.5 {
+		t.Errorf("expected float64 to be converted to float32, got %v: %v", f, err)
+	}
+	b := map[string]uint8{}
+	if err := SetAttr(b, "a", int64(300)); err == nil {
+		t.Errorf("expected error setting overflowing number in map of uint8")
+	}
+	s := []Value{1, 2}
+	if err := SetAttr(s, 1, "x"); err != nil || s[1] != "x" {
+		t.Errorf("expected slice index to be set, got %v: %v", s, err)
+	}
+	p := &struct{ Name string }{"a"}
+	if err := SetAttr(p, "Name", "b"); err != nil || p.Name != "b" {
+		t.Errorf("expected struct field to be set, got %v: %v", p, err)
+	}
+	if err := SetAttr(struct{ Name string }{"a"}, "Name", "b"); err == nil {
+		t.Errorf("expected error setting field on non-pointer struct")
+	}
+	if err := SetAttr(map[string]interface{}(nil), "k", 1); err == nil {
+		t.Errorf("expected error setting key on nil map")
+	}
+	if err := SetAttr((*struct{ Name string })(nil), "Name", "b"); err == nil {
+		t.Errorf("expected error setting field on nil struct pointer")
+	}
+}